@@ -0,0 +1,97 @@
+// aggregate.go - Contains the code to maintain aggregate values, such
+// as a running total, across a number of evaluations.
+
+package calc
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// aggregate holds the state which is maintained by Accumulate.
+type aggregate struct {
+
+	// count holds the number of values we've seen.
+	count int64
+
+	// sum holds the total of the values we've seen.
+	sum interface{}
+
+	// min holds the smallest value we've seen.
+	min interface{}
+
+	// max holds the largest value we've seen.
+	max interface{}
+}
+
+// ResetAggregates sets the aggregate variables `sum`, `count`, `min`,
+// `max`, and `mean` to zero, and forgets the values previously given
+// to Accumulate.
+//
+// This allows the variables to be used even if no values are seen.
+func (e *Evaluator) ResetAggregates() {
+	e.stats = aggregate{}
+	for _, name := range []string{"count", "sum", "min", "max", "mean"} {
+		e.variables[name] = e.arith.fromInt(big.NewInt(0))
+	}
+}
+
+// Accumulate updates the aggregate variables `sum`, `count`, `min`,
+// `max`, and `mean` with the given value, which will usually be the
+// value of a NUMBER token returned by Run or Evaluate.
+//
+// An error is returned if the value cannot be combined with those
+// previously seen, for example because their units are incompatible.
+func (e *Evaluator) Accumulate(value interface{}) error {
+
+	a := e.stats
+
+	// A value which is not a number can't be the smallest or the
+	// largest, and would make the sum meaningless.
+	if _, ordered, err := e.compare(EQ, value, value); err != nil || !ordered {
+		return fmt.Errorf("%s is not a number", format(value))
+	}
+
+	if a.count == 0 {
+		a.sum = value
+		a.min = value
+		a.max = value
+	} else {
+		sum := e.apply(PLUS, a.sum, value)
+		if sum.Type != NUMBER {
+			return fmt.Errorf("%s", sum.Value)
+		}
+		a.sum = sum.Value
+
+		cmp, _, err := e.compare(LT, value, a.min)
+		if err != nil {
+			return err
+		}
+		if cmp < 0 {
+			a.min = value
+		}
+
+		cmp, _, err = e.compare(GT, value, a.max)
+		if err != nil {
+			return err
+		}
+		if cmp > 0 {
+			a.max = value
+		}
+	}
+	a.count++
+
+	count := e.arith.fromInt(big.NewInt(a.count))
+	mean := e.apply(DIVIDE, a.sum, count)
+	if mean.Type != NUMBER {
+		return fmt.Errorf("%s", mean.Value)
+	}
+
+	e.stats = a
+	e.variables["count"] = count
+	e.variables["sum"] = a.sum
+	e.variables["min"] = a.min
+	e.variables["max"] = a.max
+	e.variables["mean"] = mean.Value
+	return nil
+}
@@ -0,0 +1,213 @@
+// api.go - Contains the high-level API, which allows the calculator
+// to be embedded within other applications.
+
+package calc
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"math"
+	"math/big"
+	"sort"
+)
+
+// Limits restricts the work which may be carried out when evaluating
+// an expression, which is useful if the expression is untrusted.
+type Limits struct {
+
+	// MaxDepth is the maximum depth of nested function-calls.
+	//
+	// If this is zero a default of 1000 is used.
+	MaxDepth int
+
+	// MaxSteps is the maximum number of nodes of the AST which may
+	// be evaluated.
+	//
+	// If this is zero there is no limit.
+	MaxSteps int
+}
+
+// limitsKey is the key under which Limits are stored in a context.
+type limitsKey struct{}
+
+// WithLimits returns a copy of the given context which carries the
+// given limits, for use with EvalValue and EvaluateContext.
+func WithLimits(ctx context.Context, limits Limits) context.Context {
+	return context.WithValue(ctx, limitsKey{}, limits)
+}
+
+// limitsFrom returns the limits attached to the given context, with
+// any defaults applied.
+func limitsFrom(ctx context.Context) Limits {
+	limits, _ := ctx.Value(limitsKey{}).(Limits)
+	if limits.MaxDepth <= 0 {
+		limits.MaxDepth = maxCallDepth
+	}
+	return limits
+}
+
+// Eval evaluates the given input, and returns the result as a float64.
+//
+// Any variables or functions which are defined persist, and may be used
+// by later calls.  The definition of a function produces a result of zero.
+//
+// If arbitrary-precision is in use the result will be converted to a
+// float64, see EvalValue for the alternative.
+func (e *Evaluator) Eval(input string) (float64, error) {
+
+	val, err := e.EvalValue(context.Background(), input)
+	if err != nil {
+		return 0, err
+	}
+	return e.toFloat(val), nil
+}
+
+// EvalValue evaluates the given input, returning the result without
+// any conversion.
+//
+// The result will be a float64, a *big.Float, or a *big.Rat depending
+// upon whether SetPrecision or SetExact were called, or a *Quantity if
+// the value has a unit.  If the input defined a function the result is
+// a string containing its signature, and if the input was empty the
+// result is nil.
+//
+// Evaluation is abandoned if the context is cancelled, or if the limits
+// attached to it via WithLimits are exceeded.  Any error returned will
+// be an *Error, which records the position of the problem.
+func (e *Evaluator) EvalValue(ctx context.Context, input string) (interface{}, error) {
+
+	node, err := Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	return e.EvalNode(ctx, node)
+}
+
+// EvalNode is like EvalValue, but evaluates an AST which has already
+// been produced by Parse.
+func (e *Evaluator) EvalNode(ctx context.Context, node Node) (interface{}, error) {
+
+	out := e.EvaluateContext(ctx, node)
+	if out == nil {
+		return nil, nil
+	}
+
+	switch out.Type {
+	case ERROR:
+		return nil, &Error{Position: out.Position, Message: fmt.Sprintf("%v", out.Value)}
+	case NUMBER, FUNCTION:
+		return out.Value, nil
+	}
+	return nil, &Error{Position: out.Position, Message: fmt.Sprintf("unexpected result %v", out)}
+}
+
+// SetVariable sets the value of the given variable.
+func (e *Evaluator) SetVariable(name string, value float64) error {
+
+	v, err := e.arith.fromFloat(value)
+	if err != nil {
+		return err
+	}
+	e.variables[name] = v
+	return nil
+}
+
+// Variables returns an iterator over the names and values of all
+// the variables which are defined, in order of their names.
+//
+// If arbitrary-precision is in use the values will be converted to
+// float64, as with Variable.
+func (e *Evaluator) Variables() iter.Seq2[string, float64] {
+
+	var names []string
+	for name := range e.variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return func(yield func(string, float64) bool) {
+		for _, name := range names {
+			val, ok := e.variables[name]
+			if !ok {
+				continue
+			}
+			if !yield(name, e.toFloat(val)) {
+				return
+			}
+		}
+	}
+}
+
+// RegisterFunction makes the given Go function available to expressions,
+// under the given name.
+//
+// The function may be invoked with any number of arguments, so should
+// validate them itself.  If arbitrary-precision is in use the arguments
+// are converted to, and the result from, float64.
+//
+// It is not possible to replace one of the standard functions, but a
+// registered function replaces any user-defined function of the same name.
+func (e *Evaluator) RegisterFunction(name string, fn func(args ...float64) (float64, error)) error {
+
+	if _, ok := builtins[name]; ok {
+		return fmt.Errorf("cannot redefine built-in function %s", name)
+	}
+	if fn == nil {
+		return fmt.Errorf("nil function registered as %s", name)
+	}
+
+	delete(e.functions, name)
+	e.natives[name] = builtin{arity: anyNumber, fn: fn}
+	return nil
+}
+
+// isBuiltin returns true if the given name is a standard function, or
+// one registered via RegisterFunction.
+func (e *Evaluator) isBuiltin(name string) bool {
+	if _, ok := builtins[name]; ok {
+		return true
+	}
+	_, ok := e.natives[name]
+	return ok
+}
+
+// IsTrue returns true if the given value, as returned by EvalValue, is
+// considered to be true.
+//
+// Any non-zero number is true, as is a function signature.
+func IsTrue(value interface{}) bool {
+
+	if q, ok := value.(*Quantity); ok {
+		value = q.Value
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case *big.Float:
+		return v.Sign() != 0
+	case *big.Rat:
+		return v.Sign() != 0
+	case string:
+		return true
+	}
+	return false
+}
+
+// toFloat converts a value to a float64.
+//
+// A quantity is converted in terms of its unit, and anything which
+// isn't a number, such as the signature of a function, is zero.
+func (e *Evaluator) toFloat(v interface{}) float64 {
+
+	if q, ok := v.(*Quantity); ok {
+		v = q.Value
+	}
+
+	switch v.(type) {
+	case nil, string:
+		return 0
+	}
+	return e.arith.toFloat(v)
+}
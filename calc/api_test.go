@@ -0,0 +1,238 @@
+package calc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEval tests the simple API.
+func TestEval(t *testing.T) {
+
+	e := New()
+
+	tests := []struct {
+		input  string
+		result float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"x = 10", 10},
+		{"x / 4", 2.5},
+		{"fn double(n) = n * 2", 0},
+		{"double(x)", 20},
+		{"90s", 90},
+	}
+
+	for _, test := range tests {
+
+		out, err := e.Eval(test.input)
+		if err != nil {
+			t.Fatalf("unexpected error evaluating '%s': %s", test.input, err)
+		}
+		if !almostEqual(out, test.result) {
+			t.Fatalf("wrong result for '%s', expected %f got %f", test.input, test.result, out)
+		}
+	}
+}
+
+// TestEvalErrors ensures errors are returned as *Error.
+func TestEvalErrors(t *testing.T) {
+
+	e := New()
+
+	for _, input := range []string{"1 +", "1 / 0", "y * 2", "1GiB + 3s", "nope(3)"} {
+
+		_, err := e.Eval(input)
+		if err == nil {
+			t.Fatalf("expected error evaluating '%s'", input)
+		}
+
+		var cerr *Error
+		if !errors.As(err, &cerr) {
+			t.Fatalf("expected *Error evaluating '%s', got %T", input, err)
+		}
+		if cerr.Line != 1 || cerr.Column < 1 {
+			t.Fatalf("expected position for error evaluating '%s', got %d:%d", input, cerr.Line, cerr.Column)
+		}
+	}
+}
+
+// TestEvalValue ensures values are returned without conversion.
+func TestEvalValue(t *testing.T) {
+
+	e := New()
+	if err := e.SetExact(); err != nil {
+		t.Fatalf("failed to set exact mode: %s", err)
+	}
+
+	out, err := e.EvalValue(context.Background(), "1 / 3")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if format(out) != "1/3" {
+		t.Fatalf("wrong result %s", format(out))
+	}
+
+	out, err = e.EvalValue(context.Background(), "fn f(x) = x")
+	if err != nil || out != "fn f(x) = x" {
+		t.Fatalf("expected signature, got %v %v", out, err)
+	}
+
+	out, err = e.EvalValue(context.Background(), "")
+	if err != nil || out != nil {
+		t.Fatalf("expected nothing, got %v %v", out, err)
+	}
+}
+
+// TestVariables tests setting, and iterating over, variables.
+func TestVariables(t *testing.T) {
+
+	e := New()
+	if err := e.SetVariable("width", 3); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := e.SetVariable("height", 4); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out, err := e.Eval("width * height")
+	if err != nil || out != 12 {
+		t.Fatalf("unexpected result %f %v", out, err)
+	}
+
+	var names []string
+	for name, val := range e.Variables() {
+		names = append(names, fmt.Sprintf("%s=%g", name, val))
+	}
+
+	expected := fmt.Sprintf("e=%g,height=4,pi=%g,result=12,width=3", math.E, math.Pi)
+	if strings.Join(names, ",") != expected {
+		t.Fatalf("wrong variables, expected %s got %s", expected, strings.Join(names, ","))
+	}
+
+	// Stopping early is fine.
+	for name := range e.Variables() {
+		if name != "e" {
+			t.Fatalf("expected to stop after the first variable")
+		}
+		break
+	}
+
+	// Exact mode cannot represent infinity.
+	if err := e.SetExact(); err != nil {
+		t.Fatalf("failed to set exact mode: %s", err)
+	}
+	if err := e.SetVariable("x", math.Inf(1)); err == nil {
+		t.Fatalf("expected error setting infinity")
+	}
+}
+
+// TestRegisterFunction tests functions implemented in Go.
+func TestRegisterFunction(t *testing.T) {
+
+	e := New()
+
+	err := e.RegisterFunction("sum", func(args ...float64) (float64, error) {
+		total := 0.0
+		for _, a := range args {
+			total += a
+		}
+		return total, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = e.RegisterFunction("fail", func(args ...float64) (float64, error) {
+		return 0, fmt.Errorf("this always fails")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out, err := e.Eval("sum() + sum(1) + sum(1, 2, 3)")
+	if err != nil || out != 7 {
+		t.Fatalf("unexpected result %f %v", out, err)
+	}
+
+	_, err = e.Eval("2 * fail(1)")
+	if err == nil || !strings.Contains(err.Error(), "always fails") {
+		t.Fatalf("expected error, got %v", err)
+	}
+
+	_, err = e.Eval("fn sum(a) = a")
+	if err == nil || !strings.Contains(err.Error(), "cannot redefine") {
+		t.Fatalf("expected error redefining function, got %v", err)
+	}
+
+	err = e.RegisterFunction("sqrt", func(args ...float64) (float64, error) {
+		return 0, nil
+	})
+	if err == nil {
+		t.Fatalf("expected error replacing a standard function")
+	}
+
+	found := false
+	for _, name := range e.Functions() {
+		if name == "sum" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("registered function missing from Functions()")
+	}
+}
+
+// TestLimits ensures that evaluation may be limited.
+func TestLimits(t *testing.T) {
+
+	// Each level doubles the work, so this takes a very long time.
+	slow := "fn a(x) = x + x; "
+	prev := "a"
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("f%d", i)
+		slow += fmt.Sprintf("fn %s(x) = %s(x) + %s(x); ", name, prev, prev)
+		prev = name
+	}
+	slow += prev + "(1)"
+
+	e := New()
+	ctx := WithLimits(context.Background(), Limits{MaxSteps: 10000})
+	_, err := e.EvalValue(ctx, slow)
+	if err == nil || !strings.Contains(err.Error(), "limit of 10000 steps") {
+		t.Fatalf("expected step limit to be hit, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = e.EvalValue(ctx, slow)
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	ctx = WithLimits(context.Background(), Limits{MaxDepth: 10})
+	_, err = e.EvalValue(ctx, "fn r(x) = r(x); r(1)")
+	if err == nil || !strings.Contains(err.Error(), "maximum call depth") {
+		t.Fatalf("expected depth limit to be hit, got %v", err)
+	}
+
+	// Limits don't persist once the evaluation is complete.
+	out, err := e.Eval("f3(1)")
+	if err != nil || out != 32 {
+		t.Fatalf("unexpected result %f %v", out, err)
+	}
+
+	// Hostile nesting is rejected by the parser.
+	_, err = e.Eval(strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000))
+	if err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Fatalf("expected nesting error, got %v", err)
+	}
+	_, err = e.Eval(strings.Repeat("-", 100000) + "1")
+	if err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Fatalf("expected nesting error, got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+// ast.go - Contains the node-types which make up our abstract syntax tree.
+//
+// The parser converts a stream of tokens into a tree of these nodes,
+// which may then be evaluated as many times as required.
+
+package calc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Node is the interface which is implemented by every node in our AST.
+type Node interface {
+
+	// String returns a readable representation of the node.
+	//
+	// Binary and unary operations are fully parenthesized, which
+	// makes the precedence chosen by the parser explicit.
+	String() string
+
+	// Pos returns the position of the node within our input, which
+	// is used to report the location of errors.
+	Pos() Position
+}
+
+// Program holds a series of statements, which are executed in turn.
+type Program struct {
+
+	// Position holds the location of the first statement.
+	Position
+
+	// Statements contains each statement we've parsed.
+	Statements []Node
+}
+
+// String returns a readable representation of the program.
+func (p *Program) String() string {
+	out := make([]string, len(p.Statements))
+	for i, s := range p.Statements {
+		out[i] = s.String()
+	}
+	return strings.Join(out, "; ")
+}
+
+// NumberLiteral holds a literal number.
+type NumberLiteral struct {
+
+	// Position holds the location of the number.
+	Position
+
+	// Value holds the value of the number.
+	Value float64
+
+	// Literal holds the number as it appeared in our input, which
+	// is used when evaluating with more precision than a float64.
+	Literal string
+
+	// Unit holds the name of the unit attached to the number, if any.
+	Unit string
+}
+
+// String returns a readable representation of the number.
+func (n *NumberLiteral) String() string {
+	if n.Literal != "" {
+		return n.Literal + n.Unit
+	}
+	return fmt.Sprintf("%v%s", n.Value, n.Unit)
+}
+
+// Identifier holds a reference to a variable.
+type Identifier struct {
+
+	// Position holds the location of the name.
+	Position
+
+	// Name holds the name of the variable.
+	Name string
+}
+
+// String returns the name of the variable.
+func (i *Identifier) String() string {
+	return i.Name
+}
+
+// Assignment sets a variable to the result of an expression.
+type Assignment struct {
+
+	// Position holds the location of the variable-name.
+	Position
+
+	// Name holds the name of the variable which is being set.
+	Name string
+
+	// Value holds the expression to be assigned.
+	Value Node
+}
+
+// String returns a readable representation of the assignment.
+func (a *Assignment) String() string {
+	return fmt.Sprintf("%s = %s", a.Name, a.Value.String())
+}
+
+// PrefixExpression holds a unary operation, such as "-x".
+type PrefixExpression struct {
+
+	// Position holds the location of the operator.
+	Position
+
+	// Operator holds the token-type of the operator.
+	Operator string
+
+	// Right holds the operand.
+	Right Node
+}
+
+// String returns a readable representation of the prefix expression.
+func (p *PrefixExpression) String() string {
+	if p.Operator == NOT {
+		return fmt.Sprintf("(not %s)", p.Right.String())
+	}
+	return fmt.Sprintf("(%s%s)", p.Operator, p.Right.String())
+}
+
+// InfixExpression holds a binary operation, such as "a + b".
+type InfixExpression struct {
+
+	// Position holds the location of the operator.
+	Position
+
+	// Left holds the left operand.
+	Left Node
+
+	// Operator holds the token-type of the operator.
+	Operator string
+
+	// Right holds the right operand.
+	Right Node
+}
+
+// String returns a readable representation of the infix expression.
+func (i *InfixExpression) String() string {
+	return fmt.Sprintf("(%s %s %s)", i.Left.String(), i.Operator, i.Right.String())
+}
+
+// CallExpression holds a call to a function, such as "sqrt(2)".
+type CallExpression struct {
+
+	// Position holds the location of the function-name.
+	Position
+
+	// Function holds the name of the function being invoked.
+	Function string
+
+	// Arguments holds the expressions passed as arguments.
+	Arguments []Node
+}
+
+// String returns a readable representation of the call.
+func (c *CallExpression) String() string {
+	args := make([]string, len(c.Arguments))
+	for i, a := range c.Arguments {
+		args[i] = a.String()
+	}
+	return fmt.Sprintf("%s(%s)", c.Function, strings.Join(args, ", "))
+}
+
+// FunctionDefinition holds a user-defined function, such as
+// "fn double(x) = x * 2".
+type FunctionDefinition struct {
+
+	// Position holds the location of the "fn" keyword.
+	Position
+
+	// Name holds the name of the function.
+	Name string
+
+	// Parameters holds the names of the function's parameters.
+	Parameters []string
+
+	// Body holds the expression which is evaluated when the
+	// function is called.
+	Body Node
+}
+
+// String returns a readable representation of the definition.
+func (f *FunctionDefinition) String() string {
+	return fmt.Sprintf("fn %s(%s) = %s", f.Name, strings.Join(f.Parameters, ", "), f.Body.String())
+}
+
+// Conversion converts the result of an expression to a different unit,
+// such as "2h to minutes".
+type Conversion struct {
+
+	// Position holds the location of the "to" or "in".
+	Position
+
+	// Value holds the expression to be converted.
+	Value Node
+
+	// Unit holds the name of the unit to convert to.
+	Unit string
+}
+
+// String returns a readable representation of the conversion.
+func (c *Conversion) String() string {
+	return fmt.Sprintf("(%s to %s)", c.Value.String(), c.Unit)
+}
+
+// Conditional holds a conditional expression, which may be written as
+// "if a then b else c", or "a ? b : c".
+type Conditional struct {
+
+	// Position holds the location of the "if" or "?".
+	Position
+
+	// Condition is the expression which is tested.
+	Condition Node
+
+	// Consequence is evaluated if the condition is true.
+	Consequence Node
+
+	// Alternative is evaluated if the condition is false.
+	Alternative Node
+}
+
+// String returns a readable representation of the conditional.
+func (c *Conditional) String() string {
+	return fmt.Sprintf("(if %s then %s else %s)", c.Condition.String(), c.Consequence.String(), c.Alternative.String())
+}
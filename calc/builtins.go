@@ -0,0 +1,114 @@
+// builtins.go - Contains the standard library of functions which are
+// available to all expressions.
+
+package calc
+
+import (
+	"fmt"
+	"math"
+)
+
+// These constants are used as the arity of functions which accept
+// a variable number of arguments.
+const (
+	// oneOrMore is the arity of a function which requires at least
+	// one argument.
+	oneOrMore = -1
+
+	// anyNumber is the arity of a function which accepts any number
+	// of arguments, including none.
+	anyNumber = -2
+)
+
+// builtin holds a function which is implemented in Go.
+type builtin struct {
+
+	// arity holds the number of arguments the function requires,
+	// or one of oneOrMore or anyNumber.
+	arity int
+
+	// fn is the implementation of the function.
+	fn func(args ...float64) (float64, error)
+}
+
+// unary is a helper to wrap a function from the math package which
+// accepts a single argument.
+func unary(fn func(float64) float64) builtin {
+	return builtin{arity: 1, fn: func(args ...float64) (float64, error) {
+		return fn(args[0]), nil
+	}}
+}
+
+// binary is a helper to wrap a function from the math package which
+// accepts two arguments.
+func binary(fn func(float64, float64) float64) builtin {
+	return builtin{arity: 2, fn: func(args ...float64) (float64, error) {
+		return fn(args[0], args[1]), nil
+	}}
+}
+
+// builtins contains the functions which are available by default.
+var builtins = map[string]builtin{
+	"abs":   unary(math.Abs),
+	"acos":  unary(math.Acos),
+	"asin":  unary(math.Asin),
+	"atan":  unary(math.Atan),
+	"atan2": binary(math.Atan2),
+	"cbrt":  unary(math.Cbrt),
+	"ceil":  unary(math.Ceil),
+	"cos":   unary(math.Cos),
+	"cosh":  unary(math.Cosh),
+	"exp":   unary(math.Exp),
+	"floor": unary(math.Floor),
+	"hypot": binary(math.Hypot),
+	"ln":    unary(math.Log),
+	"log":   unary(math.Log),
+	"log10": unary(math.Log10),
+	"log2":  unary(math.Log2),
+	"pow":   binary(math.Pow),
+	"round": unary(math.Round),
+	"sin":   unary(math.Sin),
+	"sinh":  unary(math.Sinh),
+	"sqrt":  unary(math.Sqrt),
+	"tan":   unary(math.Tan),
+	"tanh":  unary(math.Tanh),
+	"trunc": unary(math.Trunc),
+
+	"max": {arity: oneOrMore, fn: func(args ...float64) (float64, error) {
+		res := args[0]
+		for _, a := range args[1:] {
+			res = math.Max(res, a)
+		}
+		return res, nil
+	}},
+	"min": {arity: oneOrMore, fn: func(args ...float64) (float64, error) {
+		res := args[0]
+		for _, a := range args[1:] {
+			res = math.Min(res, a)
+		}
+		return res, nil
+	}},
+}
+
+// call invokes the builtin with the given arguments, after ensuring
+// the argument-count is correct.
+func (b builtin) call(name string, args []float64) (float64, error) {
+
+	if b.arity == oneOrMore && len(args) < 1 {
+		return 0, fmt.Errorf("%s() expects at least 1 argument, got %d", name, len(args))
+	}
+	if b.arity >= 0 && len(args) != b.arity {
+		return 0, fmt.Errorf("%s() expects %d argument(s), got %d", name, b.arity, len(args))
+	}
+
+	res, err := b.fn(args...)
+	if err != nil {
+		return 0, err
+	}
+
+	// Catch things like sqrt(-1), or log(-1).
+	if math.IsNaN(res) {
+		return 0, fmt.Errorf("%s%v is not a number", name, args)
+	}
+	return res, nil
+}
@@ -5,6 +5,22 @@
 //	-
 //	*
 //	/
+//	%         (modulus)
+//	^ or **   (exponentiation, which is right-associative)
+//
+// Integers may be written in hex (0xff), octal (0o755), or binary
+// (0b1010), and the bitwise operators "&", "|", "xor", "~", "<<", and
+// ">>" may be used upon integer values.  Since "^" is used for
+// exponentiation exclusive-or is spelled "xor", rather than "^" as in C.
+//
+// The comparison operators "<", "<=", "==", "!=", ">=", and ">" produce
+// 1 for true and 0 for false, and may be combined via "and", "or", and
+// "not".  Conditionals may be written as "if a then b else c", or as
+// "a ? b : c", and "#" introduces a comment which runs to the end of
+// the line.
+//
+// Unary "+", "-", and "~" may be applied to any expression, for example
+// `-(2 + 3)` or `-pi`, and parentheses may be used to group terms.
 //
 // In addition to the basic operations it is also possible to
 // declare variables via `let name = xxx`, for example:
@@ -13,4 +29,52 @@
 //	a / 9        -> 0.3333
 //
 // The two variables `pi` and `e` are available by default.
+//
+// Functions may be invoked, for example `sqrt(2)` or `max(1, 2, 3)`,
+// and a standard library of functions backed by the math package is
+// available.  You may define your own functions too:
+//
+//	fn hyp(a, b) = sqrt(a*a + b*b)
+//	hyp(3, 4)    -> 5
+//
+// Numbers may have a unit of data or time attached, such as "1.5GiB",
+// "300ms", or "80MB/s", in which case the result is a *Quantity.
+// Arithmetic upon quantities is dimensionally checked, and "to" or "in"
+// may be used to convert between units:
+//
+//	(12GiB / 80MB/s) to minutes
+//
+// By default values are stored as float64, but SetPrecision may be
+// used to switch to arbitrary-precision *big.Float values, and SetExact
+// to switch to exact *big.Rat values.
+//
+// SetNumber may be used to set variables from text, and Accumulate
+// maintains the aggregate variables sum, count, min, max, and mean,
+// which is useful when evaluating an expression against many inputs.
+//
+// The user-defined variables and functions may be written out via
+// Evaluator.Save, and later restored via Load and Run.
+//
+// Input is parsed into an AST, via Parse, which may be evaluated
+// as many times as you wish via Evaluator.Evaluate.
+//
+// Every Token, and every node of the AST, records its Position within
+// the input.  Parse returns an *Error, which records the location of
+// the problem, and ERROR tokens returned by the evaluator record the
+// position of the expression which failed.
+//
+// The simplest way to embed the calculator is via Eval:
+//
+//	e := calc.New()
+//	e.SetVariable("width", 3)
+//	e.RegisterFunction("double", func(args ...float64) (float64, error) {
+//		return args[0] * 2, nil
+//	})
+//	out, err := e.Eval("double(width) + 1")
+//
+// If you're evaluating untrusted input use EvalValue, with a context
+// which has a deadline, or which carries Limits via WithLimits:
+//
+//	ctx := calc.WithLimits(context.Background(), calc.Limits{MaxSteps: 10000})
+//	out, err := e.EvalValue(ctx, input)
 package calc
@@ -0,0 +1,22 @@
+// error.go - Contains the error-type we return, which records where
+// in the input a problem was found.
+
+package calc
+
+// Error is the type of error returned by Parse.
+//
+// It records the position within the input at which the problem was
+// found, so that it may be shown to the user.
+type Error struct {
+
+	// Position holds the location of the problem.
+	Position
+
+	// Message describes the problem.
+	Message string
+}
+
+// Error returns the description of the problem, without the position.
+func (e *Error) Error() string {
+	return e.Message
+}
@@ -1,22 +1,61 @@
 package calc
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"math/big"
+	"sort"
+	"strings"
 )
 
+// maxCallDepth is the default maximum depth of nested function-calls
+// we allow, which prevents runaway recursion from exhausting the stack.
+const maxCallDepth = 1000
+
+// checkInterval is the number of steps between checks to see if the
+// context we were given has been cancelled.
+const checkInterval = 1024
+
 // Evaluator holds the state of the evaluation-object.
 type Evaluator struct {
 
-	// tokens holds the series of tokens which our
-	// lexer produced from our input.
-	tokens []*Token
+	// program holds the AST which was produced by parsing the
+	// input given to Load.
+	program Node
 
-	// Current position within the array of tokens.
-	token int
+	// err holds any error which was encountered when parsing
+	// the input given to Load.
+	err error
+
+	// arith implements the arithmetic for the numeric mode we're
+	// using; float64, *big.Float, or *big.Rat.
+	arith arithmetic
 
 	// holder for any variables the user has defined.
-	variables map[string]float64
+	//
+	// The values will be of the type used by our arithmetic.
+	variables map[string]interface{}
+
+	// holder for any functions the user has defined.
+	functions map[string]*FunctionDefinition
+
+	// holder for any functions registered via RegisterFunction.
+	natives map[string]builtin
+
+	// depth records how deeply nested our function-calls are.
+	depth int
+
+	// ctx is the context of the current evaluation, which may be
+	// cancelled, and limits holds the limits attached to it.
+	ctx    context.Context
+	limits Limits
+
+	// steps records the number of nodes we've evaluated.
+	steps int
+
+	// stats holds the state maintained by Accumulate.
+	stats aggregate
 }
 
 // New creates a new evaluation object.
@@ -29,8 +68,13 @@ func New() *Evaluator {
 	// Create the new object.
 	e := &Evaluator{}
 
+	// Default to using float64 values.
+	e.arith = floatArith{}
+
 	// Populate the variable storage-store.
-	e.variables = make(map[string]float64)
+	e.variables = make(map[string]interface{})
+	e.functions = make(map[string]*FunctionDefinition)
+	e.natives = make(map[string]builtin)
 
 	// Load default constants.
 	e.variables["pi"] = math.Pi
@@ -39,311 +83,628 @@ func New() *Evaluator {
 	return e
 }
 
+// SetPrecision switches the evaluator to use arbitrary-precision
+// floating-point arithmetic, with the given number of bits of mantissa.
+//
+// NUMBER tokens returned by Run will contain a *big.Float.
+func (e *Evaluator) SetPrecision(bits uint) error {
+	if bits == 0 {
+		return fmt.Errorf("precision must be greater than zero")
+	}
+	return e.setArithmetic(bigFloatArith{prec: bits})
+}
+
+// SetExact switches the evaluator to use exact rational arithmetic.
+//
+// NUMBER tokens returned by Run will contain a *big.Rat.
+func (e *Evaluator) SetExact() error {
+	return e.setArithmetic(ratArith{})
+}
+
+// setArithmetic changes the mode of arithmetic we use, converting any
+// existing variables to the new mode.
+//
+// The constants pi and e are reloaded with as much precision as the
+// new mode allows.
+func (e *Evaluator) setArithmetic(a arithmetic) error {
+
+	for name, val := range e.variables {
+		v, err := convert(a, val)
+		if err != nil {
+			return fmt.Errorf("failed to convert variable %s: %s", name, err)
+		}
+		e.variables[name] = v
+	}
+	e.arith = a
+
+	if _, ok := a.(floatArith); ok {
+		e.variables["pi"] = math.Pi
+		e.variables["e"] = math.E
+		return nil
+	}
+
+	pi, err := a.parse(piDigits)
+	if err != nil {
+		return err
+	}
+	e.variables["pi"] = pi
+
+	eVal, err := a.parse(eDigits)
+	if err != nil {
+		return err
+	}
+	e.variables["e"] = eVal
+
+	return nil
+}
+
 // Variable allows you to return the value of the given variable
+//
+// If arbitrary-precision is in use the value will be converted
+// to a float64, see Value for the alternative.
 func (e *Evaluator) Variable(name string) (float64, bool) {
+	res, ok := e.variables[name]
+	if !ok {
+		return 0, false
+	}
+
+	// A quantity is returned in terms of its unit.
+	return e.toFloat(res), true
+}
+
+// Value allows you to return the value of the given variable, without
+// any conversion.
+//
+// The result will be a float64, a *big.Float, or a *big.Rat depending
+// upon whether SetPrecision or SetExact were called, or a *Quantity if
+// the value has a unit.
+func (e *Evaluator) Value(name string) (interface{}, bool) {
 	res, ok := e.variables[name]
 	return res, ok
 }
 
+// SetNumber sets the value of the given variable, by parsing the given
+// text as a number, which may be negative and may have a unit attached.
+//
+// An error is returned if the text is not a number, in which case the
+// variable is left unchanged.
+func (e *Evaluator) SetNumber(name string, text string) error {
+
+	l := NewLexer(strings.TrimSpace(text))
+
+	tok := l.Next()
+	sign := ""
+	if tok.Type == MINUS || tok.Type == PLUS {
+		sign = tok.Type
+		tok = l.Next()
+	}
+	if tok.Type != NUMBER || l.Next().Type != EOF {
+		return fmt.Errorf("'%s' is not a number", text)
+	}
+
+	var node Node = &NumberLiteral{Value: tok.Value.(float64), Literal: tok.Literal, Unit: tok.Unit}
+	if sign != "" {
+		node = &PrefixExpression{Operator: sign, Right: node}
+	}
+
+	out := e.Evaluate(node)
+	if out.Type != NUMBER {
+		return fmt.Errorf("%s", out.Value)
+	}
+	e.variables[name] = out.Value
+	return nil
+}
+
+// Unset removes the given variable, if it exists.
+func (e *Evaluator) Unset(name string) {
+	delete(e.variables, name)
+}
+
+// Functions returns the sorted names of all the functions which are
+// available, whether built-in, registered, or user-defined.
+func (e *Evaluator) Functions() []string {
+	var names []string
+	for name := range builtins {
+		names = append(names, name)
+	}
+	for name := range e.natives {
+		names = append(names, name)
+	}
+	for name := range e.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // Load is used to load a program into the evaluator.
 //
 // Note that the existing variables will maintain their state
 // if not reset explicitly.
 func (e *Evaluator) Load(input string) {
+	e.program, e.err = Parse(input)
+}
 
-	// Create a lexer for splitting the program
-	lexer := NewLexer(input)
-
-	// Remove any existing tokens
-	e.tokens = nil
+// Run launches the program we've loaded.
+//
+// If multiple statements are available each are executed in turn,
+// and the result of the last one returned.  However errors will
+// cause early-termination.
+func (e *Evaluator) Run() *Token {
 
-	// Parse the input into tokens, and
-	// save them away.
-	for {
-		tok := lexer.Next()
-		if tok.Type == EOF {
-			break
+	// Did we fail to parse?
+	if e.err != nil {
+		tok := &Token{Type: ERROR, Value: e.err.Error()}
+		if perr, ok := e.err.(*Error); ok {
+			tok.Position = perr.Position
 		}
-		e.tokens = append(e.tokens, tok)
+		return tok
 	}
 
-	// Add an extra pair of EOF tokens so that nextToken
-	// can always be called
-	e.tokens = append(e.tokens, &Token{Value: "EOF", Type: EOF})
-	e.tokens = append(e.tokens, &Token{Value: "EOF", Type: EOF})
-	e.token = 0
+	return e.Evaluate(e.program)
 }
 
-// nextToken returns the next token from our input.
+// Evaluate executes the given AST, which will have been produced by
+// Parse, and returns the result.
+//
+// The result of a Program is stored in the `result` variable, and
+// the AST may be evaluated as many times as you wish.
 //
-// When Load is called the input-expression is broken
-// down into a series of Tokens, and this function
-// advances to the next token, returning it.
-func (e *Evaluator) nextToken() *Token {
-	tok := e.tokens[e.token]
-	e.token++
-	return tok
+// An ERROR token records the position of the expression which failed.
+func (e *Evaluator) Evaluate(node Node) *Token {
+	return e.EvaluateContext(context.Background(), node)
 }
 
-// peekToken returns the next pending token in our stream.
-//
-// NOTE it is always possible to peek at the next token,
-// because we deliberately add an extra/spare EOF token
-// in our constructor.
-func (e *Evaluator) peekToken() *Token {
-	tok := e.tokens[e.token]
-	return tok
+// EvaluateContext is like Evaluate, but evaluation is abandoned if
+// the given context is cancelled, or if the Limits attached to it via
+// WithLimits are exceeded.
+func (e *Evaluator) EvaluateContext(ctx context.Context, node Node) *Token {
+
+	e.ctx = ctx
+	e.limits = limitsFrom(ctx)
+	e.steps = 0
+	e.depth = 0
+
+	return e.evaluate(node)
 }
 
-// term() - return a term
-func (e *Evaluator) term() *Token {
+// evaluate executes the given node, after ensuring we've not exceeded
+// our limits.
+func (e *Evaluator) evaluate(node Node) *Token {
 
-	f1 := e.factor()
+	// We might have nothing to run.
+	if node == nil {
+		return nil
+	}
 
-	// error handling
-	if f1.Type == ERROR {
-		return f1
+	e.steps++
+	if e.limits.MaxSteps > 0 && e.steps > e.limits.MaxSteps {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("evaluation exceeded the limit of %d steps", e.limits.MaxSteps), Position: node.Pos()}
+	}
+	if e.steps%checkInterval == 0 && e.ctx.Err() != nil {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("evaluation abandoned: %s", e.ctx.Err()), Position: node.Pos()}
 	}
 
-	op := e.peekToken()
-	for op.Type == MULTIPLY || op.Type == DIVIDE {
+	result := e.eval(node)
 
-		op = e.nextToken()
+	// Errors are reported at the position of the innermost node
+	// which caused them, so we only set the position once.
+	if result != nil && result.Type == ERROR && result.Line == 0 {
+		result.Position = node.Pos()
+	}
+	return result
+}
 
-		f2 := e.factor()
+// eval executes the given node.
+func (e *Evaluator) eval(node Node) *Token {
 
-		if f1.Type != NUMBER {
-			return &Token{Type: ERROR, Value: fmt.Sprintf("%v is not a number", f1)}
-		}
-		if f2.Type != NUMBER {
-			return &Token{Type: ERROR, Value: fmt.Sprintf("%v is not a number", f2)}
+	switch n := node.(type) {
+	case *Program:
+		return e.evalProgram(n)
+	case *NumberLiteral:
+		return e.evalNumber(n)
+	case *Identifier:
+		val, ok := e.variables[n.Name]
+		if ok {
+			return &Token{Type: NUMBER, Value: val}
 		}
+		return &Token{Type: ERROR, Value: fmt.Sprintf("undefined variable: %s", n.Name)}
+	case *Assignment:
+		result := e.evaluate(n.Value)
 
-		if op.Type == MULTIPLY {
-			f1.Value = f1.Value.(float64) * f2.Value.(float64)
+		// Save it, and also return the value.
+		if result.Type == NUMBER {
+			e.variables[n.Name] = result.Value
 		}
-		if op.Type == DIVIDE {
-			if f2.Value.(float64) == 0 {
-				f1 = &Token{Type: ERROR, Value: fmt.Sprintf("Attempted division by zero: %v/%v", f1, f2)}
-			} else {
-				f1.Value = f1.Value.(float64) / f2.Value.(float64)
-			}
+		return result
+	case *FunctionDefinition:
+		if e.isBuiltin(n.Name) {
+			return &Token{Type: ERROR, Value: fmt.Sprintf("cannot redefine built-in function %s", n.Name)}
 		}
+		e.functions[n.Name] = n
+		return &Token{Type: FUNCTION, Value: n.String()}
+	case *CallExpression:
+		return e.evalCall(n)
+	case *Conversion:
+		return e.evalConversion(n)
+	case *Conditional:
+		return e.evalConditional(n)
+	case *PrefixExpression:
+		return e.evalPrefix(n)
+	case *InfixExpression:
+		return e.evalInfix(n)
+	}
 
-		op = e.peekToken()
+	return &Token{Type: ERROR, Value: fmt.Sprintf("unknown node-type %T", node)}
+}
+
+// evalProgram executes each statement in turn, returning the result
+// of the last one.
+func (e *Evaluator) evalProgram(program *Program) *Token {
+
+	var result *Token
+
+	// Process each statement
+	for _, stmt := range program.Statements {
+
+		// Get the result
+		result = e.evaluate(stmt)
+
+		// Error? Then abort
+		if result.Type == ERROR {
+			return result
+		}
 	}
 
-	if op.Type == ERROR {
-		return &Token{Type: ERROR, Value: fmt.Sprintf("Unexpected token inside term() - %v\n", op)}
+	// If we evaluated something we'll have a result which
+	// we'll save in the `result` variable.
+	//
+	// (We might receive input such as "", which will result
+	// in nothing being evaluated)
+	if result != nil && result.Type == NUMBER {
+		e.variables["result"] = result.Value
 	}
 
-	return f1
+	// All done.
+	return result
 }
 
-// expr() parse an expression
-func (e *Evaluator) expr() *Token {
+// evalPrefix handles unary operations.
+func (e *Evaluator) evalPrefix(n *PrefixExpression) *Token {
 
-	t1 := e.term()
-
-	//
-	// If we have an assignment we'll save the result
-	// of the expression here.
-	//
-	// We do this to avoid repetition for "let x = ..." and
-	// "y = ..."
-	//
-	variable := &Token{Type: ERROR, Value: "cant happen"}
+	right := e.evaluate(n.Right)
+	if right.Type != NUMBER {
+		return right
+	}
 
-	//
-	// Assignment without LET ?
-	//
-	if t1.Type == IDENT {
-		nxt := e.peekToken()
-		if nxt.Type == ASSIGN {
+	if n.Operator == NOT {
+		return e.boolean(!IsTrue(right.Value))
+	}
 
-			// Skip the assignment
-			e.nextToken()
+	if q, ok := right.Value.(*Quantity); ok {
+		switch n.Operator {
+		case MINUS:
+			return &Token{Type: NUMBER, Value: &Quantity{Value: e.arith.negate(q.Value), Unit: q.Unit}}
+		case PLUS:
+			return right
+		}
+		return &Token{Type: ERROR, Value: fmt.Sprintf("operator %s cannot be used with units, got %s", n.Operator, format(q))}
+	}
 
-			// And we've found a variable to assign to
-			variable = t1
+	switch n.Operator {
+	case MINUS:
+		return &Token{Type: NUMBER, Value: e.arith.negate(right.Value)}
+	case PLUS:
+		return right
+	case BITNOT:
+		i, ok := e.arith.toInt(right.Value)
+		if !ok {
+			return &Token{Type: ERROR, Value: fmt.Sprintf("bitwise operator %s requires an integer, got %s", n.Operator, format(right.Value))}
 		}
+		return &Token{Type: NUMBER, Value: e.arith.fromInt(i.Not(i))}
 	}
 
-	//
-	// Assignment with LET
-	//
-	if t1.Type == LET {
+	return &Token{Type: ERROR, Value: fmt.Sprintf("unknown prefix operator %s", n.Operator)}
+}
+
+// evalInfix handles binary operations.
+func (e *Evaluator) evalInfix(n *InfixExpression) *Token {
+
+	left := e.evaluate(n.Left)
+	if left.Type != NUMBER {
+		return left
+	}
 
-		// Get the identifier.
-		ident := e.nextToken()
-		if ident.Type != IDENT {
-			return &Token{Type: ERROR, Value: fmt.Sprintf("%v is not an identifier", ident)}
+	// The logical operators only evaluate their right side if
+	// they need to.
+	if n.Operator == AND || n.Operator == OR {
+		if IsTrue(left.Value) == (n.Operator == OR) {
+			return e.boolean(n.Operator == OR)
 		}
 
-		// Skip the assignment statement
-		assign := e.nextToken()
-		if assign.Type != ASSIGN {
-			return &Token{Type: ERROR, Value: fmt.Sprintf("%v is not an assignment statement", ident)}
+		right := e.evaluate(n.Right)
+		if right.Type != NUMBER {
+			return right
 		}
+		return e.boolean(IsTrue(right.Value))
+	}
 
-		variable = ident
+	right := e.evaluate(n.Right)
+	if right.Type != NUMBER {
+		return right
 	}
 
-	//
-	// OK if we have an assignment, of either form, then
-	// process it here.
-	//
-	if variable.Type == IDENT {
+	return e.apply(n.Operator, left.Value, right.Value)
+}
 
-		// Calculate the result
-		result := e.expr()
+// apply performs the given binary operation upon two values.
+func (e *Evaluator) apply(op string, a, b interface{}) *Token {
 
-		// Save it, and also return the value.
-		if result.Type == NUMBER {
-			e.variables[variable.Value.(string)] = result.Value.(float64)
-		}
-		return result
+	switch op {
+	case LT, LE, EQ, NE, GE, GT:
+		return e.evalComparison(op, a, b)
 	}
 
-	//
-	// If we reach here we're now done with assignments.
-	//
-	tok := e.peekToken()
-	for tok.Type == PLUS || tok.Type == MINUS {
+	// Values with units are handled separately.
+	if isQuantity(a) || isQuantity(b) {
+		return e.evalUnits(op, a, b)
+	}
+
+	switch op {
+	case BITAND, BITOR, XOR, LSHIFT, RSHIFT:
+		return e.evalBitwise(op, a, b)
+	}
 
-		tok = e.nextToken()
-		t2 := e.term()
+	if (op == DIVIDE || op == MODULO) && e.arith.isZero(b) {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("Attempted division by zero: %s%s%s", format(a), op, format(b))}
+	}
 
-		if t1.Type != NUMBER {
-			return &Token{Type: ERROR, Value: fmt.Sprintf("%v is not a number", t1)}
-		}
-		if t2.Type != NUMBER {
-			return &Token{Type: ERROR, Value: fmt.Sprintf("%v is not a number", t2)}
+	res, err := e.arith.infix(op, a, b)
+	if err != nil {
+		return &Token{Type: ERROR, Value: err.Error()}
+	}
+	return &Token{Type: NUMBER, Value: res}
+}
+
+// evalComparison handles the comparison operators.
+func (e *Evaluator) evalComparison(op string, a, b interface{}) *Token {
+
+	cmp, ordered, err := e.compare(op, a, b)
+	if err != nil {
+		return &Token{Type: ERROR, Value: err.Error()}
+	}
+
+	// A value which is not a number is unequal to everything,
+	// including itself.
+	if !ordered {
+		return e.boolean(op == NE)
+	}
+
+	switch op {
+	case LT:
+		return e.boolean(cmp < 0)
+	case LE:
+		return e.boolean(cmp <= 0)
+	case EQ:
+		return e.boolean(cmp == 0)
+	case NE:
+		return e.boolean(cmp != 0)
+	case GE:
+		return e.boolean(cmp >= 0)
+	}
+	return e.boolean(cmp > 0)
+}
+
+// compare returns -1, 0, or +1 depending upon whether a is less than,
+// equal to, or greater than b, and false if they are unordered because
+// one of them is not a number.
+//
+// Values with units are compared in our base-units.  The operator is
+// only used to describe the problem if the values cannot be compared.
+func (e *Evaluator) compare(op string, a, b interface{}) (int, bool, error) {
+
+	av, au := unitOf(a)
+	bv, bu := unitOf(b)
+
+	if au != nil || bu != nil {
+		if au == nil || bu == nil || au.dim != bu.dim {
+			return 0, false, fmt.Errorf("incompatible units for %s: %s and %s", op, nameOf(au), nameOf(bu))
 		}
 
-		if tok.Type == PLUS {
-			t1.Value = t1.Value.(float64) + t2.Value.(float64)
+		var err error
+		av, err = e.toBase(av, au)
+		if err != nil {
+			return 0, false, err
 		}
-		if tok.Type == MINUS {
-			t1.Value = t1.Value.(float64) - t2.Value.(float64)
+		bv, err = e.toBase(bv, bu)
+		if err != nil {
+			return 0, false, err
 		}
+	}
+
+	cmp, ordered := e.arith.cmp(av, bv)
+	return cmp, ordered, nil
+}
 
-		tok = e.peekToken()
+// boolean converts the given truth-value into a NUMBER token, holding
+// 1 for true and 0 for false.
+func (e *Evaluator) boolean(b bool) *Token {
+	if b {
+		return &Token{Type: NUMBER, Value: e.arith.fromInt(big.NewInt(1))}
 	}
+	return &Token{Type: NUMBER, Value: e.arith.fromInt(big.NewInt(0))}
+}
+
+// evalConditional evaluates one of the branches of a conditional,
+// depending upon the value of its condition.
+func (e *Evaluator) evalConditional(n *Conditional) *Token {
 
-	if tok.Type == ERROR {
-		return &Token{Type: ERROR, Value: fmt.Sprintf("Unexpected token inside expr() - %v\n", tok)}
+	cond := e.evaluate(n.Condition)
+	if cond.Type != NUMBER {
+		return cond
 	}
 
-	return t1
+	if IsTrue(cond.Value) {
+		return e.evaluate(n.Consequence)
+	}
+	return e.evaluate(n.Alternative)
 }
 
-// factor() - return a token
-func (e *Evaluator) factor() *Token {
-	tok := e.nextToken()
+// evalBitwise handles the bitwise operations, which are only
+// permitted upon integers.
+func (e *Evaluator) evalBitwise(op string, a, b interface{}) *Token {
 
-	switch tok.Type {
-	case EOF:
-		return &Token{Type: ERROR, Value: "unexpected EOF in factor()"}
-	case NUMBER:
-		return tok
-	case IDENT:
-
-		// sleazy hack here.
-		//
-		// We're getting a factor, but if we have a variable
-		// AND the next token is an assignment then we return
-		// the ident (i.e. current token) to allow Run() to
-		// process "var = expr"
-		//
-		// Without this we'd interpret "foo = 1 + 2" as
-		// a reference to the preexisting variable "foo"
-		// which would not exist.
-		//
-		nxt := e.peekToken()
-		if nxt.Type == ASSIGN {
-			return tok
-		}
+	x, ok := e.arith.toInt(a)
+	if !ok {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("bitwise operator %s requires integers, got %s", op, format(a))}
+	}
+	y, ok := e.arith.toInt(b)
+	if !ok {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("bitwise operator %s requires integers, got %s", op, format(b))}
+	}
 
-		//
-		// OK lookup the content of an existing variable.
-		//
-		val, ok := e.variables[tok.Value.(string)]
-		if ok {
-			return &Token{Value: val, Type: NUMBER}
+	res, err := bitwise(op, x, y)
+	if err != nil {
+		return &Token{Type: ERROR, Value: err.Error()}
+	}
+	return &Token{Type: NUMBER, Value: e.arith.fromInt(res)}
+}
+
+// evalNumber converts a literal number into a value of the
+// appropriate type for our arithmetic.
+func (e *Evaluator) evalNumber(n *NumberLiteral) *Token {
+
+	var v interface{}
+	var err error
+
+	if _, ok := e.arith.(floatArith); ok || n.Literal == "" {
+		// float64 is the default, and needs no conversion.
+		v, err = e.arith.fromFloat(n.Value)
+	} else if i, ok := new(big.Int).SetString(n.Literal, 0); ok && hasBasePrefix(n.Literal) {
+		// Integers such as 0xff are converted exactly.
+		v = e.arith.fromInt(i)
+	} else {
+		v, err = e.arith.parse(n.Literal)
+		if err != nil {
+			err = fmt.Errorf("failed to parse number: %s", err.Error())
 		}
-		return &Token{Type: ERROR, Value: fmt.Sprintf("undefined variable: %s", tok.Value.(string))}
-	case LET:
-		return tok
-	case LPAREN:
-		//
-		// We don't need to skip past the `(` here
-		// because the `expr` call will do that
-		// to find its arguments
-		//
-
-		// evaluate the expression
-		res := e.expr()
-
-		// next token should be ")"
-		if e.peekToken().Type != RPAREN {
-			return &Token{Type: ERROR, Value: fmt.Sprintf("expected ')' after expression found %v", e.peekToken())}
+	}
+	if err != nil {
+		return &Token{Type: ERROR, Value: err.Error()}
+	}
+
+	// Attach the unit, if there is one.
+	if n.Unit != "" {
+		unit, ok := LookupUnit(n.Unit)
+		if !ok {
+			return &Token{Type: ERROR, Value: fmt.Sprintf("unknown unit '%s'", n.Unit)}
 		}
+		v = &Quantity{Value: v, Unit: unit}
+	}
+	return &Token{Type: NUMBER, Value: v}
+}
 
-		// skip that ")"
-		e.nextToken()
+// evalCall invokes either a built-in or a user-defined function.
+func (e *Evaluator) evalCall(n *CallExpression) *Token {
 
-		return res
-	case MINUS:
-		// If the next token is a number then we're good
-		if e.peekToken().Type == NUMBER {
-			val := e.nextToken()
-			cur := val.Value.(float64)
-			val.Value = cur * -1
+	// Evaluate the arguments
+	args := make([]interface{}, len(n.Arguments))
+	for i, arg := range n.Arguments {
+		val := e.evaluate(arg)
+		if val.Type != NUMBER {
 			return val
 		}
+		args[i] = val.Value
 	}
 
-	return &Token{Type: ERROR, Value: fmt.Sprintf("Unexpected token inside factor() - %v\n", tok)}
-}
+	if b, ok := builtins[n.Function]; ok {
+		return e.evalBuiltin(n.Function, b, args)
+	}
+	if b, ok := e.natives[n.Function]; ok {
+		return e.evalBuiltin(n.Function, b, args)
+	}
 
-// Run launches the program we've loaded.
-//
-// If multiple statements are available each are executed in turn,
-// and the result of the last one returned.  However errors will
-// cause early-termination.
-func (e *Evaluator) Run() *Token {
+	fn, ok := e.functions[n.Function]
+	if !ok {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("undefined function: %s", n.Function)}
+	}
+	if len(args) != len(fn.Parameters) {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("%s() expects %d argument(s), got %d", fn.Name, len(fn.Parameters), len(args))}
+	}
 
-	var result *Token
+	if e.depth >= e.limits.MaxDepth {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("maximum call depth exceeded calling %s()", fn.Name)}
+	}
 
-	// Process each statement
-	for e.peekToken().Type != EOF && e.peekToken().Type != ERROR {
+	//
+	// Parameters shadow any global variables of the same name,
+	// so we save those away and restore them once we're done.
+	//
+	saved := make(map[string]interface{})
+	for i, param := range fn.Parameters {
+		if old, found := e.variables[param]; found {
+			saved[param] = old
+		}
+		e.variables[param] = args[i]
+	}
 
-		// Get the result
-		result = e.expr()
+	e.depth++
+	result := e.evaluate(fn.Body)
+	e.depth--
 
-		// Error? Then abort
-		if result.Type == ERROR {
-			return result
+	//
+	// The function body was parsed from a different input, so
+	// we report any error at the position of the call.
+	//
+	if result.Type == ERROR {
+		result.Position = n.Position
+	}
+
+	for _, param := range fn.Parameters {
+		if old, found := saved[param]; found {
+			e.variables[param] = old
+		} else {
+			delete(e.variables, param)
 		}
+	}
+
+	return result
+}
 
-		// Otherwise loop again.
+// evalBuiltin invokes a built-in function.
+//
+// The built-in functions operate upon float64 values, so when using
+// arbitrary-precision our arguments are converted to, and the result
+// converted from, float64, with no more precision than that has.  The
+// exception is sqrt, which may be calculated at full precision.
+//
+// With exact arithmetic the result must be exact.
+func (e *Evaluator) evalBuiltin(name string, b builtin, args []interface{}) *Token {
+
+	if bf, ok := e.arith.(bigFloatArith); ok && name == "sqrt" && len(args) == 1 && !isQuantity(args[0]) {
+		res, err := bf.sqrt(args[0])
+		if err != nil {
+			return &Token{Type: ERROR, Value: err.Error()}
+		}
+		return &Token{Type: NUMBER, Value: res}
 	}
 
-	// Did we terminate on an error?
-	if e.peekToken().Type == ERROR {
-		return e.peekToken()
+	floats := make([]float64, len(args))
+	for i, arg := range args {
+		if isQuantity(arg) {
+			return &Token{Type: ERROR, Value: fmt.Sprintf("%s() cannot be used with units, got %s", name, format(arg))}
+		}
+		floats[i] = e.arith.toFloat(arg)
 	}
 
-	// If we evaluated something we'll have a result which
-	// we'll save in the `result` variable.
-	//
-	// (We might receive input such as "", which will result
-	// in nothing being evaluated)
-	if result != nil {
-		e.variables["result"] = result.Value.(float64)
+	res, err := b.call(name, floats)
+	if err != nil {
+		return &Token{Type: ERROR, Value: err.Error()}
 	}
 
-	// All done.
-	return result
+	val, err := e.arith.approximate(name+"()", res, args...)
+	if err != nil {
+		return &Token{Type: ERROR, Value: err.Error()}
+	}
+	return &Token{Type: NUMBER, Value: val}
 }
@@ -2,6 +2,7 @@ package calc
 
 import (
 	"math"
+	"math/big"
 	"strings"
 	"testing"
 )
@@ -31,6 +32,21 @@ func TestBasic(t *testing.T) {
 		{"-1 + 3", 2},
 		{"( 1 + 2 ) * 4", 12},
 		{"( ( 1 + 2 ) * 4 )", 12},
+
+		// unary operators apply to any expression
+		{"-(2 + 3)", -5},
+		{"-pi", -3.14159265},
+		{"+3", 3},
+		{"2 * -(1 + 1)", -4},
+
+		// exponents and modulus
+		{"2 ^ 10", 1024},
+		{"2 ** 3", 8},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"2 ^ -1", 0.5},
+		{"7 % 3", 1},
+		{"1 + 7 % 4 * 2", 7},
 	}
 
 	for _, test := range tests {
@@ -56,6 +72,7 @@ func TestDivideZero(t *testing.T) {
 		input string
 	}{
 		{"1 / 0"},
+		{"1 % 0"},
 		{"let a = 1 ; let b = 0 ; a / b ;"},
 	}
 
@@ -190,3 +207,765 @@ func TestAssign(t *testing.T) {
 		}
 	}
 }
+
+// TestFunctions tests built-in and user-defined functions.
+func TestFunctions(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output float64
+	}{
+		{"sqrt(16)", 4},
+		{"abs(-3) + floor(2.7) + ceil(2.1)", 8},
+		{"min(3, 1, 2)", 1},
+		{"max(3, 1, 2) * 2", 6},
+		{"log10(1000)", 3},
+		{"sin(0)", 0},
+		{"pow(2, 8)", 256},
+		{"fn double(x) = x * 2; double(4)", 8},
+		{"fn hyp(a, b) = sqrt(a*a + b*b); hyp(3, 4)", 5},
+		{"fn three() = 3; three() + 1", 4},
+		{"fn sq(x) = x * x; fn sum(a, b) = sq(a) + sq(b); sum(1, 2)", 5},
+
+		// parameters shadow, but don't replace, global variables
+		{"x = 10; fn inc(x) = x + 1; inc(1) + x", 12},
+	}
+
+	for _, test := range tests {
+
+		p := New()
+		p.Load(test.input)
+
+		out := p.Run()
+
+		if out.Type != NUMBER {
+			t.Fatalf("Output was not a number for '%s': %v\n", test.input, out)
+		}
+		if !almostEqual(out.Value.(float64), test.output) {
+			t.Fatalf("Got wrong result for '%s', expected '%f' found '%f'", test.input, test.output, out.Value.(float64))
+		}
+	}
+}
+
+// TestFunctionErrors tests error-handling for functions.
+func TestFunctionErrors(t *testing.T) {
+
+	tests := []struct {
+		input string
+		error string
+	}{
+		{"sqrt(1, 2)", "expects 1 argument"},
+		{"max()", "at least 1 argument"},
+		{"sqrt(-1)", "is not a number"},
+		{"nope(3)", "undefined function"},
+		{"fn f(a) = a; f()", "expects 1 argument"},
+		{"fn sqrt(a) = a", "cannot redefine"},
+		{"fn f(a, a) = a", "duplicate parameter"},
+		{"fn f(a b) = a", "expected ','"},
+		{"fn 3(a) = a", "is not an identifier"},
+		{"sqrt(1 2)", "expected ','"},
+		{"fn loop(x) = loop(x); loop(1)", "maximum call depth"},
+	}
+
+	for _, test := range tests {
+
+		p := New()
+		p.Load(test.input)
+
+		out := p.Run()
+
+		if out.Type != ERROR {
+			t.Fatalf("expected error, found none for input '%s'", test.input)
+		}
+		if !strings.Contains(out.Value.(string), test.error) {
+			t.Fatalf("expected error '%s', but found %s", test.error, out.Value.(string))
+		}
+	}
+}
+
+// TestFunctionsPersist ensures that user-defined functions are
+// available to later programs.
+func TestFunctionsPersist(t *testing.T) {
+
+	p := New()
+	p.Load("fn cube(x) = x ^ 3")
+	out := p.Run()
+	if out.Type != FUNCTION {
+		t.Fatalf("expected function definition, got %v", out)
+	}
+
+	p.Load("cube(3)")
+	out = p.Run()
+	if out.Type != NUMBER || out.Value.(float64) != 27 {
+		t.Fatalf("unexpected result %v", out)
+	}
+
+	found := false
+	for _, name := range p.Functions() {
+		if name == "cube" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("user-defined function missing from Functions()")
+	}
+}
+
+// TestExact tests arithmetic using big.Rat values.
+func TestExact(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"0.1 + 0.2", "3/10"},
+		{"1 / 3 * 3", "1"},
+		{"2 ^ 100", "1267650600228229401496703205376"},
+		{"2 ^ -2", "1/4"},
+		{"7.5 % 2", "3/2"},
+		{"-(1/3)", "-1/3"},
+		{"123456789012345678901234567890 + 1", "123456789012345678901234567891"},
+		{"a = 0.1; a * 10", "1"},
+		{"sqrt(16)", "4"},
+		{"4 ^ 0.5", "2"},
+		{"floor(7 / 2)", "3"},
+	}
+
+	for _, test := range tests {
+
+		p := New()
+		if err := p.SetExact(); err != nil {
+			t.Fatalf("failed to set exact mode: %s", err)
+		}
+		p.Load(test.input)
+
+		out := p.Run()
+		if out.Type != NUMBER {
+			t.Fatalf("Output was not a number for '%s': %v\n", test.input, out)
+		}
+		if out.Value.(*big.Rat).RatString() != test.output {
+			t.Fatalf("Got wrong result for '%s', expected '%s' found '%s'", test.input, test.output, out.Value.(*big.Rat).RatString())
+		}
+
+		// result should be stored, without conversion
+		res, ok := p.Value("result")
+		if !ok || res.(*big.Rat).Cmp(out.Value.(*big.Rat)) != 0 {
+			t.Fatalf("result variable not updated for '%s': %v", test.input, res)
+		}
+	}
+}
+
+// TestExactApproximate ensures that results which can only be calculated
+// approximately are errors in exact mode.
+func TestExactApproximate(t *testing.T) {
+
+	tests := []string{"sqrt(2)", "2 ^ 0.5", "8 ^ (1 / 3)", "abs(1 / 3)", "sin(1)", "exp(1000)"}
+
+	for _, test := range tests {
+
+		p := New()
+		if err := p.SetExact(); err != nil {
+			t.Fatalf("failed to set exact mode: %s", err)
+		}
+		p.Load(test)
+
+		out := p.Run()
+		if out.Type != ERROR || !strings.Contains(out.Value.(string), "cannot be calculated exactly") {
+			t.Fatalf("expected error for '%s', got %v", test, out)
+		}
+	}
+}
+
+// TestPrecision tests arithmetic using big.Float values.
+func TestPrecision(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"2 ^ 64", "18446744073709551616"},
+		{"1 / 3", "0.33333333333333333333333333333333333333333333333333"},
+		{"sqrt(2)", "1.4142135623730950488016887242096980785696718753769"},
+		{"pi", "3.1415926535897932384626433832795028841971693993751"},
+		{"10 % 3", "1"},
+	}
+
+	for _, test := range tests {
+
+		p := New()
+		if err := p.SetPrecision(256); err != nil {
+			t.Fatalf("failed to set precision: %s", err)
+		}
+		p.Load(test.input)
+
+		out := p.Run()
+		if out.Type != NUMBER {
+			t.Fatalf("Output was not a number for '%s': %v\n", test.input, out)
+		}
+		if out.Value.(*big.Float).Text('g', 50) != test.output {
+			t.Fatalf("Got wrong result for '%s', expected '%s' found '%s'", test.input, test.output, out.Value.(*big.Float).Text('g', 50))
+		}
+	}
+
+	//
+	// Results calculated via float64 have only its precision, as
+	// do those derived from them, unless they're exact.
+	//
+	approximate := []struct {
+		input string
+		prec  uint
+	}{
+		{"sin(1)", 53},
+		{"2 ^ 0.5", 53},
+		{"-exp(2) / 3 + 1", 53},
+		{"sqrt(2)", 256},
+		{"pow(2, 10) / 3", 256},
+		{"floor(sin(1) * 10) / 3", 256},
+	}
+	for _, test := range approximate {
+		p := New()
+		if err := p.SetPrecision(256); err != nil {
+			t.Fatalf("failed to set precision: %s", err)
+		}
+		p.Load(test.input)
+
+		out := p.Run()
+		if out.Type != NUMBER {
+			t.Fatalf("Output was not a number for '%s': %v\n", test.input, out)
+		}
+		if out.Value.(*big.Float).Prec() != test.prec {
+			t.Fatalf("Got wrong precision for '%s', expected %d found %d", test.input, test.prec, out.Value.(*big.Float).Prec())
+		}
+	}
+
+	// Errors should still be caught.
+	p := New()
+	if err := p.SetPrecision(0); err == nil {
+		t.Fatalf("expected error with zero precision")
+	}
+	p.SetPrecision(128)
+	p.Load("1 / 0")
+	out := p.Run()
+	if out.Type != ERROR || !strings.Contains(out.Value.(string), "division by zero") {
+		t.Fatalf("expected division by zero, got %v", out)
+	}
+	p.Load("exp(1000) - exp(1000)")
+	out = p.Run()
+	if out.Type != ERROR {
+		t.Fatalf("expected error, got %v", out)
+	}
+	p.Load("(2 ^ 100000000000) % 3")
+	out = p.Run()
+	if out.Type != ERROR || !strings.Contains(out.Value.(string), "not a number") {
+		t.Fatalf("expected error, got %v", out)
+	}
+	p.Load("3 % (2 ^ 100000000000)")
+	out = p.Run()
+	if out.Type != NUMBER || out.Value.(*big.Float).Text('g', 10) != "3" {
+		t.Fatalf("expected 3, got %v", out)
+	}
+}
+
+// TestBitwise tests integer literals and bitwise operations.
+func TestBitwise(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output float64
+	}{
+		{"0xff", 255},
+		{"0XFF + 1", 256},
+		{"0o755", 493},
+		{"0b1010", 10},
+		{"0xf0 & 0x3c", 0x30},
+		{"0xf0 | 0x0f", 0xff},
+		{"0xff xor 0x0f", 0xf0},
+		{"~0", -1},
+		{"~0b1010 & 0xf", 5},
+		{"1 << 10", 1024},
+		{"1024 >> 3", 128},
+		{"1 << 2 + 1", 8},
+		{"1 | 2 & 3", 3},
+		{"0o755 & ~0o022", 0o755},
+		{"-8 >> 1", -4},
+		{"4.0 & 5", 4},
+
+		// "^" is exponentiation, not exclusive-or.
+		{"0xf0 ^ 2", 0xe100},
+		{"0b10 ^ 0b11", 8},
+	}
+
+	for _, test := range tests {
+
+		p := New()
+		p.Load(test.input)
+
+		out := p.Run()
+
+		if out.Type != NUMBER {
+			t.Fatalf("Output was not a number for '%s': %v\n", test.input, out)
+		}
+		if out.Value.(float64) != test.output {
+			t.Fatalf("Got wrong result for '%s', expected '%f' found '%f'", test.input, test.output, out.Value.(float64))
+		}
+	}
+
+	// exact mode keeps large values intact
+	p := New()
+	p.SetExact()
+	p.Load("0xffffffffffffffff xor 0x1")
+	out := p.Run()
+	if out.Type != NUMBER || out.Value.(*big.Rat).RatString() != "18446744073709551614" {
+		t.Fatalf("wrong result in exact mode: %v", out)
+	}
+}
+
+// TestBitwiseErrors ensures non-integers are rejected.
+func TestBitwiseErrors(t *testing.T) {
+
+	tests := []struct {
+		input string
+		error string
+	}{
+		{"1.5 & 1", "requires integers, got 1.5"},
+		{"1 | 0.5", "requires integers, got 0.5"},
+		{"~1.5", "requires an integer"},
+		{"1 << -1", "negative shift count"},
+		{"1 << 100000000", "too large"},
+		{"0xfg", "invalid integer"},
+		{"0b102", "invalid integer"},
+	}
+
+	for _, test := range tests {
+
+		p := New()
+		p.Load(test.input)
+
+		out := p.Run()
+
+		if out.Type != ERROR {
+			t.Fatalf("expected error, found none for input '%s'", test.input)
+		}
+		if !strings.Contains(out.Value.(string), test.error) {
+			t.Fatalf("expected error '%s', but found %s", test.error, out.Value.(string))
+		}
+	}
+}
+
+// TestUnits tests arithmetic upon values with units.
+func TestUnits(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output float64
+		unit   string
+	}{
+		{"1.5GiB", 1.5, "GiB"},
+		{"1GiB + 512MiB", 1.5, "GiB"},
+		{"1GiB + 512MiB to MiB", 1536, "MiB"},
+		{"2h to minutes", 120, "minutes"},
+		{"300ms * 4", 1200, "ms"},
+		{"3 * 300ms", 900, "ms"},
+		{"1h / 4", 0.25, "h"},
+		{"90s in min", 1.5, "min"},
+		{"10Mbit to MB", 1.25, "MB"},
+		{"100Mbps * 8s to MB", 100, "MB"},
+		{"12GiB / 80MB/s", 12 * 1073741824 / 80e6, "s"},
+		{"(12GiB / 80MB/s) to minutes", 12 * 1073741824 / 80e6 / 60, "minutes"},
+		{"1GB / 10s to MB/s", 100, "MB/s"},
+		{"1 / 2s", 0.5, "1/s"},
+		{"-2h", -2, "h"},
+		{"(1KiB) ^ 2", 1048576, "B^2"},
+		{"7d % 1w", 0, "d"},
+		{"10min % 1h", 10, "min"},
+		{"fn double(x) = x * 2; double(1.5GiB)", 3, "GiB"},
+		{"2µs + 1us to ns", 3000, "ns"},
+	}
+
+	for _, test := range tests {
+
+		p := New()
+		p.Load(test.input)
+
+		out := p.Run()
+
+		if out.Type != NUMBER {
+			t.Fatalf("Output was not a number for '%s': %v\n", test.input, out)
+		}
+		q, ok := out.Value.(*Quantity)
+		if !ok {
+			t.Fatalf("Output was not a quantity for '%s': %v\n", test.input, out)
+		}
+		if q.Unit.Name != test.unit {
+			t.Fatalf("Got wrong unit for '%s', expected '%s' found '%s'", test.input, test.unit, q.Unit.Name)
+		}
+		if !almostEqual(q.Value.(float64), test.output) {
+			t.Fatalf("Got wrong result for '%s', expected '%f' found '%f'", test.input, test.output, q.Value.(float64))
+		}
+	}
+
+	// Units which cancel out produce plain numbers.
+	p := New()
+	p.Load("1GiB / 1MiB")
+	out := p.Run()
+	if out.Type != NUMBER || out.Value.(float64) != 1024 {
+		t.Fatalf("expected a plain number, got %v", out)
+	}
+
+	// Units work in exact mode too.
+	p = New()
+	p.SetExact()
+	p.Load("1GiB / 3 to MiB")
+	out = p.Run()
+	if out.Type != NUMBER || out.Value.(*Quantity).Value.(*big.Rat).RatString() != "1024/3" {
+		t.Fatalf("wrong result in exact mode: %v", out)
+	}
+}
+
+// TestUnitErrors tests that incompatible units are reported.
+func TestUnitErrors(t *testing.T) {
+
+	tests := []struct {
+		input string
+		error string
+	}{
+		{"1GiB + 3ms", "incompatible units for +: GiB and ms"},
+		{"3ms - 1", "incompatible units for -: ms and no unit"},
+		{"2h to GiB", "cannot convert h to GiB"},
+		{"2 to GiB", "cannot convert no unit to GiB"},
+		{"2h to parsecs", "unknown unit 'parsecs'"},
+		{"2h to 3", "expected unit"},
+		{"1GiB & 1", "cannot be used with units"},
+		{"~1GiB", "cannot be used with units"},
+		{"sqrt(4GiB)", "cannot be used with units"},
+		{"2 ^ 1s", "small integer power"},
+		{"1GiB / 0", "division by zero"},
+	}
+
+	for _, test := range tests {
+
+		p := New()
+		p.Load(test.input)
+
+		out := p.Run()
+
+		if out.Type != ERROR {
+			t.Fatalf("expected error, found none for input '%s': %v", test.input, out)
+		}
+		if !strings.Contains(out.Value.(string), test.error) {
+			t.Fatalf("expected error '%s', but found %s", test.error, out.Value.(string))
+		}
+	}
+}
+
+// TestSave ensures that saved variables and functions may be restored.
+func TestSave(t *testing.T) {
+
+	tests := []struct {
+		setup func(e *Evaluator) error
+		input string
+		check string
+	}{
+		{nil, "a = 3; b = 0.1; fn sq(x) = x * x", "sq(a) + b"},
+		{nil, "big = 2 ^ 70; d = 4", "big / 2 ^ 69 + d"},
+		{nil, "size = 1.5GiB; rate = 80MB/s; neg = -3s", "size / rate + neg"},
+		{func(e *Evaluator) error { return e.SetExact() }, "third = 1 / 3; q = 0.5KiB / 3", "third * 3 + q / 1B"},
+		{func(e *Evaluator) error { return e.SetPrecision(128) }, "x = 1 / 7", "x * 7"},
+	}
+
+	for _, test := range tests {
+
+		orig := New()
+		restored := New()
+		if test.setup != nil {
+			if err := test.setup(orig); err != nil {
+				t.Fatalf("failed to setup: %s", err)
+			}
+			if err := test.setup(restored); err != nil {
+				t.Fatalf("failed to setup: %s", err)
+			}
+		}
+
+		orig.Load(test.input)
+		out := orig.Run()
+		if out.Type == ERROR {
+			t.Fatalf("unexpected error running '%s': %v", test.input, out.Value)
+		}
+
+		var saved strings.Builder
+		if err := orig.Save(&saved); err != nil {
+			t.Fatalf("failed to save '%s': %s", test.input, err)
+		}
+
+		restored.Load(saved.String())
+		out = restored.Run()
+		if out.Type == ERROR {
+			t.Fatalf("failed to restore '%s': %v", saved.String(), out.Value)
+		}
+
+		orig.Load(test.check)
+		expected := orig.Run()
+		restored.Load(test.check)
+		out = restored.Run()
+		if out.Type != NUMBER || format(out.Value) != format(expected.Value) {
+			t.Fatalf("restored state of '%s' differs, expected %v got %v", saved.String(), expected.Value, out.Value)
+		}
+	}
+}
+
+// TestSaveSkipsConstants ensures that pi, e, and result are not saved.
+func TestSaveSkipsConstants(t *testing.T) {
+
+	e := New()
+	e.Load("1 + 2")
+	e.Run()
+
+	var saved strings.Builder
+	if err := e.Save(&saved); err != nil {
+		t.Fatalf("failed to save: %s", err)
+	}
+	if saved.String() != "" {
+		t.Fatalf("expected nothing to be saved, got '%s'", saved.String())
+	}
+}
+
+// TestSetNumber tests setting variables from text.
+func TestSetNumber(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		result string
+	}{
+		{"3", "3"},
+		{" -2.5 ", "-2.5"},
+		{"+7", "7"},
+		{"0xff", "255"},
+		{"1.5GiB", "1.5 GiB"},
+	}
+
+	for _, test := range tests {
+
+		e := New()
+		err := e.SetNumber("x", test.input)
+		if err != nil {
+			t.Fatalf("unexpected error setting '%s': %s", test.input, err)
+		}
+
+		val, _ := e.Value("x")
+		if format(val) != test.result {
+			t.Fatalf("wrong value for '%s', expected %s got %s", test.input, test.result, format(val))
+		}
+	}
+
+	for _, bogus := range []string{"", "abc", "1 + 2", "3.3.3", "--3", "1,000"} {
+
+		e := New()
+		e.SetNumber("x", "1")
+		err := e.SetNumber("x", bogus)
+		if err == nil {
+			t.Fatalf("expected error setting '%s'", bogus)
+		}
+
+		val, _ := e.Variable("x")
+		if val != 1 {
+			t.Fatalf("variable changed after failing to set '%s'", bogus)
+		}
+	}
+
+	e := New()
+	e.SetNumber("x", "1")
+	e.Unset("x")
+	if _, ok := e.Value("x"); ok {
+		t.Fatalf("variable still present after Unset")
+	}
+}
+
+// TestAccumulate tests the aggregate variables.
+func TestAccumulate(t *testing.T) {
+
+	e := New()
+	for _, v := range []float64{3, 1, 4, 1, 5} {
+		if err := e.Accumulate(v); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	expected := map[string]float64{"count": 5, "sum": 14, "min": 1, "max": 5, "mean": 2.8}
+	for name, val := range expected {
+		out, ok := e.Variable(name)
+		if !ok || !almostEqual(out, val) {
+			t.Fatalf("wrong value for %s, expected %f got %f", name, val, out)
+		}
+	}
+
+	// Resetting sets everything to zero, and forgets what we saw.
+	e.ResetAggregates()
+	for _, name := range []string{"count", "sum", "min", "max", "mean"} {
+		out, ok := e.Variable(name)
+		if !ok || out != 0 {
+			t.Fatalf("wrong value for %s after reset, expected 0 got %f", name, out)
+		}
+	}
+	if err := e.Accumulate(7.0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out, _ := e.Variable("min"); out != 7 {
+		t.Fatalf("wrong min after reset, expected 7 got %f", out)
+	}
+
+	// Units are converted, and must be compatible.
+	e = New()
+	for _, v := range []string{"1GiB", "512MiB", "2GiB"} {
+		e.Load(v)
+		if err := e.Accumulate(e.Run().Value); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	e.Load("sum to GiB")
+	if out := e.Run(); format(out.Value) != "3.5 GiB" {
+		t.Fatalf("wrong sum: %v", format(out.Value))
+	}
+	e.Load("min to MiB")
+	if out := e.Run(); format(out.Value) != "512 MiB" {
+		t.Fatalf("wrong min: %v", format(out.Value))
+	}
+
+	// Values which are not numbers are rejected, and infinities
+	// are the largest, or smallest, values.
+	e = New()
+	for _, v := range []float64{2, math.Inf(1), math.Inf(-1)} {
+		if err := e.Accumulate(v); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := e.Accumulate(math.NaN()); err == nil || !strings.Contains(err.Error(), "not a number") {
+		t.Fatalf("expected error accumulating NaN, got %v", err)
+	}
+	if out, _ := e.Variable("max"); !math.IsInf(out, 1) {
+		t.Fatalf("wrong max, expected +Inf got %f", out)
+	}
+	if out, _ := e.Variable("min"); !math.IsInf(out, -1) {
+		t.Fatalf("wrong min, expected -Inf got %f", out)
+	}
+
+	e = New()
+	e.Load("1GiB")
+	e.Accumulate(e.Run().Value)
+	e.Load("3s")
+	err := e.Accumulate(e.Run().Value)
+	if err == nil || !strings.Contains(err.Error(), "incompatible units") {
+		t.Fatalf("expected error accumulating incompatible units, got %v", err)
+	}
+}
+
+// TestRuntimeErrorPosition ensures runtime errors record the position of the
+// expression which failed.
+func TestRuntimeErrorPosition(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		line   int
+		column int
+	}{
+		{"1 + 2 / 0", 1, 7},
+		{"a = 1; b = a + c", 1, 16},
+		{"1GiB +\n 3s", 1, 6},
+		{"fn f(x) = 1 / x; 3 * f(0)", 1, 22},
+		{"sqrt(-1)", 1, 1},
+		{"1 +", 1, 4},
+	}
+
+	for _, test := range tests {
+
+		e := New()
+		e.Load(test.input)
+		out := e.Run()
+		if out.Type != ERROR {
+			t.Fatalf("expected error evaluating '%s', got %v", test.input, out)
+		}
+		if out.Line != test.line || out.Column != test.column {
+			t.Fatalf("wrong position for '%s', expected %d:%d got %d:%d", test.input, test.line, test.column, out.Line, out.Column)
+		}
+	}
+}
+
+// TestConditionals tests comparisons, logic, and conditionals.
+func TestConditionals(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		result float64
+	}{
+		{"1 < 2", 1},
+		{"2 <= 2", 1},
+		{"3 == 3.0", 1},
+		{"3 != 3", 0},
+		{"4 >= 5", 0},
+		{"5 > 4", 1},
+		{"1 < 2 and 2 < 3", 1},
+		{"1 > 2 or 2 > 3", 0},
+		{"not 0", 1},
+		{"not 2 > 1", 0},
+		{"0 and 1 / 0", 0},
+		{"1 or undefined", 1},
+		{"x = 5; if x > 3 then x * 2 else x / 2", 10},
+		{"x = 1; x > 3 ? x * 2 : x / 2", 0.5},
+		{"fn fact(n) = if n <= 1 then 1 else n * fact(n - 1); fact(10)", 3628800},
+		{"1GiB > 1000MB", 1},
+		{"90s == 1.5min", 1},
+		{"exp(1000) == exp(1000)", 1},
+		{"-exp(1000) < exp(1000)", 1},
+		{"exp(1000) > 10 ^ 300", 1},
+		{"(-8) ^ (1 / 3) == 5", 0},
+		{"(-8) ^ (1 / 3) == (-8) ^ (1 / 3)", 0},
+		{"(-8) ^ (1 / 3) != (-8) ^ (1 / 3)", 1},
+		{"(-8) ^ (1 / 3) < 1", 0},
+		{"(-8) ^ (1 / 3) >= 1", 0},
+		{"# a comment\n1 + # another\n2", 3},
+	}
+
+	for _, test := range tests {
+
+		p := New()
+		p.Load(test.input)
+		out := p.Run()
+
+		if out.Type != NUMBER {
+			t.Fatalf("Output of '%s' was not a number: %v", test.input, out)
+		}
+		if !almostEqual(out.Value.(float64), test.result) {
+			t.Fatalf("wrong result for '%s', expected %f got %v", test.input, test.result, out.Value)
+		}
+	}
+
+	// Comparisons use exact values when we have them.
+	p := New()
+	if err := p.SetExact(); err != nil {
+		t.Fatalf("failed to set exact mode: %s", err)
+	}
+	p.Load("0.1 + 0.2 == 0.3")
+	out := p.Run()
+	if out.Type != NUMBER || out.Value.(*big.Rat).Cmp(big.NewRat(1, 1)) != 0 {
+		t.Fatalf("unexpected result %v", out)
+	}
+
+	// Infinite values may be compared with arbitrary-precision.
+	for _, test := range []string{"exp(1000) == exp(1000)", "exp(1000) >= 2 ^ 100000000000", "-exp(1000) < 1"} {
+		q := New()
+		if err := q.SetPrecision(128); err != nil {
+			t.Fatalf("failed to set precision: %s", err)
+		}
+		q.Load(test)
+		out = q.Run()
+		if out.Type != NUMBER || out.Value.(*big.Float).Cmp(big.NewFloat(1)) != 0 {
+			t.Fatalf("unexpected result for '%s': %v", test, out)
+		}
+	}
+
+	// Incompatible units cannot be compared.
+	p.Load("1GiB < 3s")
+	out = p.Run()
+	if out.Type != ERROR || !strings.Contains(out.Value.(string), "incompatible units for <") {
+		t.Fatalf("expected error, got %v", out)
+	}
+}
@@ -1,16 +1,18 @@
 // lexer.go - Contains our simple lexer, which returns tokens from
 // our input.
 //
-// These are NOT parsed into an AST, instead they are directly exected
-// by the evaluator.
+// These tokens are consumed by the parser, which builds an AST that
+// is then executed by the evaluator.
 
 package calc
 
 import (
 	"fmt"
+	"math/big"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // These constants are used to describe the type of token which has been lexed.
@@ -25,6 +27,14 @@ const (
 	LET    = "LET"
 	ASSIGN = "="
 
+	// Function definitions, and calls
+	FN       = "FN"
+	COMMA    = ","
+	FUNCTION = "FUNCTION"
+
+	// Unit conversion, via "to" or "in".
+	TO = "TO"
+
 	// Paren
 	LPAREN = "("
 	RPAREN = ")"
@@ -34,11 +44,87 @@ const (
 	MINUS    = "-"
 	MULTIPLY = "*"
 	DIVIDE   = "/"
+	MODULO   = "%"
+	POWER    = "^"
+
+	// Bitwise operations
+	BITAND = "&"
+	BITOR  = "|"
+	BITNOT = "~"
+	XOR    = "xor"
+	LSHIFT = "<<"
+	RSHIFT = ">>"
+
+	// Comparisons
+	LT = "<"
+	LE = "<="
+	EQ = "=="
+	NE = "!="
+	GE = ">="
+	GT = ">"
+
+	// Logical operations
+	AND = "and"
+	OR  = "or"
+	NOT = "not"
+
+	// Conditionals, via "if .. then .. else", or "? :".
+	IF       = "IF"
+	THEN     = "THEN"
+	ELSE     = "ELSE"
+	QUESTION = "?"
+	COLON    = ":"
 )
 
+// keywords maps our reserved-words to their token-types.
+//
+// Keywords are case-insensitive.
+var keywords = map[string]string{
+	"and":  AND,
+	"else": ELSE,
+	"fn":   FN,
+	"if":   IF,
+	"in":   TO,
+	"let":  LET,
+	"not":  NOT,
+	"or":   OR,
+	"then": THEN,
+	"to":   TO,
+	"xor":  XOR,
+}
+
+// Position records a location within our input.
+type Position struct {
+
+	// Offset is the byte-offset from the start of the input,
+	// starting from zero.
+	Offset int
+
+	// Line is the line-number, starting from one.
+	//
+	// A Line of zero means that the position is unknown.
+	Line int
+
+	// Column is the character-offset within the line, starting
+	// from one.
+	Column int
+}
+
+// Pos returns the position, which allows Position to be embedded
+// in the nodes of our AST to satisfy the Node interface.
+func (p Position) Pos() Position {
+	return p
+}
+
 // Token holds a lexed token from our input.
 type Token struct {
 
+	// Position holds the location of the token in our input.
+	//
+	// ERROR tokens returned by the evaluator hold the location of
+	// the expression which failed.
+	Position
+
 	// The type of the token.
 	Type string
 
@@ -48,7 +134,37 @@ type Token struct {
 	// will be stored as a float64.  Otherwise the
 	// value will be a string representation of the token.
 	//
+	// A FUNCTION token is returned by the evaluator when
+	// a function is defined, and holds its signature.
+	//
 	Value interface{}
+
+	// Literal holds the text of a NUMBER token, as it appeared
+	// in the input.
+	//
+	// This allows numbers to be parsed with more precision than
+	// a float64 allows, if required.
+	Literal string
+
+	// Unit holds the unit-suffix of a NUMBER token, such as "GiB"
+	// for the input "1.5GiB", if one was present.
+	Unit string
+}
+
+// String returns a readable representation of the token, for use
+// in error messages.
+func (t *Token) String() string {
+	switch t.Type {
+	case EOF:
+		return "end of input"
+	case ERROR:
+		return fmt.Sprintf("%v", t.Value)
+	case NUMBER:
+		if t.Literal != "" {
+			return "'" + t.Literal + t.Unit + "'"
+		}
+	}
+	return fmt.Sprintf("'%v'", t.Value)
 }
 
 // Lexer holds our lexer state.
@@ -60,6 +176,12 @@ type Lexer struct {
 	// position is the current position within the input-string.
 	position int
 
+	// line and column record the location of counted, which is
+	// the position up to which we've counted characters.
+	line    int
+	column  int
+	counted int
+
 	// simple map of single-character tokens to their type
 	known map[string]string
 }
@@ -68,34 +190,118 @@ type Lexer struct {
 func NewLexer(input string) *Lexer {
 
 	// Create the lexer object.
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1, column: 1}
 
 	// Populate the simple token-types in a map for later use.
 	l.known = make(map[string]string)
 	l.known["*"] = MULTIPLY
+	l.known["%"] = MODULO
+	l.known["^"] = POWER
+	l.known["&"] = BITAND
+	l.known["|"] = BITOR
+	l.known["~"] = BITNOT
 	l.known["+"] = PLUS
 	l.known["-"] = MINUS
 	l.known["/"] = DIVIDE
 	l.known["="] = ASSIGN
 	l.known["("] = LPAREN
 	l.known[")"] = RPAREN
+	l.known[","] = COMMA
+	l.known["<"] = LT
+	l.known[">"] = GT
+	l.known["?"] = QUESTION
+	l.known[":"] = COLON
 
 	return l
 }
 
-// Next returns the next token from our input stream.
+// Next returns the next token from our input stream, recording
+// the position at which it was found.
+func (l *Lexer) Next() *Token {
+
+	// The end of the input is reported as being directly after
+	// the last token, rather than after any trailing whitespace.
+	end := l.locate()
+
+	l.skipWhitespace()
+	pos := l.locate()
+
+	tok := l.next()
+	tok.Position = pos
+	if tok.Type == EOF {
+		tok.Position = end
+	}
+	return tok
+}
+
+// locate returns our current position.
+func (l *Lexer) locate() Position {
+
+	// Count the characters since we last did so.
+	l.column += utf8.RuneCountInString(l.input[l.counted:l.position])
+	l.counted = l.position
+
+	return Position{Offset: l.position, Line: l.line, Column: l.column}
+}
+
+// skipWhitespace skips whitespace and comments, keeping track of the
+// line we're upon.
+//
+// Note that ";" is treated as whitespace, as a series of statements
+// needs no separator, and that comments run from "#" to the end of
+// the line.
+func (l *Lexer) skipWhitespace() {
+
+	for l.position < len(l.input) {
+
+		switch l.input[l.position] {
+		case '\n':
+			l.line++
+			l.column = 1
+			l.counted = l.position + 1
+			l.position++
+		case ' ', '\r', '\t', ';':
+			l.position++
+		case '#':
+			for l.position < len(l.input) && l.input[l.position] != '\n' {
+				l.position++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// next returns the next token from our input stream, once any
+// whitespace has been skipped.
 //
 // This is pretty naive lexer, however it is sufficient to
 // recognize numbers, identifiers, and our small set of
 // operators.
-func (l *Lexer) Next() *Token {
+func (l *Lexer) next() *Token {
 
-	// Loop until we've exhausted our input.
-	for l.position < len(l.input) {
+	// Have we exhausted our input?
+	if l.position < len(l.input) {
 
 		// Get the next character
 		char := string(l.input[l.position])
 
+		// "**" is an alternative spelling of "^".
+		if char == "*" && l.position+1 < len(l.input) && l.input[l.position+1] == '*' {
+			l.position += 2
+			return &Token{Value: "**", Type: POWER}
+		}
+
+		// Shifts and comparisons are the only other
+		// two-character operators.
+		if l.position+1 < len(l.input) {
+			pair := l.input[l.position : l.position+2]
+			if isOneOf(pair, []string{LSHIFT, RSHIFT, LE, GE, EQ, NE}) {
+				l.position += 2
+				return &Token{Value: pair, Type: pair}
+			}
+		}
+
 		// Is this a known character/token?
 		t, ok := l.known[char]
 		if ok {
@@ -107,14 +313,17 @@ func (l *Lexer) Next() *Token {
 		// If we reach here it is something more complex.
 		switch char {
 
-		// Skip whitespace
-		case " ", "\n", "\r", "\t", ";":
-			l.position++
-			continue
-
-			// Is it a potential number?
+		// Is it a potential number?
 		case "-", "0", "1", "2", "3", "4", "5", "6", "7", "8", "9", ".":
 
+			//
+			// Integers may be written in hex, octal, or
+			// binary, with a prefix such as "0x".
+			//
+			if char == "0" && l.position+1 < len(l.input) && strings.ContainsRune("xXoObB", rune(l.input[l.position+1])) {
+				return l.readBasedInteger()
+			}
+
 			//
 			// Loop for more digits
 			//
@@ -152,7 +361,7 @@ func (l *Lexer) Next() *Token {
 				return &Token{Value: fmt.Sprintf("failed to parse number: %s", err.Error()), Type: ERROR}
 			}
 
-			return &Token{Value: number, Type: NUMBER}
+			return &Token{Value: number, Type: NUMBER, Literal: token, Unit: l.readUnit()}
 		}
 
 		//
@@ -171,8 +380,6 @@ func (l *Lexer) Next() *Token {
 
 			// Build up identifiers from any permitted
 			// character.
-			//
-			// We allow unicode "letters" only.
 			if l.isIdentifierCharacter(l.input[end]) {
 				end++
 			} else {
@@ -192,13 +399,11 @@ func (l *Lexer) Next() *Token {
 		// In a real language/lexer we might have
 		// keywords/reserved-words to handle.
 		//
-		// We only need to cope with "let".
-		//
-		// If the identifier was LET then return that
+		// If the identifier was a keyword then return that
 		// token instead.
 		//
-		if strings.ToLower(token) == "let" {
-			return &Token{Value: "let", Type: LET}
+		if t, ok := keywords[strings.ToLower(token)]; ok {
+			return &Token{Value: strings.ToLower(token), Type: t}
 		}
 
 		//
@@ -218,7 +423,7 @@ func (l *Lexer) Next() *Token {
 
 		//
 		// We found a non-empty identifier, which
-		// wasn't converted into a `let` keyword.
+		// wasn't converted into a keyword.
 		//
 		// Return it.
 		//
@@ -233,11 +438,82 @@ func (l *Lexer) Next() *Token {
 	return &Token{Value: "", Type: EOF}
 }
 
+// readUnit reads the unit-suffix which immediately follows a number,
+// such as the "GiB" in "1.5GiB", or the "MB/s" in "80MB/s".
+//
+// If the letters following the number are not a known unit then
+// nothing is consumed, and they'll be lexed as an identifier.
+func (l *Lexer) readUnit() string {
+
+	// letters returns the offset of the end of the run of
+	// letters starting at the given offset.
+	letters := func(start int) int {
+		end := start
+		for end < len(l.input) && unicode.IsLetter(rune(l.input[end])) {
+			end++
+		}
+		return end
+	}
+
+	start := l.position
+	end := letters(start)
+	if end == start {
+		return ""
+	}
+
+	// A rate, such as "MB/s"?
+	if end+1 < len(l.input) && l.input[end] == '/' {
+		rateEnd := letters(end + 1)
+		if rateEnd > end+1 {
+			if _, ok := LookupUnit(l.input[start:rateEnd]); ok {
+				l.position = rateEnd
+				return l.input[start:rateEnd]
+			}
+		}
+	}
+
+	if _, ok := LookupUnit(l.input[start:end]); ok {
+		l.position = end
+		return l.input[start:end]
+	}
+	return ""
+}
+
+// readBasedInteger reads an integer which has a base-prefix, such as
+// 0xff, 0o755, or 0b1010.
+func (l *Lexer) readBasedInteger() *Token {
+
+	// Starting offset of our number
+	start := l.position
+
+	// Skip the prefix, then consume all the letters and digits.
+	//
+	// Invalid digits will be reported by the conversion below.
+	end := l.position + 2
+	for end < len(l.input) && l.isIdentifierCharacter(l.input[end]) {
+		end++
+	}
+	l.position = end
+
+	token := l.input[start:end]
+
+	i, ok := new(big.Int).SetString(token, 0)
+	if !ok {
+		return &Token{Value: fmt.Sprintf("failed to parse number: invalid integer '%s'", token), Type: ERROR}
+	}
+
+	number, _ := new(big.Float).SetInt(i).Float64()
+	return &Token{Value: number, Type: NUMBER, Literal: token}
+}
+
 // isIdentifierCharacter tests whether the given character is
 // valid for use in an identifier.
+//
+// Digits are permitted, to allow names such as "log10", but because
+// numbers are handled first an identifier can never begin with one.
 func (l *Lexer) isIdentifierCharacter(d byte) bool {
 
-	return (unicode.IsLetter(rune(d)))
+	return unicode.IsLetter(rune(d)) || unicode.IsDigit(rune(d)) || d == '_'
 }
 
 // isNumberComponent looks for characters that can make up integers/floats
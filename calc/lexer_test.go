@@ -148,3 +148,149 @@ func TestNumeric(t *testing.T) {
 		t.Fatalf("'-' isn't valid unless at the start of a number")
 	}
 }
+
+// TestFunctionTokens ensures we can lex function definitions.
+func TestFunctionTokens(t *testing.T) {
+	tests := []struct {
+		expectedType    string
+		expectedLiteral string
+	}{
+		{FN, "fn"},
+		{IDENT, "log_2"},
+		{LPAREN, "("},
+		{IDENT, "a1"},
+		{COMMA, ","},
+		{IDENT, "b"},
+		{RPAREN, ")"},
+		{ASSIGN, "="},
+		{IDENT, "a1"},
+		{POWER, "**"},
+		{NUMBER, "2"},
+		{EOF, ""},
+	}
+
+	l := NewLexer("Fn log_2(a1, b) = a1 ** 2")
+
+	for i, tt := range tests {
+		tok := l.Next()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if fmt.Sprintf("%v", tok.Value) != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Value)
+		}
+	}
+}
+
+// TestUnitSuffix ensures units attached to numbers are recognized.
+func TestUnitSuffix(t *testing.T) {
+	tests := []struct {
+		expectedType    string
+		expectedLiteral string
+		expectedUnit    string
+	}{
+		{NUMBER, "1.5", "GiB"},
+		{DIVIDE, "/", ""},
+		{NUMBER, "80", "MB/s"},
+		{TO, "to", ""},
+		{IDENT, "minutes", ""},
+		{NUMBER, "2", ""},
+		{IDENT, "pi", ""},
+		{NUMBER, "10", "h"},
+		{DIVIDE, "/", ""},
+		{NUMBER, "2", ""},
+		{EOF, "", ""},
+	}
+
+	l := NewLexer("1.5GiB / 80MB/s to minutes 2pi 10h/2")
+
+	for i, tt := range tests {
+		tok := l.Next()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if fmt.Sprintf("%v", tok.Value) != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Value)
+		}
+		if tok.Unit != tt.expectedUnit {
+			t.Fatalf("tests[%d] - Unit wrong, expected=%q, got=%q", i, tt.expectedUnit, tok.Unit)
+		}
+	}
+}
+
+// TestPositions ensures tokens record where they were found.
+func TestPositions(t *testing.T) {
+	tests := []struct {
+		expectedType string
+		offset       int
+		line         int
+		column       int
+	}{
+		{IDENT, 0, 1, 1},
+		{ASSIGN, 2, 1, 3},
+		{NUMBER, 4, 1, 5},
+		{IDENT, 7, 2, 1},
+		{MULTIPLY, 11, 2, 5},
+		{NUMBER, 14, 2, 8},
+		{EOF, 15, 2, 9},
+	}
+
+	l := NewLexer("a = 3;\nrad * \t2")
+
+	for i, tt := range tests {
+		tok := l.Next()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Offset != tt.offset || tok.Line != tt.line || tok.Column != tt.column {
+			t.Fatalf("tests[%d] - position wrong, expected=%d:%d@%d, got=%d:%d@%d", i, tt.line, tt.column, tt.offset, tok.Line, tok.Column, tok.Offset)
+		}
+	}
+}
+
+// TestConditionalTokens tests comparisons, keywords, and comments.
+func TestConditionalTokens(t *testing.T) {
+	tests := []struct {
+		expectedType    string
+		expectedLiteral string
+	}{
+		{IF, "if"},
+		{IDENT, "a"},
+		{LE, "<="},
+		{NUMBER, "1"},
+		{AND, "and"},
+		{NOT, "not"},
+		{IDENT, "b"},
+		{NE, "!="},
+		{NUMBER, "2"},
+		{THEN, "then"},
+		{IDENT, "c"},
+		{LSHIFT, "<<"},
+		{NUMBER, "1"},
+		{ELSE, "else"},
+		{IDENT, "d"},
+		{OR, "or"},
+		{IDENT, "e"},
+		{GT, ">"},
+		{IDENT, "f"},
+		{QUESTION, "?"},
+		{IDENT, "g"},
+		{COLON, ":"},
+		{IDENT, "h"},
+		{EQ, "=="},
+		{IDENT, "i"},
+		{EOF, ""},
+	}
+
+	l := NewLexer("IF a <= 1 AND not b != 2 then c << 1 # comment\n else d or e > f ? g : h == i # trailing")
+
+	for i, tt := range tests {
+		tok := l.Next()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if fmt.Sprintf("%v", tok.Value) != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Value)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+// number.go - Contains the implementation of the arithmetic used by
+// the evaluator.
+//
+// By default we use float64 values, but it is also possible to use
+// arbitrary-precision floating-point numbers (*big.Float), or exact
+// rational numbers (*big.Rat).  Each mode implements the arithmetic
+// interface, and the evaluator only ever deals with values via that.
+
+package calc
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// These are the constants we define by default, with more precision
+// than a float64 can hold.
+const (
+	piDigits = "3.14159265358979323846264338327950288419716939937510582097494459230781640628620899862803482534211706798214808651328230664709384460955058223172535940812848111745028410270193852110555964462294895493038196"
+	eDigits  = "2.71828182845904523536028747135266249775724709369995957496696762772407663035354759457138217852516642742746639193200305992181741359662904357290033429526059563073813232862794349076323382988075319525101901"
+)
+
+// maxIntegerBits is the largest result, in bits, we'll allow when
+// raising an exact rational number to an integer power, or shifting
+// an integer to the left.
+const maxIntegerBits = 1 << 24
+
+// arithmetic is implemented by each of the numeric modes we support.
+//
+// Values are passed around as interface{}, and will be a float64, a
+// *big.Float, or a *big.Rat, depending upon the mode in use.
+type arithmetic interface {
+
+	// parse converts the text of a numeric literal into a value.
+	parse(literal string) (interface{}, error)
+
+	// fromFloat converts a float64 into a value.
+	fromFloat(f float64) (interface{}, error)
+
+	// toFloat converts a value into a float64.
+	toFloat(v interface{}) float64
+
+	// approximate converts the result of a calculation which was
+	// carried out upon the given arguments, via float64, into a value.
+	//
+	// Such a result is no more precise than a float64, so it is an
+	// error unless we can represent that, and what describes the
+	// calculation in the error.
+	approximate(what string, f float64, args ...interface{}) (interface{}, error)
+
+	// isZero returns true if the value is zero.
+	isZero(v interface{}) bool
+
+	// cmp returns -1, 0, or +1 depending upon whether a is less
+	// than, equal to, or greater than b, and false if the values
+	// are unordered because one is not a number.
+	cmp(a, b interface{}) (int, bool)
+
+	// negate returns the negation of the given value.
+	negate(v interface{}) interface{}
+
+	// toInt converts an integral value into a *big.Int, returning
+	// false if the value has a fractional part.
+	toInt(v interface{}) (*big.Int, bool)
+
+	// fromInt converts a *big.Int into a value.
+	fromInt(i *big.Int) interface{}
+
+	// fromRat converts a *big.Rat into a value.
+	fromRat(r *big.Rat) interface{}
+
+	// infix performs the binary operation, which is one of
+	// PLUS, MINUS, MULTIPLY, DIVIDE, MODULO, or POWER.
+	//
+	// Division by zero is caught by the caller.
+	infix(op string, a, b interface{}) (interface{}, error)
+}
+
+// convert moves a value into the given mode of arithmetic.
+func convert(to arithmetic, v interface{}) (interface{}, error) {
+
+	// Quantities keep their unit, but have their value converted.
+	if q, ok := v.(*Quantity); ok {
+		val, err := convert(to, q.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &Quantity{Value: val, Unit: q.Unit}, nil
+	}
+
+	switch dst := to.(type) {
+	case floatArith:
+		switch val := v.(type) {
+		case *big.Float:
+			f, _ := val.Float64()
+			return f, nil
+		case *big.Rat:
+			f, _ := val.Float64()
+			return f, nil
+		}
+	case bigFloatArith:
+		switch val := v.(type) {
+		case *big.Float:
+			return dst.newFloat(val).Set(val), nil
+		case *big.Rat:
+			return dst.newFloat().SetRat(val), nil
+		}
+	case ratArith:
+		switch val := v.(type) {
+		case *big.Float:
+			if val.IsInf() {
+				return nil, fmt.Errorf("%s cannot be represented exactly", val.String())
+			}
+			r, _ := val.Rat(nil)
+			return r, nil
+		case *big.Rat:
+			return new(big.Rat).Set(val), nil
+		}
+	}
+
+	// The shortest representation of a float64 is what the
+	// user most likely expects, so 0.1 becomes 1/10.
+	if f, ok := v.(float64); ok {
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return to.fromFloat(f)
+		}
+		return to.parse(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	return nil, fmt.Errorf("unknown value type %T", v)
+}
+
+// format returns a readable representation of the given value, for
+// use in error-messages.
+func format(v interface{}) string {
+	switch val := v.(type) {
+	case *big.Float:
+		return val.Text('g', 10)
+	case *big.Rat:
+		return val.RatString()
+	case *Quantity:
+		return val.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// exactInteger returns true if the given result of a calculation carried
+// out via float64 is a reasonably small integer, such as that of sqrt(16),
+// which we accept as exact if the arguments were exactly representable
+// as float64 values.
+func exactInteger(f float64) bool {
+	return math.Trunc(f) == f && math.Abs(f) < 1<<52
+}
+
+//
+// float64
+//
+
+// floatArith implements arithmetic using float64 values.
+type floatArith struct{}
+
+func (floatArith) parse(literal string) (interface{}, error) {
+	return strconv.ParseFloat(literal, 64)
+}
+
+func (floatArith) fromFloat(f float64) (interface{}, error) {
+	return f, nil
+}
+
+func (floatArith) toFloat(v interface{}) float64 {
+	return v.(float64)
+}
+
+func (floatArith) approximate(what string, f float64, args ...interface{}) (interface{}, error) {
+	return f, nil
+}
+
+func (floatArith) isZero(v interface{}) bool {
+	return v.(float64) == 0
+}
+
+func (floatArith) cmp(a, b interface{}) (int, bool) {
+	x := a.(float64)
+	y := b.(float64)
+
+	switch {
+	case math.IsNaN(x) || math.IsNaN(y):
+		return 0, false
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+func (floatArith) negate(v interface{}) interface{} {
+	return -v.(float64)
+}
+
+func (floatArith) toInt(v interface{}) (*big.Int, bool) {
+	f := v.(float64)
+	if math.IsInf(f, 0) || math.IsNaN(f) || math.Trunc(f) != f {
+		return nil, false
+	}
+	i, _ := big.NewFloat(f).Int(nil)
+	return i, true
+}
+
+func (floatArith) fromInt(i *big.Int) interface{} {
+	f, _ := new(big.Float).SetInt(i).Float64()
+	return f
+}
+
+func (floatArith) fromRat(r *big.Rat) interface{} {
+	f, _ := r.Float64()
+	return f
+}
+
+func (floatArith) infix(op string, a, b interface{}) (interface{}, error) {
+	x := a.(float64)
+	y := b.(float64)
+
+	switch op {
+	case PLUS:
+		return x + y, nil
+	case MINUS:
+		return x - y, nil
+	case MULTIPLY:
+		return x * y, nil
+	case DIVIDE:
+		return x / y, nil
+	case MODULO:
+		return math.Mod(x, y), nil
+	case POWER:
+		return math.Pow(x, y), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+//
+// big.Float
+//
+
+// bigFloatArith implements arithmetic using *big.Float values, with
+// the given number of bits of precision.
+type bigFloatArith struct {
+	prec uint
+}
+
+// newFloat returns a new *big.Float with our precision, or that of the
+// least precise of the given values if it is lower.
+//
+// This ensures that a result derived from an approximate value has no
+// more precision than that value, so that it isn't shown with digits
+// which are meaningless.
+func (b bigFloatArith) newFloat(from ...*big.Float) *big.Float {
+	prec := b.prec
+	for _, f := range from {
+		prec = min(prec, f.Prec())
+	}
+	return new(big.Float).SetPrec(prec)
+}
+
+func (b bigFloatArith) parse(literal string) (interface{}, error) {
+	f, _, err := big.ParseFloat(literal, 10, b.prec, big.ToNearestEven)
+	return f, err
+}
+
+func (b bigFloatArith) fromFloat(f float64) (interface{}, error) {
+	if math.IsNaN(f) {
+		return nil, fmt.Errorf("%v is not a number", f)
+	}
+	return b.newFloat().SetFloat64(f), nil
+}
+
+func (b bigFloatArith) toFloat(v interface{}) float64 {
+	f, _ := v.(*big.Float).Float64()
+	return f
+}
+
+// approximate returns the result with the precision of a float64, or
+// ours if that is lower, so that it is known to be approximate.
+//
+// A result which is exact, see exactInteger, has our full precision.
+func (b bigFloatArith) approximate(what string, f float64, args ...interface{}) (interface{}, error) {
+	if math.IsNaN(f) {
+		return nil, fmt.Errorf("%v is not a number", f)
+	}
+
+	exact := exactInteger(f)
+	for _, arg := range args {
+		if _, acc := arg.(*big.Float).Float64(); acc != big.Exact {
+			exact = false
+		}
+	}
+	if exact {
+		return b.newFloat().SetFloat64(f), nil
+	}
+	return new(big.Float).SetPrec(min(b.prec, 53)).SetFloat64(f), nil
+}
+
+func (b bigFloatArith) isZero(v interface{}) bool {
+	return v.(*big.Float).Sign() == 0
+}
+
+func (b bigFloatArith) cmp(x, y interface{}) (int, bool) {
+	return x.(*big.Float).Cmp(y.(*big.Float)), true
+}
+
+func (b bigFloatArith) negate(v interface{}) interface{} {
+	x := v.(*big.Float)
+	return b.newFloat(x).Neg(x)
+}
+
+func (b bigFloatArith) toInt(v interface{}) (*big.Int, bool) {
+	f := v.(*big.Float)
+	if f.IsInf() || !f.IsInt() {
+		return nil, false
+	}
+	i, _ := f.Int(nil)
+	return i, true
+}
+
+func (b bigFloatArith) fromInt(i *big.Int) interface{} {
+	return b.newFloat().SetInt(i)
+}
+
+func (b bigFloatArith) fromRat(r *big.Rat) interface{} {
+	return b.newFloat().SetRat(r)
+}
+
+func (b bigFloatArith) infix(op string, l, r interface{}) (res interface{}, err error) {
+	x := l.(*big.Float)
+	y := r.(*big.Float)
+
+	// Operations such as "Inf - Inf" will panic.
+	defer func() {
+		if rec := recover(); rec != nil {
+			nan, ok := rec.(big.ErrNaN)
+			if !ok {
+				panic(rec)
+			}
+			res, err = nil, fmt.Errorf("%s", nan.Error())
+		}
+	}()
+
+	switch op {
+	case PLUS:
+		return b.newFloat(x, y).Add(x, y), nil
+	case MINUS:
+		return b.newFloat(x, y).Sub(x, y), nil
+	case MULTIPLY:
+		return b.newFloat(x, y).Mul(x, y), nil
+	case DIVIDE:
+		return b.newFloat(x, y).Quo(x, y), nil
+	case MODULO:
+		// x - y * trunc(x/y)
+		q := b.newFloat(x, y).Quo(x, y)
+		if q.IsInf() {
+			return nil, fmt.Errorf("%s%s%s is not a number", format(x), op, format(y))
+		}
+		if y.IsInf() {
+			return b.newFloat(x).Set(x), nil
+		}
+		i, _ := q.Int(nil)
+		t := b.newFloat(x, y).SetInt(i)
+		return b.newFloat(x, y).Sub(x, t.Mul(t, y)), nil
+	case POWER:
+		// Integer exponents can be handled precisely.
+		if y.IsInt() {
+			if n, acc := y.Int64(); acc == big.Exact {
+				return b.pow(x, n), nil
+			}
+		}
+		return b.approximate(fmt.Sprintf("%s^(%s)", format(x), format(y)), math.Pow(b.toFloat(x), b.toFloat(y)), x, y)
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+// pow raises x to the integer power n, via repeated squaring.
+func (b bigFloatArith) pow(x *big.Float, n int64) *big.Float {
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+
+	result := b.newFloat(x).SetInt64(1)
+	base := b.newFloat(x).Set(x)
+	for n > 0 {
+		if n&1 == 1 {
+			result.Mul(result, base)
+		}
+		base.Mul(base, base)
+		n >>= 1
+	}
+
+	if neg {
+		return b.newFloat(x).Quo(b.newFloat(x).SetInt64(1), result)
+	}
+	return result
+}
+
+// sqrt returns the square-root of the given value, at full precision.
+func (b bigFloatArith) sqrt(v interface{}) (interface{}, error) {
+	x := v.(*big.Float)
+	if x.IsInf() && x.Sign() > 0 {
+		return x, nil
+	}
+	if x.Sign() < 0 {
+		return nil, fmt.Errorf("sqrt[%s] is not a number", x.String())
+	}
+	return b.newFloat(x).Sqrt(x), nil
+}
+
+//
+// big.Rat
+//
+
+// ratArith implements exact arithmetic using *big.Rat values.
+type ratArith struct{}
+
+func (ratArith) parse(literal string) (interface{}, error) {
+	r, ok := new(big.Rat).SetString(literal)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse number: %s", literal)
+	}
+	return r, nil
+}
+
+func (ratArith) fromFloat(f float64) (interface{}, error) {
+	r := new(big.Rat).SetFloat64(f)
+	if r == nil {
+		return nil, fmt.Errorf("%v cannot be represented exactly", f)
+	}
+	return r, nil
+}
+
+func (ratArith) toFloat(v interface{}) float64 {
+	f, _ := v.(*big.Rat).Float64()
+	return f
+}
+
+// approximate returns the result only if it is exact, see exactInteger.
+func (r ratArith) approximate(what string, f float64, args ...interface{}) (interface{}, error) {
+
+	exact := exactInteger(f)
+	for _, arg := range args {
+		if _, ok := arg.(*big.Rat).Float64(); !ok {
+			exact = false
+		}
+	}
+	if !exact {
+		return nil, fmt.Errorf("%s cannot be calculated exactly", what)
+	}
+	return r.fromFloat(f)
+}
+
+func (ratArith) isZero(v interface{}) bool {
+	return v.(*big.Rat).Sign() == 0
+}
+
+func (ratArith) cmp(x, y interface{}) (int, bool) {
+	return x.(*big.Rat).Cmp(y.(*big.Rat)), true
+}
+
+func (ratArith) negate(v interface{}) interface{} {
+	return new(big.Rat).Neg(v.(*big.Rat))
+}
+
+func (ratArith) toInt(v interface{}) (*big.Int, bool) {
+	r := v.(*big.Rat)
+	if !r.IsInt() {
+		return nil, false
+	}
+	return new(big.Int).Set(r.Num()), true
+}
+
+func (ratArith) fromInt(i *big.Int) interface{} {
+	return new(big.Rat).SetInt(i)
+}
+
+func (ratArith) fromRat(r *big.Rat) interface{} {
+	return new(big.Rat).Set(r)
+}
+
+func (r ratArith) infix(op string, a, b interface{}) (interface{}, error) {
+	x := a.(*big.Rat)
+	y := b.(*big.Rat)
+
+	switch op {
+	case PLUS:
+		return new(big.Rat).Add(x, y), nil
+	case MINUS:
+		return new(big.Rat).Sub(x, y), nil
+	case MULTIPLY:
+		return new(big.Rat).Mul(x, y), nil
+	case DIVIDE:
+		return new(big.Rat).Quo(x, y), nil
+	case MODULO:
+		// x - y * trunc(x/y)
+		q := new(big.Rat).Quo(x, y)
+		i := new(big.Int).Quo(q.Num(), q.Denom())
+		t := new(big.Rat).SetInt(i)
+		return new(big.Rat).Sub(x, t.Mul(t, y)), nil
+	case POWER:
+		// Integer exponents can be handled exactly.
+		if y.IsInt() && y.Num().IsInt64() {
+			return r.pow(x, y.Num().Int64())
+		}
+		return r.approximate(fmt.Sprintf("%s^(%s)", format(x), format(y)), math.Pow(r.toFloat(x), r.toFloat(y)), x, y)
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+// pow raises x to the integer power n, exactly.
+func (ratArith) pow(x *big.Rat, n int64) (interface{}, error) {
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+
+	// Avoid attempting to calculate something enormous.
+	bits := int64(x.Num().BitLen())
+	if d := int64(x.Denom().BitLen()); d > bits {
+		bits = d
+	}
+	if bits > 1 && n > maxIntegerBits/bits {
+		return nil, fmt.Errorf("result of %s^%d is too large", x.RatString(), n)
+	}
+
+	exp := big.NewInt(n)
+	num := new(big.Int).Exp(x.Num(), exp, nil)
+	den := new(big.Int).Exp(x.Denom(), exp, nil)
+
+	if neg {
+		if num.Sign() == 0 {
+			return nil, fmt.Errorf("Attempted division by zero: 1/%s", x.RatString())
+		}
+		num, den = den, num
+	}
+	return new(big.Rat).SetFrac(num, den), nil
+}
+
+// bitwise performs one of the bitwise operations upon two integers.
+func bitwise(op string, x, y *big.Int) (*big.Int, error) {
+
+	switch op {
+	case BITAND:
+		return new(big.Int).And(x, y), nil
+	case BITOR:
+		return new(big.Int).Or(x, y), nil
+	case XOR:
+		return new(big.Int).Xor(x, y), nil
+	case LSHIFT, RSHIFT:
+		if y.Sign() < 0 {
+			return nil, fmt.Errorf("negative shift count %s", y.String())
+		}
+		if !y.IsInt64() || (op == LSHIFT && int64(x.BitLen())+y.Int64() > maxIntegerBits) {
+			if op == RSHIFT {
+				// Shifting right by a huge amount leaves
+				// only the sign.
+				if x.Sign() < 0 {
+					return big.NewInt(-1), nil
+				}
+				return big.NewInt(0), nil
+			}
+			return nil, fmt.Errorf("result of %s<<%s is too large", x.String(), y.String())
+		}
+		if op == LSHIFT {
+			return new(big.Int).Lsh(x, uint(y.Int64())), nil
+		}
+		return new(big.Int).Rsh(x, uint(y.Int64())), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+// hasBasePrefix returns true if the given literal is an integer which
+// was written with a base-prefix, such as 0xff.
+func hasBasePrefix(literal string) bool {
+	if len(literal) < 2 || literal[0] != '0' {
+		return false
+	}
+	switch literal[1] {
+	case 'x', 'X', 'o', 'O', 'b', 'B':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,669 @@
+// parser.go - Contains our parser, which converts the tokens produced
+// by our lexer into an AST.
+//
+// The grammar we support, in order of increasing precedence, is:
+//
+//	program    := statement*
+//	statement  := "fn" IDENT "(" [ IDENT ( "," IDENT )* ] ")" "=" expression
+//	            | expression
+//	expression := [ "let" ] IDENT "=" expression
+//	            | "if" expression "then" expression "else" expression
+//	            | ternary
+//	ternary    := or [ "?" expression ":" expression ]
+//	or         := and ( "or" and )*
+//	and        := not ( "and" not )*
+//	not        := "not" not | comparison
+//	comparison := conversion ( ( "<" | "<=" | "==" | "!=" | ">=" | ">" ) conversion )*
+//	conversion := bitor ( ( "to" | "in" ) unit )*
+//	bitor      := bitxor ( "|" bitxor )*
+//	bitxor     := bitand ( "xor" bitand )*
+//	bitand     := shift ( "&" shift )*
+//	shift      := sum ( ( "<<" | ">>" ) sum )*
+//	sum        := term ( ( "+" | "-" ) term )*
+//	term       := unary ( ( "*" | "/" | "%" ) unary )*
+//	unary      := ( "-" | "+" | "~" ) unary | power
+//	power      := primary [ ( "^" | "**" ) unary ]
+//	primary    := NUMBER [ unit ] | IDENT | call | "(" expression ")"
+//	call       := IDENT "(" [ expression ( "," expression )* ] ")"
+//
+// Note that exponentiation is right-associative, so "2^3^2" is
+// the same as "2^(3^2)", and that it binds more tightly than
+// unary minus, so "-2^2" is "-(2^2)".
+//
+// Because "^" is used for exponentiation the bitwise exclusive-or
+// operator is spelled "xor".
+//
+// Comparisons, and the logical operators, produce 1 for true and 0
+// for false.  Any non-zero value is considered to be true.
+//
+// A unit attached to a number, such as "1.5GiB", is recognized by the
+// lexer, but the target of a conversion is parsed here.
+
+package calc
+
+import (
+	"fmt"
+)
+
+// maxNesting is the maximum depth of nested expressions we allow,
+// which prevents hostile input from exhausting the stack.
+const maxNesting = 1000
+
+// Parser holds the state of our parser.
+type Parser struct {
+
+	// tokens holds the series of tokens which our
+	// lexer produced from our input.
+	tokens []*Token
+
+	// Current position within the array of tokens.
+	token int
+
+	// nesting records how deeply nested our expressions are.
+	nesting int
+}
+
+// Parse converts the given input into an AST, which can be evaluated
+// via Evaluator.Evaluate as many times as necessary.
+//
+// Any error returned will be an *Error, which records the position of
+// the problem.
+func Parse(input string) (Node, error) {
+	p := NewParser(input)
+	return p.Parse()
+}
+
+// NewParser creates a new parser, for the given input.
+func NewParser(input string) *Parser {
+
+	// Create a lexer for splitting the program
+	lexer := NewLexer(input)
+
+	p := &Parser{}
+
+	// Parse the input into tokens, and
+	// save them away.
+	tok := lexer.Next()
+	for tok.Type != EOF {
+		p.tokens = append(p.tokens, tok)
+		tok = lexer.Next()
+	}
+
+	// Add an extra pair of EOF tokens so that nextToken
+	// can always be called, which record the position of
+	// the end of our input.
+	p.tokens = append(p.tokens, &Token{Value: "EOF", Type: EOF, Position: tok.Position})
+	p.tokens = append(p.tokens, &Token{Value: "EOF", Type: EOF, Position: tok.Position})
+
+	return p
+}
+
+// Parse parses the complete input, returning a Program.
+//
+// If multiple statements are present each is parsed in turn,
+// but errors will cause early-termination.
+func (p *Parser) Parse() (Node, error) {
+
+	program := &Program{Position: p.peekToken().Position}
+
+	for p.peekToken().Type != EOF {
+
+		// Did the lexer find something bogus?
+		if p.peekToken().Type == ERROR {
+			return nil, errorAt(p.peekToken(), "%s", p.peekToken().Value)
+		}
+
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		program.Statements = append(program.Statements, stmt)
+	}
+
+	return program, nil
+}
+
+// errorAt returns an *Error describing a problem found at the position
+// of the given token.
+func errorAt(tok *Token, format string, args ...interface{}) error {
+	return &Error{Position: tok.Position, Message: fmt.Sprintf(format, args...)}
+}
+
+// nextToken returns the next token from our input, and advances
+// our position past it.
+func (p *Parser) nextToken() *Token {
+	tok := p.tokens[p.token]
+	if p.token < len(p.tokens)-1 {
+		p.token++
+	}
+	return tok
+}
+
+// peekToken returns the next pending token in our stream.
+//
+// NOTE it is always possible to peek at the next token,
+// because we deliberately add an extra/spare EOF token
+// in our constructor.
+func (p *Parser) peekToken() *Token {
+	return p.tokens[p.token]
+}
+
+// peekTokenAt returns the token which is offset positions ahead of
+// our current position.
+func (p *Parser) peekTokenAt(offset int) *Token {
+	if p.token+offset >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.token+offset]
+}
+
+// statement parses a single statement, which is either a function
+// definition or an expression.
+func (p *Parser) statement() (Node, error) {
+
+	if p.peekToken().Type == FN {
+		return p.functionDefinition()
+	}
+	return p.expression()
+}
+
+// functionDefinition parses "fn name(a, b, ..) = expression".
+func (p *Parser) functionDefinition() (Node, error) {
+
+	// Skip the fn
+	fn := p.nextToken()
+
+	// Get the name
+	name := p.nextToken()
+	if name.Type != IDENT {
+		return nil, errorAt(name, "%v is not an identifier", name)
+	}
+
+	if p.peekToken().Type != LPAREN {
+		return nil, errorAt(p.peekToken(), "expected '(' after function name %s", name.Value)
+	}
+	p.nextToken()
+
+	def := &FunctionDefinition{Position: fn.Position, Name: name.Value.(string)}
+
+	// Collect the parameter names, if any
+	for p.peekToken().Type != RPAREN {
+
+		param := p.nextToken()
+		if param.Type != IDENT {
+			return nil, errorAt(param, "%v is not an identifier", param)
+		}
+		for _, existing := range def.Parameters {
+			if existing == param.Value.(string) {
+				return nil, errorAt(param, "duplicate parameter %s in function %s", existing, def.Name)
+			}
+		}
+		def.Parameters = append(def.Parameters, param.Value.(string))
+
+		if p.peekToken().Type == COMMA {
+			p.nextToken()
+			continue
+		}
+		if p.peekToken().Type != RPAREN {
+			return nil, errorAt(p.peekToken(), "expected ',' or ')' in parameters of %s, found %v", def.Name, p.peekToken())
+		}
+	}
+
+	// skip the ")"
+	p.nextToken()
+
+	if p.peekToken().Type != ASSIGN {
+		return nil, errorAt(p.peekToken(), "expected '=' after parameters of function %s", def.Name)
+	}
+	p.nextToken()
+
+	body, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	def.Body = body
+
+	return def, nil
+}
+
+// expression parses an expression, which might be an assignment.
+func (p *Parser) expression() (Node, error) {
+
+	p.nesting++
+	defer func() { p.nesting-- }()
+	if p.nesting > maxNesting {
+		return nil, errorAt(p.peekToken(), "expression nested too deeply")
+	}
+
+	//
+	// Assignment with LET
+	//
+	// If the keyword is followed by an operator then it is being
+	// used as a value, and that will be reported by primary().
+	//
+	if p.peekToken().Type == LET && !isInfix(p.peekTokenAt(1).Type) {
+
+		// Skip the let
+		p.nextToken()
+
+		// Get the identifier.
+		ident := p.nextToken()
+		if ident.Type != IDENT {
+			return nil, errorAt(ident, "%v is not an identifier", ident)
+		}
+
+		// Skip the assignment statement
+		assign := p.nextToken()
+		if assign.Type != ASSIGN {
+			return nil, errorAt(assign, "%v is not an assignment statement", ident)
+		}
+
+		return p.assignment(ident)
+	}
+
+	//
+	// Assignment without LET ?
+	//
+	if p.peekToken().Type == IDENT && p.peekTokenAt(1).Type == ASSIGN {
+
+		ident := p.nextToken()
+
+		// Skip the assignment
+		p.nextToken()
+
+		return p.assignment(ident)
+	}
+
+	//
+	// If we reach here we're now done with assignments.
+	//
+	if p.peekToken().Type == IF {
+		return p.conditional()
+	}
+	return p.ternary()
+}
+
+// conditional parses "if condition then expression else expression".
+func (p *Parser) conditional() (Node, error) {
+
+	// Skip the if
+	tok := p.nextToken()
+
+	cond, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if p.peekToken().Type != THEN {
+		return nil, errorAt(p.peekToken(), "expected 'then' after condition, found %v", p.peekToken())
+	}
+	p.nextToken()
+
+	yes, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if p.peekToken().Type != ELSE {
+		return nil, errorAt(p.peekToken(), "expected 'else' after 'then', found %v", p.peekToken())
+	}
+	p.nextToken()
+
+	no, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conditional{Position: tok.Position, Condition: cond, Consequence: yes, Alternative: no}, nil
+}
+
+// ternary parses "condition ? expression : expression", which is an
+// alternative spelling of "if .. then .. else".
+func (p *Parser) ternary() (Node, error) {
+
+	cond, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.peekToken().Type != QUESTION {
+		return cond, nil
+	}
+	tok := p.nextToken()
+
+	yes, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if p.peekToken().Type != COLON {
+		return nil, errorAt(p.peekToken(), "expected ':' after '?', found %v", p.peekToken())
+	}
+	p.nextToken()
+
+	no, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conditional{Position: tok.Position, Condition: cond, Consequence: yes, Alternative: no}, nil
+}
+
+// or parses a logical or.
+func (p *Parser) or() (Node, error) {
+	return p.binary(p.and, OR)
+}
+
+// and parses a logical and.
+func (p *Parser) and() (Node, error) {
+	return p.binary(p.not, AND)
+}
+
+// not parses a logical not, which binds more loosely than comparisons.
+func (p *Parser) not() (Node, error) {
+
+	tok := p.peekToken()
+	if tok.Type != NOT {
+		return p.comparison()
+	}
+	p.nextToken()
+
+	p.nesting++
+	defer func() { p.nesting-- }()
+	if p.nesting > maxNesting {
+		return nil, errorAt(tok, "expression nested too deeply")
+	}
+
+	right, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	return &PrefixExpression{Position: tok.Position, Operator: NOT, Right: right}, nil
+}
+
+// comparison parses the comparison operators.
+func (p *Parser) comparison() (Node, error) {
+	return p.binary(p.conversion, LT, LE, EQ, NE, GE, GT)
+}
+
+// conversion parses conversions, such as "2h to minutes".
+func (p *Parser) conversion() (Node, error) {
+
+	left, err := p.bitOr()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekToken().Type == TO {
+
+		op := p.nextToken()
+
+		var unit string
+		unit, err = p.unit(op)
+		if err != nil {
+			return nil, err
+		}
+		left = &Conversion{Position: op.Position, Value: left, Unit: unit}
+	}
+
+	return left, nil
+}
+
+// unit parses the name of the unit which follows "to" or "in".
+//
+// As the lexer only recognizes units attached to a number a rate, such
+// as "MB/s", will be seen as a series of tokens which we join together.
+func (p *Parser) unit(op *Token) (string, error) {
+
+	tok := p.nextToken()
+	if tok.Type != IDENT {
+		return "", errorAt(tok, "expected unit after '%s', found %v", op.Value, tok)
+	}
+	name := tok.Value.(string)
+	start := tok
+
+	if p.peekToken().Type == DIVIDE && p.peekTokenAt(1).Type == IDENT {
+		rate := name + "/" + p.peekTokenAt(1).Value.(string)
+		if _, ok := LookupUnit(rate); ok {
+			p.nextToken()
+			p.nextToken()
+			name = rate
+		}
+	}
+
+	if _, ok := LookupUnit(name); !ok {
+		return "", errorAt(start, "unknown unit '%s'", name)
+	}
+	return name, nil
+}
+
+// binary parses a left-associative series of operations, where the
+// operands are parsed by next and the operators are those given.
+func (p *Parser) binary(next func() (Node, error), ops ...string) (Node, error) {
+
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	for isOneOf(p.peekToken().Type, ops) {
+
+		op := p.nextToken()
+
+		var right Node
+		right, err = next()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &InfixExpression{Position: op.Position, Left: left, Operator: op.Type, Right: right}
+	}
+
+	return left, nil
+}
+
+// isOneOf returns true if the given token-type is one of those listed.
+func isOneOf(t string, types []string) bool {
+	for _, x := range types {
+		if t == x {
+			return true
+		}
+	}
+	return false
+}
+
+// bitOr parses a bitwise or.
+func (p *Parser) bitOr() (Node, error) {
+	return p.binary(p.bitXor, BITOR)
+}
+
+// bitXor parses a bitwise exclusive-or.
+func (p *Parser) bitXor() (Node, error) {
+	return p.binary(p.bitAnd, XOR)
+}
+
+// bitAnd parses a bitwise and.
+func (p *Parser) bitAnd() (Node, error) {
+	return p.binary(p.shift, BITAND)
+}
+
+// shift parses left and right shifts.
+func (p *Parser) shift() (Node, error) {
+	return p.binary(p.sum, LSHIFT, RSHIFT)
+}
+
+// sum parses addition and subtraction.
+func (p *Parser) sum() (Node, error) {
+	return p.binary(p.term, PLUS, MINUS)
+}
+
+// isInfix returns true if the given token-type is a binary operator.
+func isInfix(t string) bool {
+	switch t {
+	case PLUS, MINUS, MULTIPLY, DIVIDE, MODULO, POWER,
+		BITAND, BITOR, XOR, LSHIFT, RSHIFT, TO,
+		LT, LE, EQ, NE, GE, GT, AND, OR, QUESTION:
+		return true
+	}
+	return false
+}
+
+// assignment parses the expression on the right-hand side of
+// an assignment, once the variable-name has been consumed.
+func (p *Parser) assignment(ident *Token) (Node, error) {
+
+	value, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &Assignment{Position: ident.Position, Name: ident.Value.(string), Value: value}, nil
+}
+
+// term parses multiplication, division, and modulus.
+func (p *Parser) term() (Node, error) {
+
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peekToken()
+	for op.Type == MULTIPLY || op.Type == DIVIDE || op.Type == MODULO {
+
+		p.nextToken()
+
+		var right Node
+		right, err = p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &InfixExpression{Position: op.Position, Left: left, Operator: op.Type, Right: right}
+
+		op = p.peekToken()
+	}
+
+	if op.Type == ERROR {
+		return nil, errorAt(op, "Unexpected token inside term() - %v", op)
+	}
+
+	return left, nil
+}
+
+// unary parses a leading "+", "-", or "~".
+func (p *Parser) unary() (Node, error) {
+
+	tok := p.peekToken()
+	if tok.Type == MINUS || tok.Type == PLUS || tok.Type == BITNOT {
+
+		p.nextToken()
+
+		p.nesting++
+		defer func() { p.nesting-- }()
+		if p.nesting > maxNesting {
+			return nil, errorAt(tok, "expression nested too deeply")
+		}
+
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &PrefixExpression{Position: tok.Position, Operator: tok.Type, Right: right}, nil
+	}
+
+	return p.power()
+}
+
+// power parses exponentiation, which is right-associative.
+func (p *Parser) power() (Node, error) {
+
+	left, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peekToken().Type == POWER {
+
+		op := p.nextToken()
+
+		// The exponent may itself be negative, or
+		// a further exponentiation.
+		var right Node
+		right, err = p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &InfixExpression{Position: op.Position, Left: left, Operator: POWER, Right: right}, nil
+	}
+
+	return left, nil
+}
+
+// primary parses a number, a variable-reference, or a
+// parenthesized expression.
+func (p *Parser) primary() (Node, error) {
+
+	tok := p.nextToken()
+
+	switch tok.Type {
+	case EOF:
+		return nil, errorAt(tok, "unexpected EOF in factor()")
+	case NUMBER:
+		return &NumberLiteral{Position: tok.Position, Value: tok.Value.(float64), Literal: tok.Literal, Unit: tok.Unit}, nil
+	case IDENT:
+		if p.peekToken().Type == LPAREN {
+			return p.call(tok)
+		}
+		return &Identifier{Position: tok.Position, Name: tok.Value.(string)}, nil
+	case LET:
+		return nil, errorAt(tok, "%v is not a number", tok)
+	case LPAREN:
+
+		// evaluate the expression
+		res, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+
+		// next token should be ")"
+		if p.peekToken().Type != RPAREN {
+			return nil, errorAt(p.peekToken(), "expected ')' after expression found %v", p.peekToken())
+		}
+
+		// skip that ")"
+		p.nextToken()
+
+		return res, nil
+	}
+
+	return nil, errorAt(tok, "Unexpected token inside factor() - %v", tok)
+}
+
+// call parses the arguments to a function-call, once the name of the
+// function has been consumed.
+func (p *Parser) call(fn *Token) (Node, error) {
+
+	// skip the "("
+	p.nextToken()
+
+	name := fn.Value.(string)
+	call := &CallExpression{Position: fn.Position, Function: name}
+
+	for p.peekToken().Type != RPAREN {
+
+		arg, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		call.Arguments = append(call.Arguments, arg)
+
+		if p.peekToken().Type == COMMA {
+			p.nextToken()
+			continue
+		}
+		if p.peekToken().Type != RPAREN {
+			return nil, errorAt(p.peekToken(), "expected ',' or ')' in arguments to %s, found %v", name, p.peekToken())
+		}
+	}
+
+	// skip the ")"
+	p.nextToken()
+
+	return call, nil
+}
@@ -0,0 +1,136 @@
+package calc
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestPrecedence confirms the parser builds the AST we expect.
+func TestPrecedence(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"1 * 2 + 3", "((1 * 2) + 3)"},
+		{"1 - 2 - 3", "((1 - 2) - 3)"},
+		{"2 ^ 3 ^ 2", "(2 ^ (3 ^ 2))"},
+		{"2 ** 3", "(2 ^ 3)"},
+		{"-2 ^ 2", "(-(2 ^ 2))"},
+		{"2 ^ -1", "(2 ^ (-1))"},
+		{"7 % 3 * 2", "((7 % 3) * 2)"},
+		{"-(2 + 3)", "(-(2 + 3))"},
+		{"+-pi", "(+(-pi))"},
+		{"let a = b = 3", "a = b = 3"},
+		{"a = 1 ; b = a", "a = 1; b = a"},
+		{"sqrt(2) * 3", "(sqrt(2) * 3)"},
+		{"1 | 2 xor 3 & 4 << 5 + 6", "(1 | (2 xor (3 & (4 << (5 + 6)))))"},
+		{"~a & b", "((~a) & b)"},
+		{"max(1, 2 + 3, -x)", "max(1, (2 + 3), (-x))"},
+		{"fn hyp(a, b) = sqrt(a*a + b*b)", "fn hyp(a, b) = sqrt(((a * a) + (b * b)))"},
+		{"1 + 2 < 4 and not 3 == 4", "(((1 + 2) < 4) and (not (3 == 4)))"},
+		{"a or b and c", "(a or (b and c))"},
+		{"1GiB to MiB > 512MiB", "((1GiB to MiB) > 512MiB)"},
+		{"x > 1 ? 2 : 3", "(if (x > 1) then 2 else 3)"},
+		{"if a then b else if c then d else e", "(if a then b else (if c then d else e))"},
+		{"a ? b : c ? d : e", "(if a then b else (if c then d else e))"},
+		{"r = if x then 1 else 2 # comment", "r = (if x then 1 else 2)"},
+	}
+
+	for _, test := range tests {
+
+		node, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("unexpected error parsing '%s': %s", test.input, err)
+		}
+
+		if node.String() != test.output {
+			t.Fatalf("wrong AST for '%s', expected '%s' got '%s'", test.input, test.output, node.String())
+		}
+	}
+}
+
+// TestParseErrors ensures that errors are returned, rather than
+// a partial AST.
+func TestParseErrors(t *testing.T) {
+
+	tests := []struct {
+		input string
+		error string
+	}{
+		{"1 +", "unexpected EOF"},
+		{"2 ^", "unexpected EOF"},
+		{"( 3", "expected ')'"},
+		{"3.3.3", "too many periods"},
+		{"if 1 then 2", "expected 'else'"},
+		{"if 1 else 2", "expected 'then'"},
+		{"1 ? 2", "expected ':'"},
+		{"1 ! 2", "unknown character !"},
+	}
+
+	for _, test := range tests {
+
+		node, err := Parse(test.input)
+		if err == nil {
+			t.Fatalf("expected error parsing '%s', got %v", test.input, node)
+		}
+		if !strings.Contains(err.Error(), test.error) {
+			t.Fatalf("expected error '%s', but found %s", test.error, err.Error())
+		}
+	}
+}
+
+// TestReuse confirms a parsed expression may be evaluated repeatedly.
+func TestReuse(t *testing.T) {
+
+	node, err := Parse("x * 2 + 1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	e := New()
+	for i := 0; i < 5; i++ {
+		e.variables["x"] = float64(i)
+
+		out := e.Evaluate(node)
+		if out.Type != NUMBER {
+			t.Fatalf("Output was not a number: %v\n", out)
+		}
+		if out.Value.(float64) != float64(i*2+1) {
+			t.Fatalf("wrong result for x=%d: %v", i, out.Value)
+		}
+	}
+}
+
+// TestParseErrorPosition ensures parse errors record where the problem is.
+func TestParseErrorPosition(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		line   int
+		column int
+	}{
+		{"1 +", 1, 4},
+		{"( 3 ", 1, 4},
+		{"a = 1\nb = 2 * )", 2, 9},
+		{"3 + 3 $", 1, 7},
+		{"1 to furlongs", 1, 6},
+	}
+
+	for _, test := range tests {
+
+		_, err := Parse(test.input)
+		if err == nil {
+			t.Fatalf("expected error parsing '%s'", test.input)
+		}
+
+		perr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("expected *Error parsing '%s', got %T", test.input, err)
+		}
+		if perr.Line != test.line || perr.Column != test.column {
+			t.Fatalf("wrong position for '%s', expected %d:%d got %d:%d", test.input, test.line, test.column, perr.Line, perr.Column)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// save.go - Contains the code to serialise the state of an evaluator,
+// so that a session may be saved and later restored.
+
+package calc
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// constants holds the names of the variables which are defined by
+// default, or updated automatically, and are not saved.
+var constants = map[string]bool{
+	"e":      true,
+	"pi":     true,
+	"result": true,
+}
+
+// Save writes the user-defined variables and functions to the given
+// writer, as a series of statements.
+//
+// The output may be restored by passing it to Load, and then calling
+// Run.  The constants pi and e, and the result variable, are not saved.
+func (e *Evaluator) Save(w io.Writer) error {
+
+	var names []string
+	for name := range e.variables {
+		if !constants[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		val, err := literal(e.variables[name])
+		if err != nil {
+			return fmt.Errorf("cannot save variable %s: %s", name, err)
+		}
+		_, err = fmt.Fprintf(w, "%s = %s\n", name, val)
+		if err != nil {
+			return err
+		}
+	}
+
+	names = nil
+	for name := range e.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		_, err := fmt.Fprintf(w, "%s\n", e.functions[name].String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// literal converts the given value into an expression which will
+// produce the same value when it is evaluated.
+//
+// Our lexer doesn't support exponents, so numbers are always written
+// out in full.
+func literal(v interface{}) (string, error) {
+
+	switch val := v.(type) {
+	case float64:
+		if math.IsInf(val, 0) || math.IsNaN(val) {
+			return "", fmt.Errorf("%v is not a finite number", val)
+		}
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+
+	case *big.Float:
+		if val.IsInf() {
+			return "", fmt.Errorf("%s is not a finite number", val.String())
+		}
+		return val.Text('f', -1), nil
+
+	case *big.Rat:
+		if val.IsInt() {
+			return val.Num().String(), nil
+		}
+		return val.Num().String() + " / " + val.Denom().String(), nil
+
+	case *Quantity:
+		if _, ok := LookupUnit(val.Unit.Name); !ok {
+			return "", fmt.Errorf("unit %s cannot be written", val.Unit.Name)
+		}
+		num, err := literal(val.Value)
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(num, " ") {
+			return "(" + num + ") * 1" + val.Unit.Name, nil
+		}
+		return num + val.Unit.Name, nil
+	}
+
+	return "", fmt.Errorf("unknown value-type %T", v)
+}
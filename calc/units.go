@@ -0,0 +1,422 @@
+// units.go - Contains the units of measurement we understand.
+//
+// We support units of data (bytes and bits) and time, along with rates
+// built from them such as "MB/s".  Numbers may have a unit attached by
+// using it as a suffix, for example "1.5GiB", "300ms", or "10Mbit".
+
+package calc
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// dimension records the exponent of each base-unit which makes up
+// a unit.
+//
+// For example a rate, such as "MB/s", has a data exponent of one
+// and a time exponent of minus one.
+type dimension struct {
+	data int
+	time int
+}
+
+// mul returns the dimension of the product of two values.
+func (d dimension) mul(o dimension) dimension {
+	return dimension{data: d.data + o.data, time: d.time + o.time}
+}
+
+// div returns the dimension of the quotient of two values.
+func (d dimension) div(o dimension) dimension {
+	return dimension{data: d.data - o.data, time: d.time - o.time}
+}
+
+// pow returns the dimension of a value raised to the given power.
+func (d dimension) pow(n int) dimension {
+	return dimension{data: d.data * n, time: d.time * n}
+}
+
+// isZero returns true if the dimension is empty, which means
+// values with this dimension are plain numbers.
+func (d dimension) isZero() bool {
+	return d.data == 0 && d.time == 0
+}
+
+// Unit describes a unit of measurement.
+type Unit struct {
+
+	// Name holds the name of the unit, as it was written.
+	Name string
+
+	// dim holds the dimension of this unit.
+	dim dimension
+
+	// factor holds the number of base-units in one of this unit.
+	//
+	// Our base-units are the byte, and the second.
+	factor *big.Rat
+}
+
+// Quantity holds a value which has a unit attached.
+//
+// NUMBER tokens returned by Run will contain a *Quantity if the result
+// of the calculation has a unit.
+type Quantity struct {
+
+	// Value holds the magnitude of the quantity, in terms of Unit.
+	//
+	// This will be a float64, a *big.Float, or a *big.Rat depending
+	// upon the arithmetic in use.
+	Value interface{}
+
+	// Unit holds the unit the value is expressed in.
+	Unit *Unit
+}
+
+// String returns a readable representation of the quantity.
+func (q *Quantity) String() string {
+	return fmt.Sprintf("%s %s", format(q.Value), q.Unit.Name)
+}
+
+// simpleUnits contains the units which may not have a prefix.
+var simpleUnits = map[string]dimension{}
+
+// unitFactors holds the factor for each of our named units.
+var unitFactors = map[string]*big.Rat{}
+
+// dataBase and timeBase are the dimensions of data, and time.
+var (
+	dataBase = dimension{data: 1}
+	timeBase = dimension{time: 1}
+)
+
+// init populates our table of named units.
+func init() {
+
+	add := func(dim dimension, factor string, names ...string) {
+		f, _ := new(big.Rat).SetString(factor)
+		for _, n := range names {
+			simpleUnits[n] = dim
+			unitFactors[n] = f
+		}
+	}
+
+	add(dataBase, "1", "B", "byte", "bytes")
+	add(dataBase, "1/8", "bit", "bits")
+	add(dataBase.div(timeBase), "1/8", "bps")
+	add(timeBase, "1", "s", "sec", "secs", "second", "seconds")
+	add(timeBase, "60", "m", "min", "mins", "minute", "minutes")
+	add(timeBase, "3600", "h", "hr", "hrs", "hour", "hours")
+	add(timeBase, "86400", "d", "day", "days")
+	add(timeBase, "604800", "w", "week", "weeks")
+}
+
+// dataPrefixes contains the prefixes which may be applied to the
+// units of data; "B", "bit", and "b".
+var dataPrefixes = map[string]string{
+	"k": "1000", "K": "1000",
+	"M": "1000000",
+	"G": "1000000000",
+	"T": "1000000000000",
+	"P": "1000000000000000",
+	"E": "1000000000000000000",
+
+	"Ki": "1024",
+	"Mi": "1048576",
+	"Gi": "1073741824",
+	"Ti": "1099511627776",
+	"Pi": "1125899906842624",
+	"Ei": "1152921504606846976",
+}
+
+// timePrefixes contains the prefixes which may be applied to seconds.
+var timePrefixes = map[string]string{
+	"m": "1/1000",
+	"u": "1/1000000",
+	"µ": "1/1000000",
+	"n": "1/1000000000",
+}
+
+// LookupUnit returns the unit with the given name, if it is known.
+//
+// As well as simple units, such as "GiB", "ms", or "hours" we support
+// rates such as "MB/s" and "Mbps".
+func LookupUnit(name string) (*Unit, bool) {
+
+	// A rate?
+	if i := strings.Index(name, "/"); i > 0 {
+		num, ok := LookupUnit(name[:i])
+		if !ok {
+			return nil, false
+		}
+		den, ok := LookupUnit(name[i+1:])
+		if !ok || strings.Contains(name[i+1:], "/") {
+			return nil, false
+		}
+		return &Unit{Name: name, dim: num.dim.div(den.dim), factor: new(big.Rat).Quo(num.factor, den.factor)}, true
+	}
+
+	// A simple unit?
+	if dim, ok := simpleUnits[name]; ok {
+		return &Unit{Name: name, dim: dim, factor: unitFactors[name]}, true
+	}
+
+	// "Mbps" is the same as "Mb/s".
+	if strings.HasSuffix(name, "ps") && len(name) > 2 {
+		if u, ok := LookupUnit(name[:len(name)-2]); ok && u.dim == dataBase {
+			return &Unit{Name: name, dim: dataBase.div(timeBase), factor: u.factor}, true
+		}
+	}
+
+	// A prefixed unit?
+	for prefix, factor := range dataPrefixes {
+		base := strings.TrimPrefix(name, prefix)
+		if base == name {
+			continue
+		}
+
+		switch base {
+		case "B", "bit", "bits", "b":
+			f, _ := new(big.Rat).SetString(factor)
+			if base != "B" {
+				f.Quo(f, big.NewRat(8, 1))
+			}
+			return &Unit{Name: name, dim: dataBase, factor: f}, true
+		}
+	}
+	for prefix, factor := range timePrefixes {
+		if name == prefix+"s" {
+			f, _ := new(big.Rat).SetString(factor)
+			return &Unit{Name: name, dim: timeBase, factor: f}, true
+		}
+	}
+
+	return nil, false
+}
+
+// canonicalUnit returns the unit, in terms of bytes and seconds,
+// which is used for the result of multiplying or dividing quantities.
+func canonicalUnit(dim dimension) *Unit {
+
+	var num, den []string
+
+	part := func(name string, exp int) {
+		switch {
+		case exp == 1:
+			num = append(num, name)
+		case exp > 1:
+			num = append(num, fmt.Sprintf("%s^%d", name, exp))
+		case exp == -1:
+			den = append(den, name)
+		case exp < -1:
+			den = append(den, fmt.Sprintf("%s^%d", name, -exp))
+		}
+	}
+	part("B", dim.data)
+	part("s", dim.time)
+
+	name := strings.Join(num, "*")
+	if name == "" {
+		name = "1"
+	}
+	if len(den) > 0 {
+		name += "/" + strings.Join(den, "*")
+	}
+
+	return &Unit{Name: name, dim: dim, factor: big.NewRat(1, 1)}
+}
+
+// isQuantity returns true if the given value has a unit.
+func isQuantity(v interface{}) bool {
+	_, ok := v.(*Quantity)
+	return ok
+}
+
+// unitOf splits a value into its number, and its unit.
+//
+// Plain numbers have a nil unit.
+func unitOf(v interface{}) (interface{}, *Unit) {
+	if q, ok := v.(*Quantity); ok {
+		return q.Value, q.Unit
+	}
+	return v, nil
+}
+
+// dimOf returns the dimension of the given unit, which may be nil.
+func dimOf(u *Unit) dimension {
+	if u == nil {
+		return dimension{}
+	}
+	return u.dim
+}
+
+// nameOf returns the name of the given unit, for use in error-messages.
+func nameOf(u *Unit) string {
+	if u == nil {
+		return "no unit"
+	}
+	return u.Name
+}
+
+// describe returns a readable representation of a number, and
+// its unit, for use in error-messages.
+func describe(v interface{}, u *Unit) string {
+	if u == nil {
+		return format(v)
+	}
+	return format(&Quantity{Value: v, Unit: u})
+}
+
+// toBase converts a number expressed in the given unit into our
+// base-units; bytes and seconds.
+func (e *Evaluator) toBase(v interface{}, u *Unit) (interface{}, error) {
+	if u == nil {
+		return v, nil
+	}
+	return e.arith.infix(MULTIPLY, v, e.arith.fromRat(u.factor))
+}
+
+// fromBase converts a number expressed in base-units into the given unit.
+func (e *Evaluator) fromBase(v interface{}, u *Unit) (interface{}, error) {
+	if u == nil {
+		return v, nil
+	}
+	return e.arith.infix(DIVIDE, v, e.arith.fromRat(u.factor))
+}
+
+// evalUnits handles binary operations where at least one operand
+// has a unit.
+func (e *Evaluator) evalUnits(op string, a, b interface{}) *Token {
+
+	av, au := unitOf(a)
+	bv, bu := unitOf(b)
+
+	res, unit, err := e.unitInfix(op, av, au, bv, bu)
+	if err != nil {
+		return &Token{Type: ERROR, Value: err.Error()}
+	}
+
+	// Units might cancel out, for example "1GiB / 1MiB".
+	if unit == nil {
+		return &Token{Type: NUMBER, Value: res}
+	}
+	return &Token{Type: NUMBER, Value: &Quantity{Value: res, Unit: unit}}
+}
+
+// unitInfix performs the arithmetic for evalUnits, returning the
+// result and the unit it is expressed in.
+func (e *Evaluator) unitInfix(op string, av interface{}, au *Unit, bv interface{}, bu *Unit) (interface{}, *Unit, error) {
+
+	switch op {
+	case PLUS, MINUS, MODULO:
+
+		// Both sides must have the same dimension, and we
+		// express the result in the unit of the left side.
+		if au == nil || bu == nil || au.dim != bu.dim {
+			return nil, nil, fmt.Errorf("incompatible units for %s: %s and %s", op, nameOf(au), nameOf(bu))
+		}
+
+		base, err := e.toBase(bv, bu)
+		if err != nil {
+			return nil, nil, err
+		}
+		bv, err = e.fromBase(base, au)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if op == MODULO && e.arith.isZero(bv) {
+			return nil, nil, fmt.Errorf("Attempted division by zero: %s%%%s", describe(av, au), describe(bv, bu))
+		}
+		res, err := e.arith.infix(op, av, bv)
+		return res, au, err
+
+	case MULTIPLY, DIVIDE:
+
+		if op == DIVIDE && e.arith.isZero(bv) {
+			return nil, nil, fmt.Errorf("Attempted division by zero: %s/%s", describe(av, au), describe(bv, bu))
+		}
+
+		// Scaling by a plain number keeps the unit.
+		if bu == nil {
+			res, err := e.arith.infix(op, av, bv)
+			return res, au, err
+		}
+		if au == nil && op == MULTIPLY {
+			res, err := e.arith.infix(op, av, bv)
+			return res, bu, err
+		}
+
+		// Otherwise we work in base-units.
+		x, err := e.toBase(av, au)
+		if err != nil {
+			return nil, nil, err
+		}
+		y, err := e.toBase(bv, bu)
+		if err != nil {
+			return nil, nil, err
+		}
+		res, err := e.arith.infix(op, x, y)
+
+		dim := dimOf(au).mul(bu.dim)
+		if op == DIVIDE {
+			dim = dimOf(au).div(bu.dim)
+		}
+		if dim.isZero() {
+			return res, nil, err
+		}
+		return res, canonicalUnit(dim), err
+
+	case POWER:
+
+		// The exponent must be a plain integer.
+		n, ok := e.arith.toInt(bv)
+		if bu != nil || !ok || !n.IsInt64() || n.Int64() > 64 || n.Int64() < -64 {
+			return nil, nil, fmt.Errorf("a value with units may only be raised to a small integer power, got %s", format(bv))
+		}
+
+		x, err := e.toBase(av, au)
+		if err != nil {
+			return nil, nil, err
+		}
+		res, err := e.arith.infix(POWER, x, bv)
+
+		dim := au.dim.pow(int(n.Int64()))
+		if dim.isZero() {
+			return res, nil, err
+		}
+		return res, canonicalUnit(dim), err
+	}
+
+	return nil, nil, fmt.Errorf("operator %s cannot be used with units: %s and %s", op, nameOf(au), nameOf(bu))
+}
+
+// evalConversion converts a value to a different unit.
+func (e *Evaluator) evalConversion(n *Conversion) *Token {
+
+	val := e.evaluate(n.Value)
+	if val.Type != NUMBER {
+		return val
+	}
+
+	target, ok := LookupUnit(n.Unit)
+	if !ok {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("unknown unit '%s'", n.Unit)}
+	}
+
+	v, unit := unitOf(val.Value)
+	if unit == nil || unit.dim != target.dim {
+		return &Token{Type: ERROR, Value: fmt.Sprintf("cannot convert %s to %s", nameOf(unit), target.Name)}
+	}
+
+	base, err := e.toBase(v, unit)
+	if err != nil {
+		return &Token{Type: ERROR, Value: err.Error()}
+	}
+	res, err := e.fromBase(base, target)
+	if err != nil {
+		return &Token{Type: ERROR, Value: err.Error()}
+	}
+	return &Token{Type: NUMBER, Value: &Quantity{Value: res, Unit: target}}
+}
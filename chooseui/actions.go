@@ -0,0 +1,264 @@
+// actions.go - Contains the named actions which may be bound to keys,
+// via BindSpec, such as "ctrl-e:execute(vim {})".
+
+package chooseui
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/rivo/tview"
+	"github.com/skx/sysbox/templatedcmd"
+)
+
+// BindSpec parses a binding of the form "key:action", and binds the
+// action to the key.
+//
+// The available actions are:
+//
+//	accept         Choose the highlighted, or marked, entries.
+//	abort          Exit without choosing anything.
+//	exit(N)        Choose, as with accept, and set the exit-code to N.
+//	execute(CMD)   Run a command, expanded via templatedcmd, with the
+//	               highlighted entry, or with the marked entries if it
+//	               uses "{+}".
+//	reload(CMD)    Replace the entries with the output of a command.
+//	toggle         Mark, or unmark, the highlighted entry.
+//	up, down       Move up or down.
+//	first, last    Move to the first or last entry.
+//	delete-line    Clear the filter.
+func (ui *ChooseUI) BindSpec(spec string) error {
+
+	key, action, ok := strings.Cut(spec, ":")
+
+	// Allow ":" to be bound.
+	if strings.HasPrefix(spec, "::") {
+		key, action, ok = ":", spec[2:], true
+	}
+	if !ok || key == "" || action == "" {
+		return fmt.Errorf("binding '%s' is not of the form key:action", spec)
+	}
+
+	fn, err := ui.parseAction(action)
+	if err != nil {
+		return err
+	}
+	return ui.Bind(key, fn)
+}
+
+// parseAction returns the Action for the given action-name.
+func (ui *ChooseUI) parseAction(action string) (Action, error) {
+
+	name, arg := action, ""
+	if open := strings.Index(action, "("); open > 0 && strings.HasSuffix(action, ")") {
+		name = action[:open]
+		arg = action[open+1 : len(action)-1]
+	}
+
+	switch name {
+	case "accept":
+		return func(entry string) bool {
+			ui.selectCurrent()
+			ui.app.Stop()
+			return true
+		}, nil
+
+	case "abort":
+		return func(entry string) bool {
+			ui.app.Stop()
+			return true
+		}, nil
+
+	case "exit":
+		code, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("exit requires a numeric exit-code, not '%s'", arg)
+		}
+		return func(entry string) bool {
+			ui.selectCurrent()
+			ui.exitCode = code
+			ui.app.Stop()
+			return true
+		}, nil
+
+	case "execute":
+		tmpl, err := ui.parseCommand(name, arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(entry string) bool {
+			ui.execute(tmpl, entry)
+			return true
+		}, nil
+
+	case "reload":
+		tmpl, err := ui.parseCommand(name, arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(entry string) bool {
+			ui.reload(tmpl, entry)
+			return true
+		}, nil
+
+	case "toggle":
+		return func(entry string) bool {
+			if ui.multi {
+				ui.toggle()
+			}
+			return true
+		}, nil
+
+	case "up", "down", "first", "last":
+		return func(entry string) bool {
+			current := ui.list.GetCurrentItem()
+			switch name {
+			case "up":
+				current = max(current-1, 0)
+			case "down":
+				current++
+			case "first":
+				current = 0
+			case "last":
+				current = ui.list.GetItemCount() - 1
+			}
+			ui.list.SetCurrentItem(current)
+			return true
+		}, nil
+
+	case "delete-line":
+		return func(entry string) bool {
+			ui.inputField.SetText("")
+			ui.filter("")
+			return true
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown action '%s'", action)
+}
+
+// parseCommand parses the command template given to the named action.
+func (ui *ChooseUI) parseCommand(name string, arg string) (*templatedcmd.Template, error) {
+
+	if arg == "" {
+		return nil, fmt.Errorf("%s requires a command", name)
+	}
+
+	tmpl, err := templatedcmd.Parse(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command for %s: %s", name, err)
+	}
+	if ui.Regexp != nil {
+		tmpl.SetRegexp(ui.Regexp)
+	}
+	return tmpl, nil
+}
+
+// ExitCode returns the exit-code chosen by an exit(N) action, or zero
+// if the user didn't choose one.
+func (ui *ChooseUI) ExitCode() int {
+	return ui.exitCode
+}
+
+// execute runs the given command template for the highlighted entry,
+// or the marked entries, suspending the UI while it runs so that it
+// may be interactive.
+func (ui *ChooseUI) execute(template *templatedcmd.Template, entry string) {
+
+	var run []string
+	if template.UsesAll() {
+		entries := []string{}
+		for _, idx := range ui.order {
+			entries = append(entries, ui.Choices[idx])
+		}
+		if len(entries) == 0 && entry != "" {
+			entries = append(entries, entry)
+		}
+		run = template.ExpandAll(entries, ui.Delimiter)
+	} else {
+		run = template.Expand(entry, ui.Delimiter)
+	}
+	if len(run) == 0 {
+		return
+	}
+
+	ui.app.Suspend(func() {
+
+		cmd := exec.Command(run[0], run[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		// Our STDIN might be a pipe, so connect the command
+		// to the terminal if we can.
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err == nil {
+			defer tty.Close()
+			cmd.Stdin = tty
+			cmd.Stdout = tty
+			cmd.Stderr = tty
+		}
+
+		_ = cmd.Run()
+	})
+}
+
+// reload replaces our choices with the output of the given command
+// template, which is run in the background.
+//
+// If the command fails our choices are left alone, and the failure is
+// shown in the status line.
+func (ui *ChooseUI) reload(template *templatedcmd.Template, entry string) {
+
+	run := template.Expand(entry, ui.Delimiter)
+	if len(run) == 0 {
+		return
+	}
+
+	go func() {
+		out, err := exec.Command(run[0], run[1:]...).Output()
+		if err != nil {
+
+			// Show the error the command reported, if any.
+			msg := err.Error()
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				if stderr := strings.TrimSpace(string(exitErr.Stderr)); stderr != "" {
+					msg = strings.Split(stderr, "\n")[0] + " (" + msg + ")"
+				}
+			}
+
+			ui.app.QueueUpdateDraw(func() {
+				ui.setStatus(fmt.Sprintf("reload failed: %s", msg))
+			})
+			return
+		}
+
+		var lines []string
+		if len(out) > 0 {
+			for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+				lines = append(lines, strings.TrimSpace(line))
+			}
+		}
+
+		ui.app.QueueUpdateDraw(func() {
+			ui.setStatus("")
+			ui.SetChoices(lines)
+		})
+	}()
+}
+
+// setStatus shows the given message in the status line, or hides the
+// status line if the message is empty.
+func (ui *ChooseUI) setStatus(msg string) {
+
+	height := 0
+	if msg != "" {
+		height = 1
+	}
+
+	ui.status.SetText(tview.Escape(msg))
+	ui.layout.ResizeItem(ui.status, height, 0)
+}
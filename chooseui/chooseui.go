@@ -2,10 +2,26 @@
 //
 // The user-interface is constructed with an array of strings,
 // and will allow the user to choose one of them.  The list may
-// be filtered, and the user can cancel if they wish.
+// be filtered, via a fuzzy-search, and the user can cancel if
+// they wish.
+//
+// Choose allows a single entry to be selected, and ChooseMultiple
+// allows the user to mark several.
+//
+// If a Preview function is set then a pane alongside the list will
+// show its output for the highlighted entry.
+//
+// The choices may be supplied up-front, via New, or received from
+// a channel while the UI is running, via NewStream.
+//
+// Only some fields of each choice may be displayed, and searched, via
+// WithNth, and the first HeaderLines may be shown as a header rather
+// than as choices.
 package chooseui
 
 import (
+	"context"
+	"regexp"
 	"sort"
 	"strings"
 
@@ -19,9 +35,66 @@ type ChooseUI struct {
 	// The items the user will choose from.
 	Choices []string
 
+	// Preview, if set, is used to populate the preview-pane.
+	Preview PreviewFunc
+
+	// Query is the initial filter.
+	Query string
+
+	// SelectOne causes Choose to return immediately, without
+	// showing the UI, if exactly one entry matches the Query.
+	SelectOne bool
+
+	// ExitZero causes Choose to return immediately, without showing
+	// the UI, if no entries match the Query.
+	ExitZero bool
+
+	// WithNth holds the numbers of the fields of each choice which
+	// are displayed and searched, numbered from one.  If empty the
+	// whole choice is used.
+	WithNth []int
+
+	// Delimiter is used to split choices into fields, as with
+	// templatedcmd.Fields, by default they are split on whitespace.
+	Delimiter string
+
+	// Display, if set, returns the text which is displayed, and
+	// searched, for each choice.  It takes precedence over WithNth.
+	Display func(entry string) string
+
+	// Prompt is shown before the filter, by default "Filter: ".  It
+	// is displayed literally.
+	Prompt string
+
+	// HeaderLines is the number of choices, from the start, which
+	// are shown as a header, rather than being available to choose.
+	//
+	// As New sorts the choices this is most useful with NewStream.
+	HeaderLines int
+
+	// Regexp, if set, is matched against the highlighted entry so
+	// that its named groups may be used as placeholders, such as
+	// "{name}", in the commands run by key bindings.  It must be set
+	// before those bindings are made, via BindSpec.
+	Regexp *regexp.Regexp
+
 	// The users' choice.
 	chosen string
 
+	// The users' choices, when multiple entries may be selected.
+	selected []string
+
+	// multi is true if the user may mark more than one entry.
+	multi bool
+
+	// marked records the entries the user has marked, by their
+	// index in Choices.
+	marked map[int]bool
+
+	// order holds the indexes of the marked entries, in the order
+	// in which they were marked.
+	order []int
+
 	// app is the global application
 	app *tview.Application
 
@@ -30,6 +103,63 @@ type ChooseUI struct {
 
 	// inputField contains the global text-input field.
 	inputField *tview.InputField
+
+	// items, if set, supplies further choices while the UI is running.
+	items <-chan string
+
+	// loading is true while we're still receiving choices from items.
+	loading bool
+
+	// query holds the current filter.
+	query string
+
+	// prepared is true once the header has been removed from
+	// Choices, and display populated.
+	prepared bool
+
+	// display holds the text displayed for each of the Choices.
+	display []string
+
+	// header holds the header lines.
+	header []string
+
+	// headerView displays the header lines.
+	headerView *tview.TextView
+
+	// layout contains all our widgets.
+	layout *tview.Flex
+
+	// matches holds the entries which are currently displayed in
+	// the list, in the same order.
+	matches []Match
+
+	// populating is true while the list is being rebuilt.
+	populating bool
+
+	// counter shows the number of matching, and total, entries.
+	counter *tview.TextView
+
+	// status shows a message, such as the failure of a reload.
+	status *tview.TextView
+
+	// preview is the pane showing the preview of the current entry.
+	preview *tview.TextView
+
+	// previewing is the entry shown in the preview-pane.
+	previewing string
+
+	// cancelPreview cancels the generation of the current preview.
+	cancelPreview context.CancelFunc
+
+	// bindings holds the actions bound to keys, via Bind.
+	bindings map[keySpec]Action
+
+	// exitCode is the exit-code chosen by an exit(N) action.
+	exitCode int
+
+	// replaced is true if SetChoices has been called, after which
+	// we ignore any choices received from items.
+	replaced bool
 }
 
 // New creates a new UI, allowing the user to select from the available options.
@@ -41,6 +171,8 @@ func New(choices []string) *ChooseUI {
 // SetupUI configures the UI.
 func (ui *ChooseUI) SetupUI() {
 
+	ui.prepare()
+
 	//
 	// Create the console-GUI application.
 	//
@@ -54,27 +186,52 @@ func (ui *ChooseUI) SetupUI() {
 	ui.list.SetWrapAround(false)
 
 	//
-	// Add all the choices to it.
+	// Create the preview-pane, and update it as the user moves
+	// around the list.
 	//
-	for _, entry := range ui.Choices {
-		ui.list.AddItem(entry, "", ' ', nil)
-	}
+	ui.preview = tview.NewTextView()
+	ui.preview.SetDynamicColors(true)
+	ui.preview.SetWrap(false)
+	ui.preview.SetBorder(true)
+	ui.list.SetChangedFunc(func(index int, _ string, _ string, _ rune) {
+		if !ui.populating {
+			ui.showPreview(index)
+		}
+	})
+
+	//
+	// Create the counter, showing how many entries match.
+	//
+	ui.counter = tview.NewTextView()
+	ui.counter.SetTextAlign(tview.AlignRight)
+
+	//
+	// Create the header
+	//
+	ui.headerView = tview.NewTextView()
+
+	//
+	// Create the status line, which is hidden until there's
+	// something to show.
+	//
+	ui.status = tview.NewTextView()
+	ui.status.SetTextColor(tcell.ColorRed)
+
+	//
+	// Add all the choices which match our initial filter.
+	//
+	ui.filter(ui.Query)
 
 	//
 	// Create a filter input-view
 	//
 	ui.inputField = tview.NewInputField().
-		SetLabel("Filter: ").
+		SetLabel(ui.prompt()).
+		SetText(ui.Query).
 		SetDoneFunc(func(key tcell.Key) {
 			if key == tcell.KeyEnter {
 
-				// get the selected index
-				selected := ui.list.GetCurrentItem()
-
-				// less than the entry count?
-				if ui.list.GetItemCount() > 0 {
-					ui.chosen, _ = ui.list.GetItemText(selected)
-				}
+				ui.selectCurrent()
 				ui.app.Stop()
 			}
 		})
@@ -84,43 +241,41 @@ func (ui *ChooseUI) SetupUI() {
 	// only matches present in the input-field
 	//
 	ui.inputField.SetAutocompleteFunc(func(currentText string) (entries []string) {
-		// Get text
-		input := strings.TrimSpace(currentText)
-
-		// empty? All items should be visible
-		if input == "" {
-			ui.list.Clear()
-			for _, entry := range ui.Choices {
-				ui.list.AddItem(entry, "", ' ', nil)
-			}
-			return
-		}
-
-		// Otherwise filter by input
-		input = strings.ToLower(input)
-		ui.list.Clear()
-		for _, entry := range ui.Choices {
-			if strings.Contains(strings.ToLower(entry), input) {
-				ui.list.AddItem(entry, "", ' ', nil)
-			}
-		}
-
+		ui.filter(currentText)
 		return
 	})
 
 	//
 	// Help text
 	//
-	help := tview.NewBox().SetBorder(true).SetTitle("TAB to switch focus, ENTER to select, ESC to cancel, arrows/etc to move")
+	title := "TAB to switch focus, ENTER to select, ESC to cancel, arrows/etc to move"
+	if ui.multi {
+		title = "TAB/SPACE to mark, ENTER to select, ESC to cancel, arrows/etc to move"
+	}
+	help := tview.NewBox().SetBorder(true).SetTitle(title)
 
 	//
 	// Create a layout grid, add the filter-box and the list.
 	//
 	grid := tview.NewFlex().SetFullScreen(true).SetDirection(tview.FlexRow)
-	grid.AddItem(ui.inputField, 1, 0, true)
-	grid.AddItem(ui.list, 0, 1, false)
+	ui.layout = grid
+	top := tview.NewFlex()
+	top.AddItem(ui.inputField, 0, 1, true)
+	top.AddItem(ui.counter, 30, 0, false)
+	grid.AddItem(top, 1, 0, true)
+	grid.AddItem(ui.headerView, 0, 0, false)
+	if ui.Preview != nil {
+		panes := tview.NewFlex()
+		panes.AddItem(ui.list, 0, 1, false)
+		panes.AddItem(ui.preview, 0, 1, false)
+		grid.AddItem(panes, 0, 1, false)
+	} else {
+		grid.AddItem(ui.list, 0, 1, false)
+	}
+	grid.AddItem(ui.status, 0, 0, false)
 	grid.AddItem(help, 2, 1, false)
 
+	ui.updateHeader()
 	ui.app.SetRoot(grid, true).SetFocus(grid).EnableMouse(true)
 
 }
@@ -133,10 +288,15 @@ func (ui *ChooseUI) SetupKeyBinding() {
 	//
 	ui.list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		if event.Key() == tcell.KeyEnter {
-			selected := ui.list.GetCurrentItem()
-			ui.chosen, _ = ui.list.GetItemText(selected)
+			ui.selectCurrent()
 			ui.app.Stop()
 		}
+
+		// Space marks an entry, rather than selecting it.
+		if ui.multi && event.Key() == tcell.KeyRune && event.Rune() == ' ' {
+			ui.toggle()
+			return nil
+		}
 		return event
 	})
 
@@ -146,6 +306,12 @@ func (ui *ChooseUI) SetupKeyBinding() {
 	// Arrows and HOME/END work as expected regardless of focus-state
 	//
 	ui.app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+
+		// Keys bound by our caller take precedence.
+		if ui.handleBinding(event) {
+			return nil
+		}
+
 		switch event.Key() {
 
 		// Home
@@ -176,6 +342,21 @@ func (ui *ChooseUI) SetupKeyBinding() {
 
 		// TAB
 		case tcell.KeyTab, tcell.KeyBacktab:
+
+			// In multi-select mode TAB marks the current
+			// entry, and moves to the next.
+			if ui.multi {
+				ui.toggle()
+				selected := ui.list.GetCurrentItem()
+				if event.Key() == tcell.KeyTab {
+					selected++
+				} else if selected > 0 {
+					selected--
+				}
+				ui.list.SetCurrentItem(selected)
+				return nil
+			}
+
 			if ui.list.HasFocus() {
 				ui.app.SetFocus(ui.inputField)
 			} else {
@@ -192,9 +373,168 @@ func (ui *ChooseUI) SetupKeyBinding() {
 
 }
 
+// prompt returns the prompt shown before the filter.
+func (ui *ChooseUI) prompt() string {
+	if ui.Prompt == "" {
+		return "Filter: "
+	}
+	return tview.Escape(ui.Prompt)
+}
+
+// SetPrompt changes the prompt shown before the filter, which may be
+// done while the UI is running.
+func (ui *ChooseUI) SetPrompt(prompt string) {
+	ui.Prompt = prompt
+	if ui.inputField != nil {
+		ui.inputField.SetLabel(ui.prompt())
+	}
+}
+
+// filter updates the list to show only those choices which match the
+// given query, with the best matches first.
+func (ui *ChooseUI) filter(query string) {
+
+	ui.query = query
+	ui.matches = Filter(query, ui.display)
+	ui.populate(0)
+}
+
+// populate replaces the contents of the list with our matches, and
+// highlights the entry at the given offset.
+func (ui *ChooseUI) populate(current int) {
+
+	ui.populating = true
+	ui.list.Clear()
+	for _, m := range ui.matches {
+		ui.list.AddItem(ui.itemText(m), "", ' ', nil)
+	}
+	ui.list.SetCurrentItem(current)
+	ui.populating = false
+
+	ui.updateCounter()
+	ui.showPreview(ui.list.GetCurrentItem())
+}
+
+// itemText returns the text to display in the list for the given match.
+func (ui *ChooseUI) itemText(m Match) string {
+
+	if !ui.multi {
+		return highlight(m)
+	}
+	if ui.marked[m.Index] {
+		return "[green::b]>[-::-] " + highlight(m)
+	}
+	return "  " + highlight(m)
+}
+
+// toggle marks, or unmarks, the currently-highlighted entry.
+func (ui *ChooseUI) toggle() {
+
+	current := ui.list.GetCurrentItem()
+	if current < 0 || current >= len(ui.matches) {
+		return
+	}
+
+	m := ui.matches[current]
+	if ui.marked[m.Index] {
+		delete(ui.marked, m.Index)
+		for i, idx := range ui.order {
+			if idx == m.Index {
+				ui.order = append(ui.order[:i], ui.order[i+1:]...)
+				break
+			}
+		}
+	} else {
+		ui.marked[m.Index] = true
+		ui.order = append(ui.order, m.Index)
+	}
+
+	ui.list.SetItemText(current, ui.itemText(m), "")
+}
+
+// selectCurrent records the currently-highlighted entry as the
+// user's choice.
+//
+// We can't use the text of the list-item, as that contains the
+// markup used to highlight the characters which matched.
+//
+// If the user has marked any entries then those are selected instead,
+// in the order they were marked.
+func (ui *ChooseUI) selectCurrent() {
+
+	if len(ui.order) > 0 {
+		for _, idx := range ui.order {
+			ui.selected = append(ui.selected, ui.Choices[idx])
+		}
+		ui.chosen = ui.selected[0]
+		return
+	}
+
+	selected := ui.list.GetCurrentItem()
+	if selected >= 0 && selected < len(ui.matches) {
+		ui.chosen = ui.Choices[ui.matches[selected].Index]
+		ui.selected = []string{ui.chosen}
+	}
+}
+
+// highlight returns the text of the given match, with the characters
+// which matched the query highlighted.
+//
+// The text is escaped, so that entries which look like tview's
+// color-tags are displayed literally.
+func highlight(m Match) string {
+
+	if len(m.Positions) == 0 {
+		return tview.Escape(m.Text)
+	}
+
+	var out strings.Builder
+	var plain []rune
+
+	flush := func() {
+		out.WriteString(tview.Escape(string(plain)))
+		plain = plain[:0]
+	}
+
+	next := 0
+	for i, r := range []rune(m.Text) {
+		if next < len(m.Positions) && m.Positions[next] == i {
+			flush()
+			out.WriteString("[yellow::b]")
+			out.WriteString(tview.Escape(string(r)))
+			out.WriteString("[-::-]")
+			next++
+			continue
+		}
+		plain = append(plain, r)
+	}
+	flush()
+
+	return out.String()
+}
+
 // Choose launches our user interface.
+//
+// If SelectOne or ExitZero are set then all the choices are received
+// first, and the UI is only shown if it is required.
 func (ui *ChooseUI) Choose() string {
 
+	ui.prepare()
+
+	if ui.SelectOne || ui.ExitZero {
+
+		matches := ui.Matching()
+
+		if len(matches) == 0 && ui.ExitZero {
+			return ""
+		}
+		if len(matches) == 1 && ui.SelectOne {
+			ui.chosen = matches[0]
+			ui.selected = matches
+			return ui.chosen
+		}
+	}
+
 	ui.SetupUI()
 
 	ui.SetupKeyBinding()
@@ -202,7 +542,14 @@ func (ui *ChooseUI) Choose() string {
 	//
 	// Launch the application.
 	//
+	done := make(chan struct{})
+	if ui.items != nil {
+		go ui.receive(done)
+	}
+
 	err := ui.app.Run()
+	close(done)
+	ui.stopPreview()
 	if err != nil {
 		panic(err)
 	}
@@ -212,3 +559,20 @@ func (ui *ChooseUI) Choose() string {
 	//
 	return ui.chosen
 }
+
+// ChooseMultiple launches our user interface, allowing the user to mark
+// several entries with TAB or SPACE.
+//
+// The marked entries are returned in the order in which they were
+// marked.  If nothing was marked the highlighted entry is returned, and
+// if the user cancelled the result is empty.
+func (ui *ChooseUI) ChooseMultiple() []string {
+
+	ui.multi = true
+	ui.marked = make(map[int]bool)
+	ui.order = nil
+
+	ui.Choose()
+
+	return ui.selected
+}
@@ -0,0 +1,79 @@
+// fields.go - Contains the code which allows only some fields of each
+// entry to be displayed, and searched, and which keeps header lines
+// separate from the entries.
+
+package chooseui
+
+import (
+	"strings"
+
+	"github.com/rivo/tview"
+	"github.com/skx/sysbox/templatedcmd"
+)
+
+// prepare splits any header lines from the choices, and works out
+// the text to display for each of them.
+//
+// It is safe to call this more than once.
+func (ui *ChooseUI) prepare() {
+
+	if ui.prepared {
+		return
+	}
+	ui.prepared = true
+
+	choices := ui.Choices
+	ui.Choices = nil
+	ui.display = nil
+	ui.append(choices)
+}
+
+// append adds the given entries, after using them to complete the
+// header, and returns the offset of the first one which was added
+// to the choices, along with the text displayed for those which were.
+func (ui *ChooseUI) append(entries []string) (int, []string) {
+
+	for len(entries) > 0 && len(ui.header) < ui.HeaderLines {
+		ui.header = append(ui.header, entries[0])
+		entries = entries[1:]
+	}
+
+	offset := len(ui.Choices)
+	ui.Choices = append(ui.Choices, entries...)
+
+	for _, entry := range entries {
+		ui.display = append(ui.display, ui.displayText(entry))
+	}
+	return offset, ui.display[offset:]
+}
+
+// displayText returns the text which is displayed, and searched, for
+// the given entry.
+func (ui *ChooseUI) displayText(entry string) string {
+
+	if ui.Display != nil {
+		return ui.Display(entry)
+	}
+	if len(ui.WithNth) == 0 {
+		return entry
+	}
+	return templatedcmd.Select(entry, ui.Delimiter, ui.WithNth)
+}
+
+// updateHeader shows the header lines above the list.
+func (ui *ChooseUI) updateHeader() {
+
+	// Line the header up with the text of the entries.
+	indent := "    "
+	if ui.multi {
+		indent += "  "
+	}
+
+	var lines []string
+	for _, entry := range ui.header {
+		lines = append(lines, indent+tview.Escape(ui.displayText(entry)))
+	}
+
+	ui.headerView.SetText(strings.Join(lines, "\n"))
+	ui.layout.ResizeItem(ui.headerView, len(lines), 0)
+}
@@ -0,0 +1,223 @@
+// keys.go - Contains the code which allows actions to be bound to keys,
+// and which allows the choices to be replaced while the UI is running.
+
+package chooseui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Action is invoked when a key which has been bound, via Bind, is pressed.
+//
+// It is given the highlighted entry, or an empty string if nothing
+// matches the filter, and returns true if it handled the key.  If it
+// returns false the key is handled as if it had not been bound.
+//
+// Actions are invoked by the UI, and so may call methods such as
+// SetChoices and Stop.
+type Action func(entry string) bool
+
+// keySpec identifies a key, along with any modifiers.
+type keySpec struct {
+
+	// key is the key which was pressed.
+	key tcell.Key
+
+	// r is the character which was typed, if key is tcell.KeyRune.
+	r rune
+
+	// alt is true if the alt-key must also be held down.
+	alt bool
+}
+
+// namedKeys maps the names of keys to their definitions.
+var namedKeys = map[string]tcell.Key{
+	"backspace": tcell.KeyBackspace2,
+	"bspace":    tcell.KeyBackspace2,
+	"btab":      tcell.KeyBacktab,
+	"del":       tcell.KeyDelete,
+	"delete":    tcell.KeyDelete,
+	"down":      tcell.KeyDown,
+	"end":       tcell.KeyEnd,
+	"enter":     tcell.KeyEnter,
+	"esc":       tcell.KeyEscape,
+	"escape":    tcell.KeyEscape,
+	"home":      tcell.KeyHome,
+	"ins":       tcell.KeyInsert,
+	"insert":    tcell.KeyInsert,
+	"left":      tcell.KeyLeft,
+	"pgdn":      tcell.KeyPgDn,
+	"pgup":      tcell.KeyPgUp,
+	"return":    tcell.KeyEnter,
+	"right":     tcell.KeyRight,
+	"tab":       tcell.KeyTab,
+	"up":        tcell.KeyUp,
+}
+
+// sameKeys holds the letters which, with ctrl, send the same code as
+// another key, and the name of that key.
+var sameKeys = map[byte]string{
+	'h': "backspace",
+	'i': "tab",
+	'm': "enter",
+}
+
+// parseKey parses the name of a key, such as "ctrl-e", "alt-x", "f1",
+// "enter", or a single character.
+func parseKey(name string) (keySpec, error) {
+
+	lower := strings.ToLower(name)
+
+	if key, ok := namedKeys[lower]; ok {
+		return keySpec{key: key}, nil
+	}
+
+	if lower == "space" {
+		return keySpec{key: tcell.KeyRune, r: ' '}, nil
+	}
+
+	if strings.HasPrefix(lower, "ctrl-") && len(lower) == len("ctrl-")+1 {
+		c := lower[len(lower)-1]
+
+		// Terminals send the same codes for these as for other
+		// keys, so they could never be told apart.
+		if same, ok := sameKeys[c]; ok {
+			return keySpec{}, fmt.Errorf("'%s' cannot be told apart from '%s', so use '%s' instead", name, same, same)
+		}
+		if c >= 'a' && c <= 'z' {
+			return keySpec{key: tcell.KeyCtrlA + tcell.Key(c-'a')}, nil
+		}
+	}
+
+	if strings.HasPrefix(lower, "alt-") {
+		r := []rune(name[len("alt-"):])
+		if len(r) == 1 {
+			return keySpec{key: tcell.KeyRune, r: r[0], alt: true}, nil
+		}
+	}
+
+	if strings.HasPrefix(lower, "f") {
+		num, err := strconv.Atoi(lower[1:])
+		if err == nil && num >= 1 && num <= 12 {
+			return keySpec{key: tcell.KeyF1 + tcell.Key(num-1)}, nil
+		}
+	}
+
+	if r := []rune(name); len(r) == 1 {
+		return keySpec{key: tcell.KeyRune, r: r[0]}, nil
+	}
+
+	return keySpec{}, fmt.Errorf("unknown key '%s'", name)
+}
+
+// specOf returns the keySpec which matches the given event.
+func specOf(event *tcell.EventKey) keySpec {
+
+	key := event.Key()
+
+	// Terminals differ in which code they send for backspace.
+	if key == tcell.KeyBackspace {
+		key = tcell.KeyBackspace2
+	}
+
+	if key != tcell.KeyRune {
+		return keySpec{key: key}
+	}
+	return keySpec{key: key, r: event.Rune(), alt: event.Modifiers()&tcell.ModAlt != 0}
+}
+
+// Bind arranges for the given action to be invoked when the named key
+// is pressed, replacing any action previously bound to it.
+//
+// Keys are named as "ctrl-e", "alt-x", "f1", "enter", "backspace", etc.
+func (ui *ChooseUI) Bind(name string, action Action) error {
+
+	spec, err := parseKey(name)
+	if err != nil {
+		return err
+	}
+
+	if ui.bindings == nil {
+		ui.bindings = make(map[keySpec]Action)
+	}
+	ui.bindings[spec] = action
+	return nil
+}
+
+// handleBinding invokes the action bound to the key of the given event,
+// if there is one, and returns true if the key was handled.
+func (ui *ChooseUI) handleBinding(event *tcell.EventKey) bool {
+
+	action, ok := ui.bindings[specOf(event)]
+	if !ok {
+		return false
+	}
+	return action(ui.Current())
+}
+
+// Current returns the highlighted entry, or an empty string if nothing
+// matches the filter.
+func (ui *ChooseUI) Current() string {
+
+	if ui.list == nil {
+		return ""
+	}
+
+	current := ui.list.GetCurrentItem()
+	if current < 0 || current >= len(ui.matches) {
+		return ""
+	}
+	return ui.Choices[ui.matches[current].Index]
+}
+
+// CurrentQuery returns the filter the user has entered.
+func (ui *ChooseUI) CurrentQuery() string {
+	return ui.query
+}
+
+// SetChoices replaces the choices, and clears the filter.
+//
+// Any further choices received from the channel given to NewStream
+// are ignored.
+//
+// If the UI is running this must only be called from an Action, or a
+// function passed to QueueUpdate.  Any entries which were marked are
+// forgotten, and the header lines are taken from the new choices.
+func (ui *ChooseUI) SetChoices(choices []string) {
+
+	ui.prepared = true
+	ui.replaced = true
+	ui.loading = false
+	ui.Choices = nil
+	ui.display = nil
+	ui.header = nil
+	ui.append(choices)
+
+	if ui.multi {
+		ui.marked = make(map[int]bool)
+		ui.order = nil
+	}
+
+	if ui.app == nil {
+		return
+	}
+
+	ui.updateHeader()
+	ui.inputField.SetText("")
+	ui.filter("")
+}
+
+// QueueUpdate invokes the given function from the UI, which allows
+// other goroutines to call methods such as SetChoices safely.
+func (ui *ChooseUI) QueueUpdate(fn func()) {
+	ui.app.QueueUpdateDraw(fn)
+}
+
+// Stop terminates the UI, as if the user had cancelled.
+func (ui *ChooseUI) Stop() {
+	ui.app.Stop()
+}
@@ -0,0 +1,184 @@
+package chooseui
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/skx/sysbox/templatedcmd"
+)
+
+// TestParseKey tests parsing the names of keys.
+func TestParseKey(t *testing.T) {
+
+	tests := []struct {
+		name string
+		spec keySpec
+	}{
+		{"enter", keySpec{key: tcell.KeyEnter}},
+		{"ctrl-e", keySpec{key: tcell.KeyCtrlE}},
+		{"CTRL-E", keySpec{key: tcell.KeyCtrlE}},
+		{"alt-x", keySpec{key: tcell.KeyRune, r: 'x', alt: true}},
+		{"f12", keySpec{key: tcell.KeyF12}},
+		{"space", keySpec{key: tcell.KeyRune, r: ' '}},
+		{"?", keySpec{key: tcell.KeyRune, r: '?'}},
+		{"backspace", keySpec{key: tcell.KeyBackspace2}},
+	}
+
+	for _, test := range tests {
+		spec, err := parseKey(test.name)
+		if err != nil {
+			t.Fatalf("unexpected error parsing '%s': %s", test.name, err)
+		}
+		if spec != test.spec {
+			t.Fatalf("wrong key for '%s': %v", test.name, spec)
+		}
+	}
+
+	for _, name := range []string{"", "ctrl-", "ctrl-1", "f13", "hyper-x", "alt-"} {
+		if _, err := parseKey(name); err == nil {
+			t.Fatalf("expected error parsing '%s'", name)
+		}
+	}
+
+	// These are the same as other keys, so can't be bound.
+	for _, name := range []string{"ctrl-h", "CTRL-I", "ctrl-m"} {
+		_, err := parseKey(name)
+		if err == nil || !strings.Contains(err.Error(), "cannot be told apart") {
+			t.Fatalf("expected error parsing '%s', got %v", name, err)
+		}
+	}
+}
+
+// TestMatchKey ensures events are matched against the keys they should be.
+func TestMatchKey(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		event *tcell.EventKey
+	}{
+		{"ctrl-e", tcell.NewEventKey(tcell.KeyCtrlE, 5, tcell.ModCtrl)},
+		{"backspace", tcell.NewEventKey(tcell.KeyBackspace, 0, tcell.ModNone)},
+		{"backspace", tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone)},
+		{"alt-x", tcell.NewEventKey(tcell.KeyRune, 'x', tcell.ModAlt)},
+		{"x", tcell.NewEventKey(tcell.KeyRune, 'x', tcell.ModNone)},
+	}
+
+	for _, test := range tests {
+		spec, err := parseKey(test.name)
+		if err != nil {
+			t.Fatalf("unexpected error parsing '%s': %s", test.name, err)
+		}
+		if specOf(test.event) != spec {
+			t.Fatalf("event %v didn't match '%s'", test.event.Name(), test.name)
+		}
+	}
+}
+
+// TestSetChoices ensures choices may be replaced.
+func TestSetChoices(t *testing.T) {
+
+	ui := New([]string{"one", "two"})
+	ui.Display = func(entry string) string {
+		return entry[len("dir/"):]
+	}
+	ui.SetChoices([]string{"dir/three", "dir/four"})
+
+	ui.Query = "^t"
+	out := ui.Matching()
+	if len(out) != 1 || out[0] != "dir/three" {
+		t.Fatalf("unexpected matches %v", out)
+	}
+
+	if err := ui.Bind("hyper-q", nil); err == nil {
+		t.Fatalf("expected error binding an unknown key")
+	}
+}
+
+// TestBindSpec tests parsing bindings.
+func TestBindSpec(t *testing.T) {
+
+	ui := New(nil)
+
+	for _, spec := range []string{"ctrl-e:execute(vim {})", "ctrl-r:reload(ls)", "f1:exit(3)", "::accept", "ctrl-d:delete-line"} {
+		if err := ui.BindSpec(spec); err != nil {
+			t.Fatalf("unexpected error binding '%s': %s", spec, err)
+		}
+	}
+
+	for _, spec := range []string{"ctrl-e", ":accept", "ctrl-e:", "ctrl-e:explode", "f1:exit(x)", "f1:execute()", "f1:execute(vim \"{})", "hyper-q:accept"} {
+		if err := ui.BindSpec(spec); err == nil {
+			t.Fatalf("expected error binding '%s'", spec)
+		}
+	}
+}
+
+// TestReload tests replacing the choices with the output of a command,
+// and that the choices are kept if the command fails.
+func TestReload(t *testing.T) {
+
+	ui := New([]string{"one", "two"})
+	ui.SetupUI()
+
+	screen := tcell.NewSimulationScreen("")
+	screen.SetSize(80, 24)
+	ui.app.SetScreen(screen)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := ui.app.Run(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	defer func() {
+		ui.app.Stop()
+		<-stopped
+	}()
+
+	//
+	// wait runs the given function in the UI until it returns
+	// true, or we give up.
+	//
+	wait := func(fn func() bool) bool {
+		for i := 0; i < 100; i++ {
+			result := make(chan bool, 1)
+			ui.app.QueueUpdate(func() { result <- fn() })
+			if <-result {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+
+	failing, err := templatedcmd.Parse(`sh -c 'echo "no such host" >&2; exit 3'`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ui.app.QueueUpdate(func() { ui.reload(failing, "") })
+
+	ok := wait(func() bool {
+		return strings.Contains(ui.status.GetText(true), "no such host")
+	})
+	if !ok {
+		t.Fatalf("failure wasn't shown, status is '%s'", ui.status.GetText(true))
+	}
+	if len(ui.Choices) != 2 {
+		t.Fatalf("choices were replaced: %v", ui.Choices)
+	}
+
+	working, err := templatedcmd.Parse(`printf 'three\nfour\nfive\n'`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ui.app.QueueUpdate(func() { ui.reload(working, "") })
+
+	ok = wait(func() bool {
+		return len(ui.Choices) == 3 && ui.status.GetText(true) == ""
+	})
+	if !ok {
+		t.Fatalf("choices weren't replaced: %v, status '%s'", ui.Choices, ui.status.GetText(true))
+	}
+}
@@ -0,0 +1,513 @@
+// match.go - Contains the fuzzy-matcher which is used to filter, and
+// rank, the entries the user may choose from.
+//
+// The query syntax is modelled upon that of fzf:
+//
+//	abc     Fuzzy-match; "a", "b", and "c" must appear in that order.
+//	'abc    Exact-match; "abc" must appear literally.
+//	^abc    Prefix-match; the entry must begin with "abc".
+//	abc$    Suffix-match; the entry must end with "abc".
+//	!abc    Negation; the entry must not contain "abc".
+//
+// A query may contain several space-separated terms, all of which must
+// match.  Matching is case-insensitive unless a term contains an upper
+// case character.
+
+package chooseui
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Scores awarded when matching, which favour matches that are found
+// at the start of words and which are not spread out.
+const (
+	scoreMatch        = 16
+	scoreGapStart     = -3
+	scoreGapExtension = -1
+
+	bonusBoundary    = scoreMatch / 2
+	bonusCamel       = bonusBoundary - 1
+	bonusConsecutive = -(scoreGapStart + scoreGapExtension)
+
+	// The bonus of the first character of a pattern is multiplied
+	// by this amount.
+	bonusFirstCharMultiplier = 2
+)
+
+// Match holds the result of matching a single entry against a query.
+type Match struct {
+
+	// Index is the offset of the entry in the list of choices.
+	Index int
+
+	// Text is the entry itself.
+	Text string
+
+	// Score records how good the match is, higher is better.
+	Score int
+
+	// Positions holds the offsets of the characters, in runes, which
+	// matched the query, in ascending order.
+	Positions []int
+}
+
+// termType describes the kind of a single term of a query.
+type termType int
+
+const (
+	fuzzyTerm termType = iota
+	exactTerm
+	prefixTerm
+	suffixTerm
+	equalTerm
+)
+
+// term is a single term of a query.
+type term struct {
+
+	// kind is the kind of the match.
+	kind termType
+
+	// text is the text to match, folded to lower-case if caseFold is set.
+	text []rune
+
+	// inverse is true if the term must not match.
+	inverse bool
+
+	// caseFold is true if the match is case-insensitive.
+	caseFold bool
+}
+
+// Query is a parsed search query.
+type Query struct {
+	terms []term
+}
+
+// ParseQuery parses the given string into a query.
+func ParseQuery(input string) *Query {
+
+	q := &Query{}
+
+	for _, word := range strings.Fields(input) {
+
+		t := term{kind: fuzzyTerm}
+		text := word
+
+		if strings.HasPrefix(text, "!") {
+			t.inverse = true
+			t.kind = exactTerm
+			text = text[1:]
+		}
+
+		if strings.HasPrefix(text, "'") {
+			t.kind = exactTerm
+			text = text[1:]
+		} else if strings.HasPrefix(text, "^") {
+			t.kind = prefixTerm
+			text = text[1:]
+		}
+
+		if len(text) > 1 && strings.HasSuffix(text, "$") {
+			if t.kind == prefixTerm {
+				t.kind = equalTerm
+			} else {
+				t.kind = suffixTerm
+			}
+			text = text[:len(text)-1]
+		}
+
+		// A term which consisted only of operators is
+		// matched literally.
+		if text == "" {
+			t = term{kind: fuzzyTerm}
+			text = word
+		}
+
+		t.caseFold = strings.ToLower(text) == text
+		t.text = []rune(text)
+		if t.caseFold {
+			t.text = fold(t.text)
+		}
+		q.terms = append(q.terms, t)
+	}
+	return q
+}
+
+// Empty returns true if the query has no terms, and so matches everything.
+func (q *Query) Empty() bool {
+	return len(q.terms) == 0
+}
+
+// Match tests the given text against the query.
+//
+// If the text matches the score, and the positions of the characters
+// which matched, are returned.
+func (q *Query) Match(text string) (int, []int, bool) {
+
+	runes := []rune(text)
+	var lower []rune
+
+	score := 0
+	var positions []int
+
+	for _, t := range q.terms {
+
+		input := runes
+		if t.caseFold {
+			if lower == nil {
+				lower = fold(runes)
+			}
+			input = lower
+		}
+
+		s, pos, ok := t.match(runes, input)
+		if ok == t.inverse {
+			return 0, nil, false
+		}
+		if !t.inverse {
+			score += s
+			positions = append(positions, pos...)
+		}
+	}
+
+	sort.Ints(positions)
+	positions = unique(positions)
+	return score, positions, true
+}
+
+// Filter returns the entries from the given choices which match the
+// query, ordered with the best matches first.
+//
+// Entries which match equally well are ordered by length, and then by
+// their original position.  If the query is empty every entry is
+// returned, in the original order.
+func Filter(query string, choices []string) []Match {
+	return ParseQuery(query).Filter(choices, 0)
+}
+
+// Filter returns the entries from the given choices which match the
+// query, ordered with the best matches first.
+//
+// The offset is added to the index of each entry, which allows
+// further choices to be matched, and then merged with the results
+// of earlier calls via Merge.
+func (q *Query) Filter(choices []string, offset int) []Match {
+
+	matches := make([]Match, 0, len(choices))
+	for i, entry := range choices {
+		if q.Empty() {
+			matches = append(matches, Match{Index: offset + i, Text: entry})
+			continue
+		}
+		score, positions, ok := q.Match(entry)
+		if ok {
+			matches = append(matches, Match{Index: offset + i, Text: entry, Score: score, Positions: positions})
+		}
+	}
+
+	if !q.Empty() {
+		sort.Slice(matches, func(i, j int) bool {
+			return better(matches[i], matches[j])
+		})
+	}
+	return matches
+}
+
+// Merge combines two sets of matches, each of which has been sorted by
+// Filter, into a single sorted set.
+//
+// If the query was empty then the matches are in their original order,
+// and should be appended instead.
+func Merge(a []Match, b []Match) []Match {
+
+	out := make([]Match, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if better(b[0], a[0]) {
+			out = append(out, b[0])
+			b = b[1:]
+		} else {
+			out = append(out, a[0])
+			a = a[1:]
+		}
+	}
+	out = append(out, a...)
+	return append(out, b...)
+}
+
+// better returns true if the first match should be ordered before
+// the second.
+func better(a Match, b Match) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if len(a.Text) != len(b.Text) {
+		return len(a.Text) < len(b.Text)
+	}
+	return a.Index < b.Index
+}
+
+// match tests a single term against the given text.
+//
+// The original text is used to calculate the bonuses for word
+// boundaries, and input is the text the term is compared against,
+// which might have been folded to lower-case.
+func (t term) match(text []rune, input []rune) (int, []int, bool) {
+
+	switch t.kind {
+	case fuzzyTerm:
+		return fuzzyMatch(text, input, t.text)
+
+	case exactTerm:
+		return exactMatch(text, input, t.text)
+
+	case prefixTerm:
+		start := leadingSpace(input)
+		if !hasPrefix(input[start:], t.text) {
+			return 0, nil, false
+		}
+		return scoreAt(text, start, len(t.text))
+
+	case suffixTerm:
+		end := len(input) - trailingSpace(input)
+		if end < len(t.text) || !hasPrefix(input[end-len(t.text):end], t.text) {
+			return 0, nil, false
+		}
+		return scoreAt(text, end-len(t.text), len(t.text))
+
+	case equalTerm:
+		start := leadingSpace(input)
+		end := len(input) - trailingSpace(input)
+		if start > end || string(input[start:end]) != string(t.text) {
+			return 0, nil, false
+		}
+		return scoreAt(text, start, len(t.text))
+	}
+	return 0, nil, false
+}
+
+// fuzzyMatch finds the pattern within the input, allowing characters to
+// be skipped between those which match.
+//
+// The first occurrence of the pattern is found by scanning forward, and
+// then the match is shortened as far as possible by scanning backward
+// from its end.
+func fuzzyMatch(text []rune, input []rune, pattern []rune) (int, []int, bool) {
+
+	if len(pattern) == 0 {
+		return 0, nil, true
+	}
+
+	// Scan forward to find the end of the first match.
+	end := -1
+	p := 0
+	for i, r := range input {
+		if r == pattern[p] {
+			p++
+			if p == len(pattern) {
+				end = i
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+
+	// Scan backward to find the latest start for that match.
+	start := end
+	p = len(pattern) - 1
+	for i := end; i >= 0; i-- {
+		if input[i] == pattern[p] {
+			p--
+			if p < 0 {
+				start = i
+				break
+			}
+		}
+	}
+
+	// Now the characters which match between the two.
+	positions := make([]int, 0, len(pattern))
+	p = 0
+	for i := start; i <= end && p < len(pattern); i++ {
+		if input[i] == pattern[p] {
+			positions = append(positions, i)
+			p++
+		}
+	}
+
+	return score(text, positions), positions, true
+}
+
+// exactMatch finds the best-scoring occurrence of the pattern within the
+// input.
+func exactMatch(text []rune, input []rune, pattern []rune) (int, []int, bool) {
+
+	if len(pattern) == 0 {
+		return 0, nil, true
+	}
+
+	best := -1
+	var bestScore int
+	for i := 0; i+len(pattern) <= len(input); i++ {
+		if !hasPrefix(input[i:], pattern) {
+			continue
+		}
+		s, _, _ := scoreAt(text, i, len(pattern))
+		if best < 0 || s > bestScore {
+			best = i
+			bestScore = s
+		}
+	}
+	if best < 0 {
+		return 0, nil, false
+	}
+	return scoreAt(text, best, len(pattern))
+}
+
+// scoreAt returns the score for a run of length characters, starting
+// at the given offset.
+func scoreAt(text []rune, start int, length int) (int, []int, bool) {
+
+	positions := make([]int, length)
+	for i := range positions {
+		positions[i] = start + i
+	}
+	return score(text, positions), positions, true
+}
+
+// score calculates the score for a match at the given positions.
+func score(text []rune, positions []int) int {
+
+	total := 0
+	prev := -1
+	chunk := 0
+
+	for n, i := range positions {
+
+		b := bonus(text, i)
+		if n == 0 {
+			b *= bonusFirstCharMultiplier
+		}
+
+		if n > 0 && i == prev+1 {
+			// Consecutive characters share the bonus of the
+			// start of their run.
+			b = max(b, chunk, bonusConsecutive)
+		} else {
+			if n > 0 {
+				total += scoreGapStart + scoreGapExtension*(i-prev-2)
+			}
+			chunk = b
+		}
+
+		total += scoreMatch + b
+		prev = i
+	}
+	return total
+}
+
+// charClass is used to find word boundaries.
+type charClass int
+
+const (
+	classOther charClass = iota
+	classDelimiter
+	classLower
+	classUpper
+	classDigit
+)
+
+// classOf returns the class of the given character.
+func classOf(r rune) charClass {
+	switch {
+	case unicode.IsLower(r):
+		return classLower
+	case unicode.IsUpper(r):
+		return classUpper
+	case unicode.IsDigit(r):
+		return classDigit
+	case unicode.IsSpace(r) || strings.ContainsRune("/,:;|_-.", r):
+		return classDelimiter
+	}
+	return classOther
+}
+
+// bonus returns the bonus for matching the character at the given offset.
+func bonus(text []rune, i int) int {
+
+	if i == 0 {
+		return bonusBoundary
+	}
+
+	prev := classOf(text[i-1])
+	cur := classOf(text[i])
+
+	switch {
+	case cur == classDelimiter:
+		return 0
+	case prev == classDelimiter:
+		return bonusBoundary
+	case prev == classLower && cur == classUpper:
+		return bonusCamel
+	case prev != classDigit && cur == classDigit:
+		return bonusCamel
+	}
+	return 0
+}
+
+// fold returns a lower-cased copy of the given text.
+func fold(text []rune) []rune {
+	out := make([]rune, len(text))
+	for i, r := range text {
+		out[i] = unicode.ToLower(r)
+	}
+	return out
+}
+
+// hasPrefix returns true if text begins with prefix.
+func hasPrefix(text []rune, prefix []rune) bool {
+	if len(prefix) > len(text) {
+		return false
+	}
+	for i, r := range prefix {
+		if text[i] != r {
+			return false
+		}
+	}
+	return true
+}
+
+// leadingSpace returns the number of whitespace characters at the
+// start of the text.
+func leadingSpace(text []rune) int {
+	n := 0
+	for n < len(text) && unicode.IsSpace(text[n]) {
+		n++
+	}
+	return n
+}
+
+// trailingSpace returns the number of whitespace characters at the
+// end of the text.
+func trailingSpace(text []rune) int {
+	n := 0
+	for n < len(text) && unicode.IsSpace(text[len(text)-1-n]) {
+		n++
+	}
+	return n
+}
+
+// unique removes duplicates from a sorted slice.
+func unique(values []int) []int {
+	out := values[:0]
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,202 @@
+package chooseui
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestMatch tests which entries match which queries.
+func TestMatch(t *testing.T) {
+
+	tests := []struct {
+		query string
+		text  string
+		match bool
+	}{
+		{"cmdwatch", "cmd_watch.go", true},
+		{"cmdwatch", "cmd_watch", true},
+		{"CMD", "cmd_watch.go", false},
+		{"CMD", "CMD_WATCH.GO", true},
+		{"gc", "cmd_watch.go", false},
+		{"'watch", "cmd_watch.go", true},
+		{"'wtch", "cmd_watch.go", false},
+		{"^cmd", "cmd_watch.go", true},
+		{"^watch", "cmd_watch.go", false},
+		{".go$", "cmd_watch.go", true},
+		{".go$", "cmd_watch.go.bak", false},
+		{"^cmd_watch.go$", "cmd_watch.go", true},
+		{"^cmd$", "cmd_watch.go", false},
+		{"!test", "cmd_watch.go", true},
+		{"!test", "cmd_watch_test.go", false},
+		{"!^cmd", "cmd_watch.go", false},
+		{"!.go$", "README.md", true},
+		{"cmd !test .go$", "cmd_watch.go", true},
+		{"cmd !test .go$", "cmd_watch_test.go", false},
+		{"!", "wow!", true},
+		{"^", "no caret", false},
+		{"", "anything", true},
+	}
+
+	for _, test := range tests {
+		_, _, ok := ParseQuery(test.query).Match(test.text)
+		if ok != test.match {
+			t.Fatalf("query '%s' against '%s' - expected %v, got %v", test.query, test.text, test.match, ok)
+		}
+	}
+}
+
+// TestPositions ensures we highlight the characters we expect.
+func TestPositions(t *testing.T) {
+
+	tests := []struct {
+		query     string
+		text      string
+		positions []int
+	}{
+		{"cmdw", "cmd_watch.go", []int{0, 1, 2, 4}},
+		{"go$", "cmd_watch.go", []int{10, 11}},
+		{"^cmd", "  cmd", []int{2, 3, 4}},
+		{"'ch", "cmd_watch.go", []int{7, 8}},
+		{"ab ba", "aba", []int{0, 1, 2}},
+
+		// The match is shortened, so we don't highlight the
+		// first "a".
+		{"ab", "a-xab", []int{3, 4}},
+	}
+
+	for _, test := range tests {
+		_, pos, ok := ParseQuery(test.query).Match(test.text)
+		if !ok {
+			t.Fatalf("query '%s' failed to match '%s'", test.query, test.text)
+		}
+		if !reflect.DeepEqual(pos, test.positions) {
+			t.Fatalf("query '%s' against '%s' - expected %v, got %v", test.query, test.text, test.positions, pos)
+		}
+	}
+}
+
+// TestRanking ensures the best matches are returned first.
+func TestRanking(t *testing.T) {
+
+	tests := []struct {
+		query   string
+		choices []string
+		order   []string
+	}{
+		// Word-boundaries beat scattered characters.
+		{"cw", []string{"accessword", "cmd_watch.go"}, []string{"cmd_watch.go", "accessword"}},
+
+		// Consecutive characters beat gaps.
+		{"wat", []string{"w_a_t", "cmd_watch.go"}, []string{"cmd_watch.go", "w_a_t"}},
+
+		// Shorter entries win ties.
+		{"foo", []string{"foo.go.bak", "foo.go"}, []string{"foo.go", "foo.go.bak"}},
+
+		// Empty queries keep the original order.
+		{"", []string{"b", "a"}, []string{"b", "a"}},
+	}
+
+	for _, test := range tests {
+		var order []string
+		for _, m := range Filter(test.query, test.choices) {
+			order = append(order, m.Text)
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Fatalf("query '%s' - expected %v, got %v", test.query, test.order, order)
+		}
+	}
+}
+
+// TestMerge ensures that merging matches from two sets of choices
+// gives the same result as matching them all at once.
+func TestMerge(t *testing.T) {
+
+	first := []string{"cmd_watch.go", "w_a_t", "accessword", "what"}
+	second := []string{"watch", "cmd_watch_test.go", "wat"}
+
+	q := ParseQuery("wat")
+	merged := Merge(q.Filter(first, 0), q.Filter(second, len(first)))
+	all := q.Filter(append(first, second...), 0)
+
+	if !reflect.DeepEqual(merged, all) {
+		t.Fatalf("merged results differ\n%v\n%v", merged, all)
+	}
+}
+
+// TestHighlight ensures the markup we generate is correct.
+func TestHighlight(t *testing.T) {
+
+	tests := []struct {
+		match Match
+		out   string
+	}{
+		{Match{Text: "[red]"}, "[red[]"},
+		{Match{Text: "abc", Positions: []int{1}}, "a[yellow::b]b[-::-]c"},
+	}
+
+	for _, test := range tests {
+		out := highlight(test.match)
+		if out != test.out {
+			t.Fatalf("expected '%s', got '%s'", test.out, out)
+		}
+	}
+}
+
+// TestMatching tests filtering streamed choices without the UI.
+func TestMatching(t *testing.T) {
+
+	items := make(chan string)
+	go func() {
+		for _, item := range []string{"README.md", "cmd_watch.go", "cmd_tree.go"} {
+			items <- item
+		}
+		close(items)
+	}()
+
+	ui := NewStream(items)
+	ui.Query = "cmd .go$"
+
+	out := ui.Matching()
+	if !reflect.DeepEqual(out, []string{"cmd_tree.go", "cmd_watch.go"}) {
+		t.Fatalf("unexpected matches %v", out)
+	}
+}
+
+// TestChooseWithoutUI tests the cases where Choose returns without
+// showing the UI.
+func TestChooseWithoutUI(t *testing.T) {
+
+	ui := New([]string{"one", "two", "three"})
+	ui.Query = "^tw"
+	ui.SelectOne = true
+	if out := ui.Choose(); out != "two" {
+		t.Fatalf("expected a single match, got '%s'", out)
+	}
+
+	ui = New([]string{"one", "two", "three"})
+	ui.Query = "four"
+	ui.ExitZero = true
+	if out := ui.ChooseMultiple(); len(out) != 0 {
+		t.Fatalf("expected no matches, got %v", out)
+	}
+}
+
+// TestFields tests displaying only some fields of each choice, and
+// header lines.
+func TestFields(t *testing.T) {
+
+	ui := &ChooseUI{Choices: []string{"PID TTY CMD", "1 ? init", "42 pts/0 bash", "43 pts/0 ps"}}
+	ui.HeaderLines = 1
+	ui.WithNth = []int{3}
+
+	// Matching is only upon the third field.
+	ui.Query = "p"
+	out := ui.Matching()
+	if !reflect.DeepEqual(out, []string{"43 pts/0 ps"}) {
+		t.Fatalf("unexpected matches %v", out)
+	}
+
+	if !reflect.DeepEqual(ui.header, []string{"PID TTY CMD"}) {
+		t.Fatalf("unexpected header %v", ui.header)
+	}
+}
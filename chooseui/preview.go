@@ -0,0 +1,144 @@
+// preview.go - Contains the code for the optional preview-pane, which
+// shows information about the highlighted entry.
+
+package chooseui
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/rivo/tview"
+	"github.com/skx/sysbox/templatedcmd"
+)
+
+// maxPreview is the maximum number of bytes of output we'll display
+// in the preview-pane.
+const maxPreview = 64 * 1024
+
+// PreviewFunc returns the text to show in the preview-pane for the
+// given entry.
+//
+// The function is invoked in a goroutine of its own, and the context
+// is cancelled if the user moves to a different entry before it
+// returns, in which case the result is ignored.
+type PreviewFunc func(ctx context.Context, entry string) string
+
+// CommandPreview returns a PreviewFunc which runs the given command
+// template, as expanded by templatedcmd.Expand, and returns its output.
+//
+// Fields, such as "{2}", are split upon the given string, or upon
+// whitespace if it is empty.  This will usually be the Delimiter.
+//
+// An error is returned if the template is malformed.
+func CommandPreview(template string, split string) (PreviewFunc, error) {
+
+	tmpl, err := templatedcmd.Parse(template)
+	if err != nil {
+		return nil, err
+	}
+	return TemplatePreview(tmpl, split), nil
+}
+
+// TemplatePreview returns a PreviewFunc which runs the given command
+// template, which has already been parsed, and returns its output.
+//
+// Fields are split upon the given string, as with CommandPreview.
+func TemplatePreview(tmpl *templatedcmd.Template, split string) PreviewFunc {
+
+	return func(ctx context.Context, entry string) string {
+
+		run := tmpl.Expand(entry, split)
+		if len(run) == 0 {
+			return ""
+		}
+
+		out := &limitedBuffer{max: maxPreview}
+		cmd := exec.CommandContext(ctx, run[0], run[1:]...)
+		cmd.Stdout = out
+		cmd.Stderr = out
+
+		runErr := cmd.Run()
+		if runErr != nil && ctx.Err() == nil {
+			out.WriteString("\n" + runErr.Error())
+		}
+		return string(out.data)
+	}
+}
+
+// limitedBuffer is an io.Writer which discards anything beyond
+// the first max bytes written to it.
+type limitedBuffer struct {
+	data []byte
+	max  int
+}
+
+// Write implements io.Writer, pretending that everything was written
+// so that the command isn't interrupted by a short write.
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.max - len(l.data); room > 0 {
+		l.data = append(l.data, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// WriteString appends the given string.
+func (l *limitedBuffer) WriteString(s string) {
+	_, _ = l.Write([]byte(s))
+}
+
+// showPreview updates the preview-pane for the entry at the given
+// offset in the list, cancelling any preview which is still being
+// generated.
+func (ui *ChooseUI) showPreview(current int) {
+
+	if ui.Preview == nil {
+		return
+	}
+
+	entry := ""
+	if current >= 0 && current < len(ui.matches) {
+		entry = ui.Choices[ui.matches[current].Index]
+	}
+
+	// Still showing this entry?  Then we're done.
+	if ui.cancelPreview != nil && entry == ui.previewing {
+		return
+	}
+
+	ui.stopPreview()
+	ui.previewing = entry
+	ui.preview.SetTitle(tview.Escape(entry))
+	ui.preview.Clear()
+	ui.preview.ScrollToBeginning()
+
+	if entry == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ui.cancelPreview = cancel
+
+	go func() {
+		text := ui.Preview(ctx, entry)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Preserve any colours the command produced.
+		text = tview.TranslateANSI(tview.Escape(text))
+
+		ui.app.QueueUpdateDraw(func() {
+			if ctx.Err() == nil {
+				ui.preview.SetText(text)
+			}
+		})
+	}()
+}
+
+// stopPreview cancels the generation of any preview which is in progress.
+func (ui *ChooseUI) stopPreview() {
+	if ui.cancelPreview != nil {
+		ui.cancelPreview()
+		ui.cancelPreview = nil
+	}
+}
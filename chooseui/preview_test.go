@@ -0,0 +1,63 @@
+package chooseui
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestCommandPreview tests running a command to generate a preview.
+func TestCommandPreview(t *testing.T) {
+
+	preview, err := CommandPreview("echo 'preview of' {}", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out := preview(context.Background(), "file.txt")
+	if out != "preview of file.txt\n" {
+		t.Fatalf("unexpected preview '%s'", out)
+	}
+
+	// Fields are split upon the given string.
+	preview, err = CommandPreview("echo {2} {-1}", ":")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out = preview(context.Background(), "root:x 0:0")
+	if out != "x 0 0\n" {
+		t.Fatalf("unexpected preview '%s'", out)
+	}
+
+	// Cancelled previews return nothing useful, and no error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	preview, err = CommandPreview("sleep 10", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out = preview(ctx, "")
+	if strings.Contains(out, "killed") {
+		t.Fatalf("unexpected error for cancelled preview '%s'", out)
+	}
+
+	// Malformed templates are rejected.
+	_, err = CommandPreview("echo 'preview of {}", "")
+	if err == nil {
+		t.Fatalf("expected an error for a malformed template")
+	}
+}
+
+// TestLimitedBuffer ensures large output is truncated.
+func TestLimitedBuffer(t *testing.T) {
+
+	buf := &limitedBuffer{max: 5}
+	buf.WriteString("abc")
+	n, err := buf.Write([]byte("defgh"))
+	if n != 5 || err != nil {
+		t.Fatalf("short write %d %v", n, err)
+	}
+	if string(buf.data) != "abcde" {
+		t.Fatalf("unexpected content '%s'", buf.data)
+	}
+}
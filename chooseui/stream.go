@@ -0,0 +1,184 @@
+// stream.go - Contains the code which allows choices to be added while
+// the UI is running.
+
+package chooseui
+
+import (
+	"fmt"
+	"time"
+)
+
+// streamInterval is how often we add the choices we've received to
+// the list, to avoid redrawing the screen for every single one.
+const streamInterval = 50 * time.Millisecond
+
+// NewStream creates a new UI, allowing the user to select from the
+// choices received from the given channel.
+//
+// The UI is displayed immediately, and choices are added to it as they
+// arrive, in the order they are received, until the channel is closed.
+func NewStream(items <-chan string) *ChooseUI {
+	return &ChooseUI{items: items, loading: true}
+}
+
+// receive reads choices from our channel, and adds them to the UI
+// in batches, until the channel is closed or the UI terminates, which
+// is signalled by closing done.
+func (ui *ChooseUI) receive(done <-chan struct{}) {
+
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+
+	var batch []string
+
+	//
+	// flush adds the current batch to the UI, and waits until it
+	// has been, returning false if the UI terminates first.
+	//
+	// QueueUpdateDraw doesn't return until the update has been
+	// applied, which never happens once the UI has stopped, so we
+	// queue it in the background and stop waiting when we're done.
+	// As we wait there is only ever one update outstanding.
+	//
+	flush := func(finished bool) bool {
+		pending := batch
+		batch = nil
+
+		select {
+		case <-done:
+			return false
+		default:
+		}
+
+		applied := make(chan struct{})
+		go func() {
+			defer close(applied)
+			ui.app.QueueUpdateDraw(func() {
+				if ui.replaced {
+					return
+				}
+				ui.add(pending)
+				if finished {
+					ui.loading = false
+					ui.updateCounter()
+				}
+			})
+		}()
+
+		select {
+		case <-applied:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	for {
+		select {
+		case item, ok := <-ui.items:
+			if !ok {
+				flush(true)
+				return
+			}
+			batch = append(batch, item)
+
+		case <-ticker.C:
+			if len(batch) > 0 && !flush(false) {
+				return
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// Matching returns the choices which match the Query, best first,
+// without showing the UI.
+//
+// If the choices are being received from a channel this waits until
+// it has been closed.
+func (ui *ChooseUI) Matching() []string {
+
+	ui.prepare()
+
+	if ui.items != nil {
+		for item := range ui.items {
+			ui.append([]string{item})
+		}
+		ui.items = nil
+		ui.loading = false
+	}
+
+	var out []string
+	for _, m := range Filter(ui.Query, ui.display) {
+		out = append(out, ui.Choices[m.Index])
+	}
+	return out
+}
+
+// add appends the given choices, and updates the list if they match
+// the current filter.
+//
+// The highlighted entry remains highlighted, even if better matches
+// are added above it.
+func (ui *ChooseUI) add(choices []string) {
+
+	if len(choices) == 0 {
+		return
+	}
+
+	if len(ui.header) < ui.HeaderLines {
+		defer ui.updateHeader()
+	}
+
+	offset, display := ui.append(choices)
+	if len(display) == 0 {
+		return
+	}
+
+	q := ParseQuery(ui.query)
+	matches := q.Filter(display, offset)
+
+	//
+	// If there is no filter the new choices are simply appended.
+	//
+	if q.Empty() {
+		ui.matches = append(ui.matches, matches...)
+		for _, m := range matches {
+			ui.list.AddItem(ui.itemText(m), "", ' ', nil)
+		}
+		ui.updateCounter()
+		return
+	}
+
+	//
+	// Otherwise they're merged with the existing matches, and
+	// we rebuild the list.
+	//
+	current := -1
+	if idx := ui.list.GetCurrentItem(); idx < len(ui.matches) {
+		current = ui.matches[idx].Index
+	}
+
+	ui.matches = Merge(ui.matches, matches)
+
+	selected := 0
+	for i, m := range ui.matches {
+		if m.Index == current {
+			selected = i
+			break
+		}
+	}
+	ui.populate(selected)
+}
+
+// updateCounter shows the number of matching entries, and the total.
+func (ui *ChooseUI) updateCounter() {
+
+	text := fmt.Sprintf("%d/%d items", len(ui.matches), len(ui.Choices))
+	if ui.loading {
+		text = "loading " + text
+	}
+	ui.counter.SetText(text)
+}
@@ -0,0 +1,46 @@
+package chooseui
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rivo/tview"
+)
+
+// TestReceiveStops ensures that we stop receiving choices once the UI
+// has terminated, even though updates can no longer be applied.
+func TestReceiveStops(t *testing.T) {
+
+	items := make(chan string)
+	ui := NewStream(items)
+
+	// The application is never run, so updates are never applied.
+	ui.app = tview.NewApplication()
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		ui.receive(done)
+		close(finished)
+	}()
+
+	// Keep sending choices, as a slow producer would.
+	go func() {
+		for {
+			select {
+			case items <- "choice":
+			case <-finished:
+				return
+			}
+		}
+	}()
+
+	time.Sleep(4 * streamInterval)
+	close(done)
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatalf("receive didn't stop once the UI terminated")
+	}
+}
@@ -1,20 +1,70 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/peterh/liner"
-	"github.com/skx/subcommands"
 	"github.com/skx/sysbox/calc"
+	"github.com/skx/sysbox/templatedcmd"
 )
 
 // Structure for our options and state.
 type calcCommand struct {
 
-	// We embed the NoFlags option, because we accept no command-line flags.
-	subcommands.NoFlags
+	// precision holds the number of decimal digits of precision to
+	// use, if arbitrary-precision is enabled.
+	precision int
+
+	// exact is true if we should use exact rational arithmetic.
+	exact bool
+
+	// base is the base in which integer results are displayed.
+	base int
+
+	// init holds the path to a file which is evaluated before any
+	// input, if set.
+	init string
+
+	// each holds an expression to evaluate against each line of STDIN.
+	each string
+
+	// end holds an expression to evaluate once STDIN is exhausted.
+	end string
+
+	// split holds the string to split lines of STDIN upon, if it
+	// is not whitespace.
+	split string
+
+	// file holds the path to a script to execute, if set.
+	file string
+
+	// test is true if our exit-code should reflect the final result.
+	test bool
+}
+
+// Arguments adds per-command args to the object.
+func (c *calcCommand) Arguments(f *flag.FlagSet) {
+	f.IntVar(&c.precision, "precision", 0, "Use arbitrary-precision arithmetic, with this many decimal digits.")
+	f.BoolVar(&c.exact, "exact", false, "Use exact rational arithmetic.")
+	f.IntVar(&c.base, "base", 10, "The base in which to show integer results; 2, 8, 10, or 16.")
+	f.StringVar(&c.init, "init", "", "Evaluate the contents of this file before any input.")
+	f.StringVar(&c.each, "each", "", "Evaluate this expression for each line of STDIN.")
+	f.StringVar(&c.end, "end", "", "Evaluate this expression after processing STDIN with -each.")
+	f.StringVar(&c.split, "split", "", "Split lines of STDIN on this string, rather than whitespace.")
+	f.StringVar(&c.file, "f", "", "Execute the statements in the given file.")
+	f.BoolVar(&c.test, "test", false, "Exit with a status reflecting whether the final result is true, rather than showing it.")
 }
 
 // Info returns the name of this subcommand.
@@ -36,6 +86,125 @@ Note here we can join arguments, or accept a quoted string.  The arguments
 must be quoted if you use '*' because otherwise the shell's globbing would
 cause surprises.
 
+Operators:
+
+The usual '+', '-', '*', and '/' operators are supported, along with '%'
+for modulus and '^' (or '**') for exponentiation.  Exponentiation is
+right-associative, and binds more tightly than unary minus:
+
+   $ sysbox calc '2 ^ 3 ^ 2'
+   512
+   $ sysbox calc '2 * -(2 + 3)'
+   -10
+
+Comparisons:
+
+The comparison operators '<', '<=', '==', '!=', '>=', and '>' produce 1 if
+they are true, and 0 if not, and may be combined via 'and', 'or', and 'not'.
+Any non-zero value is considered to be true.  Conditional expressions may be
+written as 'if a then b else c', or 'a ? b : c':
+
+   $ sysbox calc 'x = 7; if x > 5 and x < 10 then x * 2 else 0'
+   14
+   calc> fn fact(n) = n <= 1 ? 1 : n * fact(n - 1)
+
+Precision:
+
+By default calculations are carried out with float64 values, which means
+that results such as '0.1 + 0.2' are not exact.  You may choose to use
+arbitrary-precision values via '-precision N', where N is the number of
+decimal digits to use, or exact rational arithmetic via '-exact':
+
+   $ sysbox calc -exact '0.1 + 0.2'
+   0.3
+   $ sysbox calc -exact '1 / 3'
+   1/3
+   $ sysbox calc -precision 50 '1 / 3'
+   0.33333333333333333333333333333333333333333333333333
+   $ sysbox calc -exact '2 ^ 100'
+   1267650600228229401496703205376
+
+Integer results are always shown in full, regardless of their magnitude,
+and with '-exact' results which can't be written exactly as a decimal are
+shown as a fraction.
+Note that most functions, with the exception of sqrt in '-precision' mode,
+are computed with float64 precision, and so are raising a number to a power
+which isn't an integer.  Such results are shown with float64 precision, or
+are an error with '-exact' unless they're exact integers, such as sqrt(16).
+
+Programmer Mode:
+
+Integers may be written in hex (0xff), octal (0o755), or binary (0b1010),
+and the bitwise operators '&', '|', 'xor', '~', '<<', and '>>' may be used
+upon integer values.  Because '^' is used for exponentiation exclusive-or is
+spelled 'xor', rather than '^' as in C, so '0xf0 ^ 2' is 0xe100 and not 0xf2.
+Using a non-integer with a bitwise operator is an error.
+
+Integer results may be displayed in a different base via '-base', or via
+the REPL commands ':bin', ':oct', ':dec', and ':hex':
+
+   $ sysbox calc -base=16 '0o755 & ~0o022'
+   0x1ed
+   calc> :bin
+   calc> 0xf0 | 0x0f
+   0b11111111
+
+Note that float64 values can only hold integers up to 2^53 exactly, so
+'-exact' should be used if you're working with larger values.
+
+Units:
+
+Numbers may have a unit of data or time attached, as a suffix, and
+arithmetic upon them is checked for consistency.  Use 'to' or 'in' to
+convert a result into a different unit:
+
+   $ sysbox calc '1GiB + 512MiB'
+   1.5 GiB
+   $ sysbox calc '(12GiB / 80MB/s) to minutes'
+   2.684355 minutes
+   $ sysbox calc '100Mbps * 30s in MB'
+   375 MB
+
+Data may be measured in bytes (B) or bits (bit, or b with a prefix),
+with SI prefixes (kB, MB, GB, ..) or binary prefixes (KiB, MiB, GiB, ..).
+Time may be measured in ns, us, ms, s, min, h, d, or w, and rates may
+be written as 'MB/s' or 'Mbps'.
+
+Scripts:
+
+A file of statements may be executed via '-f', in which case everything
+following a '#' on a line is a comment.  The result of the last statement
+is shown, unless '-test' is given, in which case nothing is shown and the
+exit-code is 0 if the result was true, 1 if it was false, or 2 on error:
+
+   $ cat disk.calc
+   # Warn if the disk is more than 85% full.
+   used = 450GiB
+   size = 500GiB
+   used / size * 100 > 85
+   $ sysbox calc -test -f disk.calc && echo "Disk is nearly full"
+
+'-test' may also be used with an expression given upon the command-line,
+or with '-each' and '-end'.
+
+Processing Input:
+
+The '-each' flag causes an expression to be evaluated for each line of
+STDIN, with the fields of the line available as the variables 'f1', 'f2',
+and so on.  Lines are split on whitespace unless '-split' is used, in the
+same way as the '{N}' fields of 'exec-stdin'.  Fields which are not
+numbers are left undefined.
+
+The result of each line is shown, and the variables 'sum', 'count', 'min',
+'max', and 'mean' are updated, so they may be used in an expression given
+via '-end'.  If there are no lines they are all zero:
+
+   $ printf '1 512\n2 0\n' | sysbox calc -each 'f1 * 1024 + f2' -end sum
+   1536
+   2048
+   3584
+   $ cut -d: -f3 /etc/passwd | sysbox calc -split=: -each f1 -end 'max'
+
 Repl:
 
 If you execute this command with no arguments you'll be dropped into a REPL
@@ -65,42 +234,480 @@ The result of the previous calculation is always stored in the variable 'result'
    0.3333
    calc> result * 3
    1
+
+Your command-history is saved to $XDG_STATE_HOME/sysbox/calc_history,
+(defaulting to ~/.local/state/sysbox/calc_history), and your variables and
+functions may be saved to, and restored from, a file:
+
+   calc> :save ~/constants.calc
+   calc> :load ~/constants.calc
+
+A saved file may be loaded at startup via '-init', which works for both
+the REPL and non-interactive use:
+
+   $ sysbox calc -init ~/constants.calc 'rate * 60s'
+
+Functions:
+
+A number of mathematical functions are available, including abs, ceil,
+floor, round, sqrt, cbrt, exp, log (natural), log2, log10, pow, hypot,
+min, max, and the usual trigonometric functions:
+
+   calc> sqrt(2) * max(1, 2, 3)
+   4.242641
+
+You may define your own functions, which persist for the rest of the
+session, and TAB will complete the names of all available functions:
+
+   calc> fn hyp(a, b) = sqrt(a*a + b*b)
+   fn hyp(a, b) = sqrt(((a * a) + (b * b)))
+   calc> hyp(3, 4)
+   5
 `
 }
 
+// evaluate evaluates the given input.
+//
+// The evaluation may be interrupted via Ctrl-C, which is useful if
+// the user has accidentally entered something which takes forever.
+func (c *calcCommand) evaluate(cal *calc.Evaluator, input string) (interface{}, error) {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return cal.EvalValue(ctx, input)
+}
+
 // Show the result of a calculation
-func (c *calcCommand) showResult(out *calc.Token) error {
+func (c *calcCommand) showResult(value interface{}) error {
 
-	if out == nil {
+	switch result := value.(type) {
+	case nil:
 		return fmt.Errorf("nil result")
+	case string:
+		// The signature of a function which was defined.
+		fmt.Printf("%s\n", result)
+	default:
+		fmt.Printf("%s\n", c.formatNumber(result))
+	}
+	return nil
+}
+
+// result shows the final result of a calculation, or the error which
+// prevented it, and returns our exit-code.
+//
+// If -test was given the result isn't shown, instead we return zero if
+// it was true and one if it was false.
+func (c *calcCommand) result(name string, input string, val interface{}, err error) int {
+
+	if err == nil && c.test {
+		if val == nil {
+			err = fmt.Errorf("nil result")
+		} else if calc.IsTrue(val) {
+			return 0
+		} else {
+			return 1
+		}
+	}
+
+	if err == nil {
+		err = c.showResult(val)
+	}
+	if err != nil {
+		showError(name, input, err)
+		return c.failure()
+	}
+	return 0
+}
+
+// failure returns the exit-code we use when something went wrong, which
+// is distinct from a false result if -test was given.
+func (c *calcCommand) failure() int {
+	if c.test {
+		return 2
+	}
+	return 1
+}
+
+// showError reports the given error.
+//
+// If the error records a position within the given input we show the
+// line containing the problem, with a caret beneath it, prefixed by
+// the name of the input if we have one.
+func showError(name string, input string, err error) {
+
+	cerr, ok := err.(*calc.Error)
+	if !ok || cerr.Line < 1 {
+		fmt.Printf("error: %s\n", err)
+		return
+	}
+
+	if name != "" {
+		fmt.Printf("error: %s:%d:%d: %s\n", name, cerr.Line, cerr.Column, err)
+	} else {
+		fmt.Printf("error: %s\n", err)
+	}
+
+	lines := strings.Split(input, "\n")
+	if cerr.Line > len(lines) {
+		return
+	}
+	line := []rune(strings.TrimRight(lines[cerr.Line-1], "\r"))
+
+	//
+	// Pad the caret to the column of the problem, copying any
+	// TABs so that it lines up.
+	//
+	pad := ""
+	for i := 0; i < cerr.Column-1; i++ {
+		if i < len(line) && line[i] == '\t' {
+			pad += "\t"
+		} else {
+			pad += " "
+		}
+	}
+
+	fmt.Printf("  %s\n  %s^\n", string(line), pad)
+}
+
+// bits returns the number of bits of precision we use for the number of
+// decimal digits the user requested, which includes some spare.
+func (c *calcCommand) bits() uint {
+	return uint(math.Ceil(float64(c.precision)*math.Log2(10))) + 16
+}
+
+// formatNumber converts the given value into a string.
+//
+// Integers are always shown in full, regardless of their magnitude, and
+// in the output base the user selected.
+func (c *calcCommand) formatNumber(value interface{}) string {
+
+	switch result := value.(type) {
+	case *calc.Quantity:
+		return c.formatNumber(result.Value) + " " + result.Unit.Name
+
+	case *big.Float:
+		//
+		// Values which were calculated via float64, and have
+		// less precision than we asked for, are shown with the
+		// digits a float64 has.
+		//
+		if result.Prec() < c.bits() {
+			f, _ := result.Float64()
+			if math.IsInf(f, 0) || math.Trunc(f) != f {
+				return strconv.FormatFloat(f, 'g', -1, 64)
+			}
+			return c.formatNumber(f)
+		}
+
+		if result.IsInt() {
+			i, _ := result.Int(nil)
+			return c.formatInteger(i)
+		}
+		return result.Text('g', c.precision)
+
+	case *big.Rat:
+		if result.IsInt() {
+			return c.formatInteger(result.Num())
+		}
+
+		//
+		// Show the value as a decimal if it can be written
+		// as one exactly, otherwise show the fraction rather
+		// than rounding it.
+		//
+		if digits, ok := decimalPlaces(result.Denom()); ok {
+			return result.FloatString(digits)
+		}
+		return result.RatString()
+
+	case float64:
+		//
+		// Show the result as an int, if possible.
+		//
+		if !math.IsInf(result, 0) && math.Trunc(result) == result {
+			i, _ := big.NewFloat(result).Int(nil)
+			return c.formatInteger(i)
+		}
+
+		//
+		// Values too small to show with six decimal places are
+		// shown in full, rather than as zero.
+		//
+		out := trimZeros(fmt.Sprintf("%f", result))
+		if out == "0" || out == "-0" {
+			return strconv.FormatFloat(result, 'g', -1, 64)
+		}
+		return out
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// formatInteger converts the given integer into a string, in the
+// output base the user selected.
+func (c *calcCommand) formatInteger(i *big.Int) string {
+
+	prefix := ""
+	switch c.base {
+	case 2:
+		prefix = "0b"
+	case 8:
+		prefix = "0o"
+	case 16:
+		prefix = "0x"
+	default:
+		return i.String()
+	}
+
+	sign := ""
+	if i.Sign() < 0 {
+		sign = "-"
+	}
+	return sign + prefix + new(big.Int).Abs(i).Text(c.base)
+}
+
+// setBase changes the output base, as a result of a REPL command
+// such as ":hex".
+func (c *calcCommand) setBase(cmd string) error {
+
+	bases := map[string]int{":bin": 2, ":oct": 8, ":dec": 10, ":hex": 16}
+
+	base, ok := bases[cmd]
+	if !ok {
+		return fmt.Errorf("unknown command %s", cmd)
+	}
+	c.base = base
+	return nil
+}
+
+// command handles a REPL command, such as ":hex", or ":save FILE".
+func (c *calcCommand) command(cal *calc.Evaluator, input string) error {
+
+	fields := strings.Fields(input)
+
+	switch fields[0] {
+	case ":load", ":save":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: %s FILE", fields[0])
+		}
+		path := expandHome(fields[1])
+
+		if fields[0] == ":load" {
+			return c.loadFile(cal, path)
+		}
+
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = cal.Save(f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	return c.setBase(input)
+}
+
+// loadFile evaluates the contents of the given file, discarding
+// the result.
+func (c *calcCommand) loadFile(cal *calc.Evaluator, path string) error {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.evaluate(cal, string(data))
+	if cerr, ok := err.(*calc.Error); ok {
+		return fmt.Errorf("%s:%d:%d: %s", path, cerr.Line, cerr.Column, cerr.Message)
+	}
+	return err
+}
+
+// historyFile returns the path to the file our REPL history should
+// be stored within, or "" if it cannot be determined.
+func historyFile() string {
+
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
 	}
-	if out.Type == calc.ERROR {
-		return fmt.Errorf("%s", out.Value.(string))
+	return filepath.Join(dir, "sysbox", "calc_history")
+}
+
+// expandHome replaces a leading "~/" in the given path with the
+// user's home directory.
+func expandHome(path string) string {
+
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			return filepath.Join(home, path[2:])
+		}
 	}
-	if out.Type != calc.NUMBER {
-		return fmt.Errorf("unexpected output (not a number): %v", out)
+	return path
+}
+
+// trimZeros removes any trailing "0" from the decimal places of the given
+// number, along with the decimal point if there are none left.
+func trimZeros(output string) string {
+	if !strings.Contains(output, ".") {
+		return output
 	}
+	output = strings.TrimRight(output, "0")
+	return strings.TrimSuffix(output, ".")
+}
+
+// decimalPlaces returns the number of decimal places needed to show a
+// fraction with the given denominator exactly, which is only possible
+// if the denominator has no prime factors other than 2 and 5.
+func decimalPlaces(denom *big.Int) (int, bool) {
+
+	// Count the factors of two.
+	twos := int(denom.TrailingZeroBits())
+	d := new(big.Int).Rsh(denom, uint(twos))
+
+	// Count the factors of five.
+	fives := 0
+	five := big.NewInt(5)
+	q, r := new(big.Int), new(big.Int)
+	for {
+		q.QuoRem(d, five, r)
+		if r.Sign() != 0 {
+			break
+		}
+		d.Set(q)
+		fives++
+	}
+
+	if d.Cmp(big.NewInt(1)) != 0 {
+		return 0, false
+	}
+	return max(twos, fives), true
+}
+
+// processLines evaluates our -each expression against each line of the
+// given reader, and finally evaluates our -end expression, if we have one.
+//
+// The return value is our exit-code, which is non-zero if any line
+// failed to evaluate.
+func (c *calcCommand) processLines(cal *calc.Evaluator, in io.Reader) int {
 
 	//
-	// Show the result as an int, if possible.
+	// Parse our expressions once, as they'll be evaluated repeatedly.
 	//
-	result := out.Value.(float64)
-	if float64(int(result)) == result {
-		fmt.Printf("%d\n", int(result))
-		return nil
+	each, err := calc.Parse(c.each)
+	if err != nil {
+		showError("", c.each, err)
+		return c.failure()
+	}
+
+	var end calc.Node
+	if c.end != "" {
+		end, err = calc.Parse(c.end)
+		if err != nil {
+			showError("", c.end, err)
+			return c.failure()
+		}
 	}
 
 	//
-	// strip trailing "0"
+	// The aggregates are defined even if we see no lines.
 	//
-	// First convert to string, then remove each
-	// final zero.
-	output := fmt.Sprintf("%f", result)
-	for strings.HasSuffix(output, "0") {
-		output = strings.TrimSuffix(output, "0")
+	cal.ResetAggregates()
+
+	ret := 0
+
+	// The number of the line we're processing, and the number of
+	// field-variables which were set by the previous line.
+	num := 0
+	fields := 0
+
+	reader := bufio.NewReader(in)
+	for {
+		line, rerr := reader.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			fmt.Printf("error: %s\n", rerr)
+			return c.failure()
+		}
+
+		num++
+		if strings.TrimSpace(line) != "" {
+
+			//
+			// Set the variables for each field, removing any
+			// left over from a longer previous line.
+			//
+			vals := templatedcmd.Fields(line, c.split)
+			for i := len(vals); i < fields; i++ {
+				cal.Unset(fmt.Sprintf("f%d", i+1))
+			}
+			fields = len(vals)
+
+			for i, val := range vals {
+				name := fmt.Sprintf("f%d", i+1)
+				if cal.SetNumber(name, val) != nil {
+					cal.Unset(name)
+				}
+			}
+
+			var val interface{}
+			val, err = cal.EvalNode(context.Background(), each)
+			if err == nil && !c.test {
+				err = c.showResult(val)
+			}
+			if _, ok := val.(string); err == nil && !ok {
+				err = cal.Accumulate(val)
+			}
+			if err != nil {
+				fmt.Printf("error: line %d: %s\n", num, err)
+				ret = c.failure()
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		}
 	}
-	fmt.Printf("%s\n", output)
-	return nil
+
+	if end != nil {
+		var val interface{}
+		val, err = cal.EvalNode(context.Background(), end)
+
+		code := c.result("", c.end, val, err)
+		if ret == 0 {
+			ret = code
+		}
+	}
+	return ret
+}
+
+// saveHistory writes the REPL history to the given file, creating
+// the parent directory if required.
+//
+// Failure is silently ignored, as there's nothing useful to do.
+func saveHistory(line *liner.State, path string) {
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	line.WriteHistory(f)
 }
 
 // Execute is invoked if the user specifies `calc` as the subcommand.
@@ -116,11 +723,94 @@ func (c *calcCommand) Execute(args []string) int {
 		input += " "
 	}
 
+	//
+	// Ensure the output base is one we support.
+	//
+	switch c.base {
+	case 2, 8, 10, 16:
+	default:
+		fmt.Printf("error: unsupported base %d\n", c.base)
+		return 1
+	}
+
 	//
 	// Create a new evaluator
 	//
 	cal := calc.New()
 
+	//
+	// Setup arbitrary-precision, if we should.
+	//
+	var err error
+	if c.exact {
+		err = cal.SetExact()
+	} else if c.precision > 0 {
+		err = cal.SetPrecision(c.bits())
+	}
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		return 1
+	}
+
+	//
+	// Evaluate our startup file, if we have one.
+	//
+	if c.init != "" {
+		err = c.loadFile(cal, c.init)
+		if err != nil {
+			fmt.Printf("error: %s\n", err)
+			return 1
+		}
+	}
+
+	//
+	// Processing STDIN?
+	//
+	if c.each != "" {
+		if len(input) > 0 {
+			fmt.Printf("error: -each does not accept an expression as an argument\n")
+			return c.failure()
+		}
+		if c.file != "" {
+			fmt.Printf("error: -each cannot be used with -f\n")
+			return c.failure()
+		}
+		if c.test && c.end == "" {
+			fmt.Printf("error: -test requires -end when used with -each\n")
+			return c.failure()
+		}
+		return c.processLines(cal, os.Stdin)
+	}
+	if c.end != "" {
+		fmt.Printf("error: -end may only be used with -each\n")
+		return c.failure()
+	}
+
+	//
+	// Executing a script?
+	//
+	if c.file != "" {
+		if len(input) > 0 {
+			fmt.Printf("error: -f does not accept an expression as an argument\n")
+			return c.failure()
+		}
+
+		data, ferr := os.ReadFile(c.file)
+		if ferr != nil {
+			fmt.Printf("error: %s\n", ferr)
+			return c.failure()
+		}
+
+		var val interface{}
+		val, err = c.evaluate(cal, string(data))
+		return c.result(c.file, string(data), val, err)
+	}
+
+	if c.test && len(input) == 0 {
+		fmt.Printf("error: -test requires an expression\n")
+		return c.failure()
+	}
+
 	//
 	// If we have no arguments then we're in the repl.
 	//
@@ -129,25 +819,11 @@ func (c *calcCommand) Execute(args []string) int {
 	if len(input) > 0 {
 
 		//
-		// Load the script
-		//
-		cal.Load(input)
-
-		//
-		// Run it.
-		//
-		out := cal.Run()
-
-		//
-		// Show the result.
+		// Evaluate it, and show the result.
 		//
-		err := c.showResult(out)
-		if err != nil {
-			fmt.Printf("error: %s\n", err)
-			return 1
-		}
-
-		return 0
+		var val interface{}
+		val, err = c.evaluate(cal, input)
+		return c.result("", input, val, err)
 	}
 
 	//
@@ -156,10 +832,24 @@ func (c *calcCommand) Execute(args []string) int {
 	line := liner.NewLiner()
 	defer line.Close()
 
+	//
+	// Load any history from a previous session, and save it once
+	// we're done.
+	//
+	history := historyFile()
+	if history != "" {
+		f, ferr := os.Open(history)
+		if ferr == nil {
+			line.ReadHistory(f)
+			f.Close()
+		}
+		defer saveHistory(line, history)
+	}
+
 	//
 	// Tab completion
 	//
-	complete := []string{"exit", "help", "result", "quit"}
+	complete := []string{"exit", "help", "result", "quit", ":bin", ":dec", ":hex", ":load", ":oct", ":save"}
 
 	line.SetCompleter(func(line string) (c []string) {
 		for _, n := range complete {
@@ -167,6 +857,21 @@ func (c *calcCommand) Execute(args []string) int {
 				c = append(c, n)
 			}
 		}
+
+		//
+		// Function names are completed at the end of the line,
+		// so that they may be used within an expression.
+		//
+		start := strings.LastIndexFunc(line, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+		}) + 1
+		if start < len(line) {
+			for _, fn := range cal.Functions() {
+				if strings.HasPrefix(fn, line[start:]) {
+					c = append(c, line[:start]+fn+"(")
+				}
+			}
+		}
 		return
 	})
 	//
@@ -214,28 +919,36 @@ func (c *calcCommand) Execute(args []string) int {
 			}
 
 			//
-			// Load the script
+			// Change of output base, or loading/saving state?
 			//
-			cal.Load(input)
+			if strings.HasPrefix(input, ":") {
+				err = c.command(cal, input)
+				if err != nil {
+					fmt.Printf("error: %s\n", err)
+				}
+				line.AppendHistory(input)
+				continue
+			}
 
 			//
-			// Run it.
+			// Evaluate it.
 			//
-			out := cal.Run()
+			var val interface{}
+			val, err = c.evaluate(cal, input)
 
 			//
 			// Show the result.
 			//
-			err = c.showResult(out)
+			if err == nil {
+				err = c.showResult(val)
+			}
 			if err != nil {
-				fmt.Printf("error: %s\n", err)
+				showError("", input, err)
 			}
 
 			//
 			// Add the input to our history.
 			//
-			// NOTE: Our history is deliberately not persisted.
-			//
 			line.AppendHistory(input)
 		}
 
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/skx/sysbox/calc"
+)
+
+// captureOutput runs the given function, returning what it wrote to
+// STDOUT along with its result.
+func captureOutput(t *testing.T, fn func() int) (string, int) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	ret := fn()
+	os.Stdout = stdout
+	w.Close()
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	return string(out), ret
+}
+
+// TestProcessLines tests evaluating an expression against each line of
+// input, followed by an expression using the aggregates.
+func TestProcessLines(t *testing.T) {
+
+	type TestCase struct {
+		input  string
+		each   string
+		end    string
+		test   bool
+		output string
+		ret    int
+	}
+
+	tests := []TestCase{
+		{input: "1 512\n2 0\n", each: "f1 * 1024 + f2", end: "sum", output: "1536\n2048\n3584\n"},
+		{input: "3\n1\n4\n", each: "f1", end: "max - min", output: "3\n1\n4\n3\n"},
+
+		// Without any input the aggregates are all zero.
+		{input: "", each: "f1", end: "sum", output: "0\n"},
+		{input: "\n\n", each: "f1", end: "count + mean + min + max", output: "0\n"},
+
+		// With -test nothing is shown.
+		{input: "1\n2\n", each: "f1", end: "sum > 2", test: true, output: "", ret: 0},
+		{input: "1\n2\n", each: "f1", end: "sum > 3", test: true, output: "", ret: 1},
+		{input: "", each: "f1", end: "count == 0", test: true, output: "", ret: 0},
+	}
+
+	for _, test := range tests {
+
+		c := &calcCommand{each: test.each, end: test.end, test: test.test}
+
+		out, ret := captureOutput(t, func() int {
+			return c.processLines(calc.New(), strings.NewReader(test.input))
+		})
+
+		if out != test.output {
+			t.Fatalf("expected output %q for %q, got %q", test.output, test.input, out)
+		}
+		if ret != test.ret {
+			t.Fatalf("expected exit-code %d for %q, got %d", test.ret, test.input, ret)
+		}
+	}
+}
+
+// TestFormatNumber tests that values which were calculated via float64
+// are shown with float64 precision, rather than the precision we asked for.
+func TestFormatNumber(t *testing.T) {
+
+	type TestCase struct {
+		input  string
+		output string
+	}
+
+	tests := []TestCase{
+		{input: "1 / 3", output: "0.33333333333333333333333333333333333333333333333333"},
+		{input: "sqrt(2)", output: "1.4142135623730950488016887242096980785696718753769"},
+		{input: "sin(1)", output: "0.8414709848078965"},
+		{input: "2 ^ 0.5 * 2 ^ 0.5", output: "2.0000000000000004"},
+		{input: "pow(2, 10)", output: "1024"},
+		{input: "pow(2, 10) / 4", output: "256"},
+		{input: "exp(1000)", output: "+Inf"},
+	}
+
+	for _, test := range tests {
+
+		c := &calcCommand{precision: 50, base: 10}
+
+		cal := calc.New()
+		if err := cal.SetPrecision(c.bits()); err != nil {
+			t.Fatalf("failed to set precision: %s", err)
+		}
+		cal.Load(test.input)
+
+		out := cal.Run()
+		if out.Type != calc.NUMBER {
+			t.Fatalf("Output was not a number for '%s': %v", test.input, out)
+		}
+		if c.formatNumber(out.Value) != test.output {
+			t.Fatalf("expected '%s' for '%s', got '%s'", test.output, test.input, c.formatNumber(out.Value))
+		}
+	}
+}
+
+// TestFormatExact tests that exact values are shown exactly, as a decimal
+// if possible and as a fraction otherwise.
+func TestFormatExact(t *testing.T) {
+
+	type TestCase struct {
+		input  string
+		output string
+	}
+
+	tests := []TestCase{
+		{input: "0.1 + 0.2", output: "0.3"},
+		{input: "1 / 8", output: "0.125"},
+		{input: "-3 / 20", output: "-0.15"},
+		{input: "1 / 2 ^ 30", output: "0.000000000931322574615478515625"},
+		{input: "10 ^ -25", output: "0.0000000000000000000000001"},
+		{input: "1 / 3", output: "1/3"},
+		{input: "-22 / 7", output: "-22/7"},
+		{input: "1 / 6", output: "1/6"},
+		{input: "2 ^ 100", output: "1267650600228229401496703205376"},
+	}
+
+	for _, test := range tests {
+
+		c := &calcCommand{exact: true, base: 10}
+
+		cal := calc.New()
+		if err := cal.SetExact(); err != nil {
+			t.Fatalf("failed to set exact mode: %s", err)
+		}
+		cal.Load(test.input)
+
+		out := cal.Run()
+		if out.Type != calc.NUMBER {
+			t.Fatalf("Output was not a number for '%s': %v", test.input, out)
+		}
+		if c.formatNumber(out.Value) != test.output {
+			t.Fatalf("expected '%s' for '%s', got '%s'", test.output, test.input, c.formatNumber(out.Value))
+		}
+	}
+}
+
+// TestFormatFloat tests showing float64 values, including those too small
+// to show with six decimal places.
+func TestFormatFloat(t *testing.T) {
+
+	type TestCase struct {
+		input  float64
+		output string
+	}
+
+	tests := []TestCase{
+		{input: 0.5, output: "0.5"},
+		{input: -2.25, output: "-2.25"},
+		{input: 0.1 + 0.2, output: "0.3"},
+		{input: 1e-7, output: "1e-07"},
+		{input: -2.5e-10, output: "-2.5e-10"},
+		{input: 0.0000004, output: "4e-07"},
+		{input: 0.0000006, output: "0.000001"},
+		{input: 1024, output: "1024"},
+		{input: math.Inf(-1), output: "-Inf"},
+		{input: math.NaN(), output: "NaN"},
+	}
+
+	for _, test := range tests {
+
+		c := &calcCommand{base: 10}
+		if c.formatNumber(test.input) != test.output {
+			t.Fatalf("expected '%s' for %v, got '%s'", test.output, test.input, c.formatNumber(test.input))
+		}
+	}
+}
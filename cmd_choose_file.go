@@ -1,31 +1,50 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/skx/sysbox/chooseui"
-	"github.com/skx/sysbox/templatedcmd"
 )
 
 // Structure for our options and state.
 type chooseFileCommand struct {
 
-	// Command to execute
-	exec string
+	// Options common to choose-file and choose-stdin
+	chooseOptions
 
-	// Filenames we'll let the user choose between
-	files []string
+	// Don't show the default preview?
+	noPreview bool
+
+	// Browse one directory at a time, rather than showing all files?
+	browse bool
+
+	// Show hidden files?
+	hidden bool
+
+	// Comma-separated list of the extensions of the files to show
+	ext string
+
+	// The extensions of the files to show, parsed from ext
+	extensions []string
 }
 
 // Arguments adds per-command args to the object.
 func (cf *chooseFileCommand) Arguments(f *flag.FlagSet) {
 	if cf != nil {
-		f.StringVar(&cf.exec, "execute", "", "Command to execute once a selection has been made")
+		cf.arguments(f)
+		f.BoolVar(&cf.noPreview, "no-preview", false, "Don't show the default preview of the highlighted file")
+		f.BoolVar(&cf.browse, "browse", false, "Browse one directory at a time, rather than showing all files beneath it")
+		f.BoolVar(&cf.hidden, "hidden", false, "Show hidden files, and those in hidden directories")
+		f.StringVar(&cf.ext, "ext", "", "Only show files with these extensions, for example '.mkv,.mp4'")
 	}
 }
 
@@ -39,8 +58,100 @@ This command presents a directory view, showing you all the files beneath
 the named directory.  You can navigate with the keyboard, and press RETURN
 to select a file.
 
+Files are shown as they are found, so you may start to choose before the
+whole directory has been searched.
+
 Optionally you can press TAB to filter the list via an input field.
 
+Filtering:
+
+The filter is a fuzzy-search, the best matches are shown first, and the
+characters which matched are highlighted.  The filter may contain several
+space-separated terms, all of which must match:
+
+   abc     Fuzzy-match; "a", "b", and "c" appear in that order.
+   'abc    Exact-match; "abc" appears literally.
+   ^abc    The entry begins with "abc".
+   abc$    The entry ends with "abc".
+   !abc    The entry does not contain "abc".
+
+Matching is case-insensitive, unless a term contains an upper-case
+character.
+
+Multiple Selections:
+
+With -multi you may mark several entries, with TAB or SPACE, before
+pressing RETURN.  Each marked entry is shown upon its own line, or the
+command given to -execute is run once for each of them.  If the command
+contains "{+}" it is instead run once, with all the marked entries:
+
+   $ sysbox choose-file -multi -execute="tar -czf backup.tar.gz {+}" ~/Downloads
+
+Commands are split into arguments with shell-like quoting rules, so you
+may write -execute='notify-send "Now playing" {}', and a literal "{}" may
+be written as '{}' or \{}.
+
+As well as "{}" and "{+}" commands may use the placeholders described by
+'sysbox help exec-stdin', such as "{-1}" for the last field, "{2..}" for
+the second field onwards, or "{/}" for the basename.  With -regex the
+named groups of a regular expression are available too:
+
+   $ sysbox choose-file -execute='convert {} {.}.png' ~/Pictures
+
+Preview:
+
+A preview of the highlighted file is shown alongside the list, with the
+first lines of text files and the size and mode of binary files.  You
+may supply a command to generate the preview instead, or disable it:
+
+   $ sysbox choose-file -preview="head -50 {}" /etc
+   $ sysbox choose-file -no-preview ~/Videos
+
+Scripting:
+
+The UI may be started with a filter already in place, via -query, and
+with -select-1 the entry is chosen without showing the UI if only one
+matches it.  Similarly -exit-0 will exit, without showing the UI, if
+nothing matches.
+
+To print all the entries which match a filter, best first, without any
+UI at all use -filter:
+
+   $ sysbox choose-file -filter="^cmd .go$"
+
+Browsing:
+
+With -browse only the contents of a single directory are shown.  Press
+RETURN upon a directory to enter it, and BACKSPACE (when the filter is
+empty) to move to its parent.  Ctrl-T toggles the display of hidden files.
+Marked entries are forgotten when you change directory.
+
+Hidden files, and those in hidden directories, are only shown if you
+specify -hidden.  To show only files with particular extensions use -ext:
+
+   $ sysbox choose-file -browse -ext=.mkv,.mp4 ~/Videos
+
+Key Bindings:
+
+Keys may be bound to actions with -bind 'key:action', which may be given
+several times.  Keys are named as "ctrl-e", "alt-x", "f1", "enter", etc,
+and the available actions are:
+
+   accept         Choose the highlighted, or marked, entries.
+   abort          Exit without choosing anything.
+   exit(N)        Choose, as with accept, and exit with the code N.
+   execute(CMD)   Run a command with the highlighted entry, or with the
+                  marked entries if it uses "{+}", then return.
+   reload(CMD)    Replace the entries with the output of a command.
+   toggle         Mark, or unmark, the highlighted entry, with -multi.
+   up, down       Move up or down.
+   first, last    Move to the first or last entry.
+   delete-line    Clear the filter.
+
+For example:
+
+   $ sysbox choose-file -bind 'ctrl-e:execute(vim {})' -bind 'ctrl-x:exit(3)'
+
 Uses:
 
 This is ideal for choosing videos, roms, etc.  For example launch a
@@ -49,6 +160,9 @@ video file, interactively:
    $ xine "$(sysbox choose-file ~/Videos)"
    $ sysbox choose-file -execute="xine {}" ~/Videos
 
+The -delimiter, -with-nth, -output-nth, and -header-lines flags work as
+they do for choose-stdin.
+
 See also 'sysbox help choose-stdin'.`
 }
 
@@ -64,80 +178,329 @@ func (cf *chooseFileCommand) Execute(args []string) int {
 	}
 
 	//
-	// Find files
+	// Ensure it exists
 	//
-	err := filepath.Walk(dir,
-		func(path string, info os.FileInfo, err error) error {
-
-			// Null info?  That probably means that the
-			// destination we're trying to walk doesn't exist.
-			if info == nil {
-				return nil
-			}
-
-			// We'll add anything that isn't a directory
-			if !info.IsDir() {
-				if !strings.Contains(path, "/.") && !strings.HasPrefix(path, ".") {
-					cf.files = append(cf.files, path)
-				}
-			}
-			return nil
-		})
-
+	_, err := os.Stat(dir)
 	if err != nil {
 		fmt.Printf("error walking %s: %s\n", dir, err.Error())
 		return 1
 	}
-	if len(cf.files) < 1 {
+
+	//
+	// Parse the extensions we show.
+	//
+	for _, ext := range strings.Split(cf.ext, ",") {
+		ext = strings.TrimSpace(ext)
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		cf.extensions = append(cf.extensions, strings.ToLower(ext))
+	}
+
+	if cf.browse {
+		return cf.browseDirectory(dir)
+	}
+
+	//
+	// Find files, in the background, so that they are shown
+	// as soon as they are found.
+	//
+	files := make(chan string)
+	go func() {
+		defer close(files)
+
+		_ = filepath.Walk(dir,
+			func(path string, info os.FileInfo, err error) error {
+
+				// Null info?  That probably means that the
+				// destination we're trying to walk doesn't exist.
+				if info == nil {
+					return nil
+				}
+
+				// Skip hidden directories entirely.
+				if info.IsDir() {
+					if path != dir && !cf.show(info.Name(), true) {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
+				// We'll add anything else we should show
+				if cf.show(info.Name(), false) {
+					files <- path
+				}
+				return nil
+			})
+	}()
+
+	//
+	// Wait for the first file, so that we don't show the UI
+	// if there are none.
+	//
+	first, ok := <-files
+	if !ok {
 		fmt.Printf("Failed to find any files beneath %s\n", dir)
 		return 1
 	}
 
+	items := make(chan string)
+	go func() {
+		defer close(items)
+
+		items <- first
+		for file := range files {
+			items <- file
+		}
+	}()
+
 	//
 	// Launch the UI
 	//
-	chooser := chooseui.New(cf.files)
-	choice := chooser.Choose()
+	chooser := chooseui.NewStream(items)
+	if !cf.noPreview {
+		chooser.Preview = filePreview
+	}
+
+	return cf.choose(chooser)
+}
+
+// show returns true if the file, or directory, with the given name
+// should be shown.
+func (cf *chooseFileCommand) show(name string, dir bool) bool {
+
+	if !cf.hidden && strings.HasPrefix(name, ".") {
+		return false
+	}
+	if dir || len(cf.extensions) == 0 {
+		return true
+	}
+
+	name = strings.ToLower(name)
+	for _, ext := range cf.extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// browseDirectory allows the user to choose a file by browsing one
+// directory at a time.
+//
+// The choices are the paths of the entries in the current directory,
+// with a trailing "/" on directories, but only their names are shown.
+func (cf *chooseFileCommand) browseDirectory(dir string) int {
+
+	chooser := chooseui.New(nil)
+	if !cf.noPreview {
+		chooser.Preview = filePreview
+	}
+	chooser.Display = func(entry string) string {
+		name := filepath.Base(entry)
+		if strings.HasSuffix(entry, "/") {
+			name += "/"
+		}
+		return name
+	}
 
 	//
-	// Did something get chosen?  If not terminate
+	// visit changes to the given directory, unless it cannot
+	// be read.
 	//
-	if choice == "" {
+	visit := func(path string) error {
+		entries, err := cf.readDirectory(path)
+		if err != nil {
+			return err
+		}
+		dir = path
+		chooser.SetPrompt(strings.TrimSuffix(dir, "/") + "/ > ")
+		chooser.SetChoices(entries)
+		return nil
+	}
 
+	err := visit(dir)
+	if err != nil {
+		fmt.Printf("error reading %s: %s\n", dir, err)
 		return 1
 	}
 
 	//
-	// Are we executing?
+	// RETURN upon a directory enters it, otherwise the
+	// highlighted file is selected as usual.
 	//
-	if cf.exec != "" {
+	_ = chooser.Bind("enter", func(entry string) bool {
+		if !strings.HasSuffix(entry, "/") {
+			return false
+		}
+		_ = visit(strings.TrimSuffix(entry, "/"))
+		return true
+	})
 
-		//
-		// Split into command and arguments
-		//
-		run := templatedcmd.Expand(cf.exec, choice, "")
+	//
+	// BACKSPACE moves to the parent, unless the user is
+	// editing the filter.
+	//
+	_ = chooser.Bind("backspace", func(entry string) bool {
+		if chooser.CurrentQuery() != "" {
+			return false
+		}
+		_ = visit(filepath.Join(dir, ".."))
+		return true
+	})
 
-		//
-		// Run it.
-		//
-		cmd := exec.Command(run[0], run[1:]...)
-		out, errr := cmd.CombinedOutput()
-		if errr != nil {
-			fmt.Printf("Error running '%v': %s\n", run, errr.Error())
-			return 1
+	//
+	// Ctrl-T toggles the display of hidden files.
+	//
+	_ = chooser.Bind("ctrl-t", func(entry string) bool {
+		cf.hidden = !cf.hidden
+		_ = visit(dir)
+		return true
+	})
+
+	return cf.choose(chooser)
+}
+
+// readDirectory returns the entries of the given directory which we
+// should show, directories first, with a trailing "/" upon each
+// directory.
+func (cf *chooseFileCommand) readDirectory(dir string) ([]string, error) {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs, files []string
+	for _, entry := range entries {
+
+		path := filepath.Join(dir, entry.Name())
+
+		// Follow symlinks, so that links to directories
+		// may be entered.
+		isDir := entry.IsDir()
+		if entry.Type()&os.ModeSymlink != 0 {
+			if info, serr := os.Stat(path); serr == nil {
+				isDir = info.IsDir()
+			}
+		}
+
+		if !cf.show(entry.Name(), isDir) {
+			continue
 		}
+		if isDir {
+			dirs = append(dirs, path+"/")
+		} else {
+			files = append(files, path)
+		}
+	}
+
+	// os.ReadDir returns the entries sorted by name.
+	return append(dirs, files...), nil
+}
 
-		//
-		// And we're done
-		//
-		fmt.Printf("%s\n", out)
-		return 0
+// trimPartialRune removes an incomplete UTF-8 character from the end of
+// the given buffer, if there is one, as we'd find when we only read the
+// start of a file.
+func trimPartialRune(buf []byte) []byte {
 
+	//
+	// Find the start of the last character, which must be within
+	// the last few bytes.
+	//
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				return buf[:i]
+			}
+			break
+		}
+	}
+	return buf
+}
+
+// filePreview is the default preview for choose-file.
+//
+// For text files we show the first lines of the file, and for
+// binary files a summary of their size and mode.
+func filePreview(ctx context.Context, path string) string {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err.Error()
+	}
+
+	summary := fmt.Sprintf("Size: %d bytes\nMode: %s\nModified: %s\n",
+		info.Size(), info.Mode(), info.ModTime().Format(time.RFC1123))
+
+	//
+	// For directories show their contents.
+	//
+	if info.IsDir() {
+		entries, derr := os.ReadDir(path)
+		if derr != nil {
+			return derr.Error()
+		}
+		var names []string
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		if len(names) > 100 {
+			names = names[:100]
+		}
+		return strings.Join(names, "\n")
+	}
+
+	if !info.Mode().IsRegular() {
+		return summary
 	}
 
+	file, err := os.Open(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer file.Close()
+
+	buf := make([]byte, 8192)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err.Error()
+	}
+	full := n == len(buf)
+	buf = buf[:n]
+
+	//
+	// If there are NUL bytes, or the content isn't valid
+	// UTF-8, then this is a binary file.
 	//
-	// We're not executing, so show the user's choice
+	// We might have cut a character in half at the end
+	// of our buffer, so allow for that.
 	//
-	fmt.Printf("%s\n", choice)
-	return 0
+	text := buf
+	if full {
+		text = trimPartialRune(buf)
+	}
+	if bytes.IndexByte(buf, 0) >= 0 || !utf8.Valid(text) {
+		return "Binary file\n\n" + summary
+	}
+
+	if ctx.Err() != nil {
+		return ""
+	}
+
+	//
+	// Show the first lines.
+	//
+	lines := strings.SplitAfter(string(text), "\n")
+	if len(lines) > 100 {
+		lines = lines[:100]
+	}
+	return strings.Join(lines, "")
 }
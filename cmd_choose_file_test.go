@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestTrimPartialRune tests removing an incomplete character from the
+// end of a buffer.
+func TestTrimPartialRune(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"", ""},
+		{"hello", "hello"},
+		{"日本", "日本"},
+		{"日本"[:4], "日"},
+		{"日本"[:5], "日"},
+		{"a€"[:3], "a"},
+		{"\xff\xff", "\xff\xff"},
+	}
+
+	for _, test := range tests {
+		out := string(trimPartialRune([]byte(test.input)))
+		if out != test.output {
+			t.Fatalf("expected %q for %q, got %q", test.output, test.input, out)
+		}
+	}
+}
+
+// TestFilePreview ensures that text files are shown, even if they're
+// larger than we read, and contain characters which cross the end of
+// what we read.
+func TestFilePreview(t *testing.T) {
+
+	dir := t.TempDir()
+
+	//
+	// Each line is 3-byte characters and a newline, so the
+	// buffer we read ends part way through one of them.
+	//
+	path := filepath.Join(dir, "cjk.txt")
+	text := strings.Repeat(strings.Repeat("日本語", 10)+"\n", 1000)
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	out := filePreview(context.Background(), path)
+	if strings.HasPrefix(out, "Binary file") {
+		t.Fatalf("text file was considered binary")
+	}
+	if !strings.HasPrefix(out, "日本語") {
+		t.Fatalf("unexpected preview: %q", out[:20])
+	}
+
+	path = filepath.Join(dir, "binary")
+	if err := os.WriteFile(path, []byte("\x00\x01\x02"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if out = filePreview(context.Background(), path); !strings.HasPrefix(out, "Binary file") {
+		t.Fatalf("binary file was not considered binary")
+	}
+}
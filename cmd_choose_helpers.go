@@ -0,0 +1,297 @@
+// helper functions shared by choose-file and choose-stdin.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/skx/sysbox/chooseui"
+	"github.com/skx/sysbox/templatedcmd"
+)
+
+// chooseOptions holds the options which are common to both
+// choose-file and choose-stdin.
+type chooseOptions struct {
+
+	// Command to execute
+	exec string
+
+	// Allow several entries to be chosen?
+	multi bool
+
+	// Command to preview the highlighted entry
+	preview string
+
+	// Initial filter
+	query string
+
+	// Don't show the UI if only one entry matches
+	selectOne bool
+
+	// Don't show the UI if no entries match
+	exitZero bool
+
+	// Show the matches for this filter, without the UI
+	filter string
+
+	// String to split entries into fields
+	delimiter string
+
+	// Fields to display, and search
+	withNth string
+
+	// Fields to output
+	outputNth string
+
+	// Number of lines to treat as a header
+	headerLines int
+
+	// Key bindings, as "key:action"
+	bind stringList
+
+	// Regular expression whose named groups may be used in commands
+	regex string
+}
+
+// stringList is a flag which may be given multiple times.
+type stringList []string
+
+// String returns the values of the flag.
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+// Set adds a value to the flag.
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// arguments adds the common arguments to the given flagset.
+func (co *chooseOptions) arguments(f *flag.FlagSet) {
+	f.StringVar(&co.exec, "execute", "", "Command to execute once a selection has been made")
+	f.BoolVar(&co.multi, "multi", false, "Allow several entries to be marked, with TAB or SPACE, and chosen")
+	f.StringVar(&co.preview, "preview", "", "Command to execute to preview the highlighted entry")
+	f.StringVar(&co.query, "query", "", "Start with the given filter")
+	f.BoolVar(&co.selectOne, "select-1", false, "If only one entry matches the filter choose it, without showing the UI")
+	f.BoolVar(&co.exitZero, "exit-0", false, "If no entries match the filter exit, without showing the UI")
+	f.StringVar(&co.filter, "filter", "", "Show the entries which match the given filter, without showing the UI")
+	f.StringVar(&co.delimiter, "delimiter", "", "Split entries into fields with this string, rather than whitespace")
+	f.StringVar(&co.withNth, "with-nth", "", "Comma-separated list of the fields to display and search")
+	f.StringVar(&co.outputNth, "output-nth", "", "Comma-separated list of the fields to output, or execute with")
+	f.IntVar(&co.headerLines, "header-lines", 0, "Show this many lines at the start as a header, rather than as entries")
+	f.Var(&co.bind, "bind", "Bind a key to an action, as 'key:action', may be repeated")
+	f.StringVar(&co.regex, "regex", "", "Regular expression whose named groups may be used in commands, as {name}")
+}
+
+// choose launches the given UI, and then either prints the users'
+// choice(s) or executes the command with them.
+func (co *chooseOptions) choose(chooser *chooseui.ChooseUI) int {
+
+	withNth, err := parseFieldList(co.withNth)
+	if err != nil {
+		fmt.Printf("error: invalid -with-nth: %s\n", err)
+		return 1
+	}
+	outputNth, err := parseFieldList(co.outputNth)
+	if err != nil {
+		fmt.Printf("error: invalid -output-nth: %s\n", err)
+		return 1
+	}
+
+	var re *regexp.Regexp
+	if co.regex != "" {
+		re, err = regexp.Compile(co.regex)
+		if err != nil {
+			fmt.Printf("error: invalid -regex: %s\n", err)
+			return 1
+		}
+		chooser.Regexp = re
+	}
+
+	//
+	// Parse the command we execute now, so that a mistake is
+	// reported before the user makes their choice.
+	//
+	var command *templatedcmd.Template
+	if co.exec != "" {
+		command, err = templatedcmd.Parse(co.exec)
+		if err != nil {
+			fmt.Printf("error: invalid -execute: %s\n", err)
+			return 1
+		}
+		command.SetRegexp(re)
+	}
+
+	chooser.Delimiter = co.delimiter
+	chooser.WithNth = withNth
+	chooser.HeaderLines = co.headerLines
+
+	for _, spec := range co.bind {
+		err = chooser.BindSpec(spec)
+		if err != nil {
+			fmt.Printf("error: invalid -bind: %s\n", err)
+			return 1
+		}
+	}
+
+	//
+	// output returns the text we show, or execute with,
+	// for the given entry.
+	//
+	output := func(entry string) string {
+		if len(outputNth) == 0 {
+			return entry
+		}
+		return templatedcmd.Select(entry, co.delimiter, outputNth)
+	}
+
+	//
+	// If we're filtering then show the matches, best first,
+	// and we're done.
+	//
+	if co.filter != "" {
+		chooser.Query = co.filter
+		matches := chooser.Matching()
+		for _, match := range matches {
+			fmt.Printf("%s\n", output(match))
+		}
+		if len(matches) == 0 {
+			return 1
+		}
+		return 0
+	}
+
+	chooser.Query = co.query
+	chooser.SelectOne = co.selectOne
+	chooser.ExitZero = co.exitZero
+
+	if co.preview != "" {
+		var preview *templatedcmd.Template
+		preview, err = templatedcmd.Parse(co.preview)
+		if err != nil {
+			fmt.Printf("error: invalid -preview: %s\n", err)
+			return 1
+		}
+		preview.SetRegexp(re)
+		chooser.Preview = chooseui.TemplatePreview(preview, co.delimiter)
+	}
+
+	var choices []string
+
+	if co.multi {
+		choices = chooser.ChooseMultiple()
+	} else {
+		choice := chooser.Choose()
+		if choice != "" {
+			choices = append(choices, choice)
+		}
+	}
+
+	//
+	// If the user chose to exit with a particular code, via
+	// a key-binding, we'll use that unless we fail.
+	//
+	code := chooser.ExitCode()
+
+	//
+	// Did something get chosen?  If not terminate
+	//
+	if len(choices) == 0 {
+		if code != 0 {
+			return code
+		}
+		return 1
+	}
+
+	for i, choice := range choices {
+		choices[i] = output(choice)
+	}
+
+	//
+	// We're not executing, so show the user's choice(s)
+	//
+	if command == nil {
+		for _, choice := range choices {
+			fmt.Printf("%s\n", choice)
+		}
+		return code
+	}
+
+	ret := co.execute(command, choices)
+	if ret != 0 {
+		return ret
+	}
+	return code
+}
+
+// execute runs the given command for the user's choices, splitting
+// them into fields with our delimiter, and returns our exit-code.
+func (co *chooseOptions) execute(command *templatedcmd.Template, choices []string) int {
+
+	//
+	// If the command uses "{+}" it is run once, with all
+	// the choices.
+	//
+	if command.UsesAll() {
+		return runChosen(command.ExpandAll(choices, co.delimiter))
+	}
+
+	//
+	// Otherwise it is run once for each choice.
+	//
+	ret := 0
+	for _, choice := range choices {
+		if runChosen(command.Expand(choice, co.delimiter)) != 0 {
+			ret = 1
+		}
+	}
+	return ret
+}
+
+// parseFieldList parses a comma-separated list of field numbers, such
+// as "1,3".
+func parseFieldList(spec string) ([]int, error) {
+
+	var fields []int
+
+	if spec == "" {
+		return fields, nil
+	}
+
+	for _, piece := range strings.Split(spec, ",") {
+		num, err := strconv.Atoi(strings.TrimSpace(piece))
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a number", piece)
+		}
+		if num < 1 {
+			return nil, fmt.Errorf("fields are numbered from 1, not %d", num)
+		}
+		fields = append(fields, num)
+	}
+	return fields, nil
+}
+
+// runChosen runs the given command, and shows its output.
+func runChosen(run []string) int {
+
+	if len(run) == 0 {
+		fmt.Printf("error: empty command\n")
+		return 1
+	}
+
+	cmd := exec.Command(run[0], run[1:]...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Printf("Error running '%v': %s\n", run, err.Error())
+		return 1
+	}
+
+	fmt.Printf("%s\n", out)
+	return 0
+}
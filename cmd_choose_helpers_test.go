@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/skx/sysbox/templatedcmd"
+)
+
+// TestExecute tests running a command for the user's choices, which
+// are split into fields with the delimiter.
+func TestExecute(t *testing.T) {
+
+	type TestCase struct {
+		command   string
+		delimiter string
+		output    string
+	}
+
+	tests := []TestCase{
+		{command: "echo {2}", output: "root\n\n\n\n"},
+		{command: "echo {2}", delimiter: ":", output: "x\n\nx\n\n"},
+		{command: "echo {-1} {1..2}", delimiter: ":", output: "0 root root:x\n\nbin bin:x\n\n"},
+		{command: "echo {+}", delimiter: ":", output: "root:x:0:0 root bin:x:1:bin\n\n"},
+	}
+
+	for _, test := range tests {
+
+		command, err := templatedcmd.Parse(test.command)
+		if err != nil {
+			t.Fatalf("unexpected error parsing '%s': %s", test.command, err)
+		}
+
+		co := &chooseOptions{delimiter: test.delimiter}
+		out, ret := captureOutput(t, func() int {
+			return co.execute(command, []string{"root:x:0:0 root", "bin:x:1:bin"})
+		})
+		if ret != 0 {
+			t.Fatalf("unexpected exit-code %d for '%s'", ret, test.command)
+		}
+		if out != test.output {
+			t.Fatalf("expected %q for '%s', got %q", test.output, test.command, out)
+		}
+	}
+}
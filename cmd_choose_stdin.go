@@ -3,27 +3,22 @@ package main
 import (
 	"bufio"
 	"flag"
-	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/skx/sysbox/chooseui"
-	"github.com/skx/sysbox/templatedcmd"
 )
 
 // Structure for our options and state.
 type chooseSTDINCommand struct {
-	// Command to execute
-	exec string
 
-	// Filenames we'll let the user choose between
-	stdin []string
+	// Options common to choose-file and choose-stdin
+	chooseOptions
 }
 
 // Arguments adds per-command args to the object.
 func (cs *chooseSTDINCommand) Arguments(f *flag.FlagSet) {
-	f.StringVar(&cs.exec, "execute", "", "Command to execute once a selection has been made")
+	cs.arguments(f)
 }
 
 // Info returns the name of this subcommand.
@@ -34,95 +29,149 @@ Details:
 
 This command presents a simple UI, showing all the lines read from STDIN.
 
+Lines are shown as they are read, so you may start to choose before the
+command feeding STDIN has finished.
+
 You can navigate with the keyboard, and press RETURN to select an entry.
 
 Optionally you can press TAB to filter the list via an input field.
 
-Uses:
+Filtering:
 
-This is ideal for choosing videos, roms, etc.  For example launch the
-given video file:
+The filter is a fuzzy-search, the best matches are shown first, and the
+characters which matched are highlighted.  The filter may contain several
+space-separated terms, all of which must match:
 
-   $ find . -name '*.avi' -print | sysbox choose-stdin -exec 'xine "{}"'
+   abc     Fuzzy-match; "a", "b", and "c" appear in that order.
+   'abc    Exact-match; "abc" appears literally.
+   ^abc    The entry begins with "abc".
+   abc$    The entry ends with "abc".
+   !abc    The entry does not contain "abc".
 
-See also 'sysbox help choose-file'.`
-}
+Matching is case-insensitive, unless a term contains an upper-case
+character.
 
-// Execute is invoked if the user specifies `choose-stdin` as the subcommand.
-func (cs *chooseSTDINCommand) Execute(args []string) int {
+Multiple Selections:
 
-	//
-	// Prepare to read line-by-line
-	//
-	scanner := bufio.NewReader(os.Stdin)
+With -multi you may mark several entries, with TAB or SPACE, before
+pressing RETURN.  Each marked entry is shown upon its own line, or the
+command given to -execute is run once for each of them.  If the command
+contains "{+}" it is instead run once, with all the marked entries:
 
-	//
-	// Read a line
-	//
-	line, err := scanner.ReadString(byte('\n'))
-	for err == nil && line != "" {
+   $ ls | sysbox choose-stdin -multi -execute="tar -czf backup.tar.gz {+}"
 
-		//
-		// Remove any leading/trailing whitespace
-		//
-		line = strings.TrimSpace(line)
+Commands are split into arguments with shell-like quoting rules, so you
+may write -execute='notify-send "Now playing" {}', and a literal "{}" may
+be written as '{}' or \{}.
 
-		//
-		// Save this away
-		//
-		cs.stdin = append(cs.stdin, line)
+As well as "{}" and "{+}" commands may use the placeholders described by
+'sysbox help exec-stdin', such as "{-1}" for the last field, "{2..}" for
+the second field onwards, or "{/}" for the basename.  With -regex the
+named groups of a regular expression are available too:
 
-		//
-		// Loop again
-		//
-		line, err = scanner.ReadString(byte('\n'))
-	}
+   $ docker ps | sysbox choose-stdin -header-lines=1 \
+        -regex='^(?P<id>[0-9a-f]+)' -execute='docker logs {id}'
 
-	//
-	// Launch the UI
-	//
-	chooser := chooseui.New(cs.stdin)
-	choice := chooser.Choose()
+Preview:
 
-	//
-	// Did something get chosen?  If not terminate
-	//
-	if choice == "" {
+If you supply a command with -preview it will be run for the highlighted
+entry, and its output shown in a pane alongside the list:
+
+   $ ls | sysbox choose-stdin -preview='file {}'
+
+Scripting:
+
+The UI may be started with a filter already in place, via -query, and
+with -select-1 the entry is chosen without showing the UI if only one
+matches it.  Similarly -exit-0 will exit, without showing the UI, if
+nothing matches.
+
+To print all the entries which match a filter, best first, without any
+UI at all use -filter:
+
+   $ ls | sysbox choose-stdin -filter=".go$ !_test"
 
-		return 1
-	}
+Fields:
+
+Entries are split into fields in the same way as "{N}" is expanded by
+-execute; upon whitespace, or upon the string given with -delimiter.
+Use -with-nth to display, and search, only some fields, and -output-nth
+to choose the fields which are output, or passed to -execute.  Both take
+a comma-separated list of field numbers, starting from 1.
+
+With -header-lines the first lines are shown as a header, rather than
+as entries which may be chosen:
+
+   $ ps -e | sysbox choose-stdin -header-lines=1 -with-nth=4 -output-nth=1
+
+Key Bindings:
+
+Keys may be bound to actions with -bind 'key:action', which may be given
+several times.  Keys are named as "ctrl-e", "alt-x", "f1", "enter", etc,
+and the available actions are:
+
+   accept         Choose the highlighted, or marked, entries.
+   abort          Exit without choosing anything.
+   exit(N)        Choose, as with accept, and exit with the code N.
+   execute(CMD)   Run a command with the highlighted entry, or with the
+                  marked entries if it uses "{+}", then return.
+   reload(CMD)    Replace the entries with the output of a command.
+   toggle         Mark, or unmark, the highlighted entry, with -multi.
+   up, down       Move up or down.
+   first, last    Move to the first or last entry.
+   delete-line    Clear the filter.
+
+For example:
+
+   $ ls | sysbox choose-stdin -bind 'ctrl-e:execute(vim {})' -bind 'ctrl-x:exit(3)'
+
+Uses:
+
+This is ideal for choosing videos, roms, etc.  For example launch the
+given video file:
+
+   $ find . -name '*.avi' -print | sysbox choose-stdin -exec 'xine "{}"'
+
+See also 'sysbox help choose-file'.`
+}
+
+// Execute is invoked if the user specifies `choose-stdin` as the subcommand.
+func (cs *chooseSTDINCommand) Execute(args []string) int {
 
 	//
-	// Are we executing?
+	// Read STDIN in the background, so that the lines are
+	// shown as soon as they are received.
 	//
-	if cs.exec != "" {
-
-		//
-		// Split into command and arguments
-		//
-		run := templatedcmd.Expand(cs.exec, choice, "")
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
 
 		//
-		// Run it.
+		// Prepare to read line-by-line
 		//
-		cmd := exec.Command(run[0], run[1:]...)
-		out, errr := cmd.CombinedOutput()
-		if errr != nil {
-			fmt.Printf("Error running '%v': %s\n", run, errr.Error())
-			return 1
+		scanner := bufio.NewReader(os.Stdin)
+
+		for {
+
+			//
+			// Read a line
+			//
+			line, err := scanner.ReadString(byte('\n'))
+			if line == "" && err != nil {
+				return
+			}
+
+			//
+			// Remove any leading/trailing whitespace, and
+			// send it to the UI.
+			//
+			lines <- strings.TrimSpace(line)
 		}
-
-		//
-		// And we're done
-		//
-		fmt.Printf("%s\n", out)
-		return 0
-
-	}
+	}()
 
 	//
-	// We're not running a command, so output the user's choice
+	// Launch the UI
 	//
-	fmt.Printf("%s\n", choice)
-	return 0
+	chooser := chooseui.NewStream(lines)
+	return cs.choose(chooser)
 }
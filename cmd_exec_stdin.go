@@ -2,15 +2,35 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/skx/sysbox/templatedcmd"
 )
 
+// defaultMaxChars is the default limit upon the length of a command
+// when batching, which is the same as that of xargs, and well below the
+// limit imposed by any system we support.
+const defaultMaxChars = 128 * 1024
+
+// pendingPerWorker is the number of commands, for each worker, which
+// may have been started but not yet had their output shown.
+const pendingPerWorker = 16
+
 // Structure for our options and state.
 type execSTDINCommand struct {
 
@@ -25,6 +45,66 @@ type execSTDINCommand struct {
 
 	// field separator
 	split string
+
+	// regular expression, whose named groups may be used as placeholders
+	regex string
+
+	// show output in the order of the input
+	keepOrder bool
+
+	// prefix output with the input
+	tag bool
+
+	// template for the prefix
+	tagTemplate string
+
+	// what to do when a command fails, "now" or "soon"
+	haltOnError string
+
+	// file to record the commands we run
+	joblog string
+
+	// skip the commands recorded in the joblog
+	resume bool
+
+	// skip the commands which succeeded in the joblog
+	resumeFailed bool
+
+	// how long each command may run for
+	timeout time.Duration
+
+	// how many times to retry a command which fails
+	retries int
+
+	// how long to wait before the first retry
+	retryDelay time.Duration
+
+	// records are separated by NUL characters
+	null bool
+
+	// the number of records to run each command with
+	number int
+
+	// the maximum length of a command, when batching
+	maxChars int
+
+	// records are separated by this character
+	delimiter string
+
+	// jlog records the commands we run, if -joblog was given
+	jlog *jobLog
+
+	// tagger is the parsed tagTemplate
+	tagger *templatedcmd.Template
+
+	// stop is closed when no more commands should be started
+	stop chan struct{}
+
+	// stopping ensures we only close stop once
+	stopping sync.Once
+
+	// cancel kills the running commands
+	cancel context.CancelFunc
 }
 
 // Command holds a command we're going to execute in a worker-process.
@@ -32,41 +112,351 @@ type execSTDINCommand struct {
 // (Command in this sense is a system-binary / external process.)
 type Command struct {
 
+	// seq is the number of the command, counting from one, in the
+	// order the input was read.
+	seq int
+
+	// order is the number of the command, counting from one, in the
+	// order the commands were started.  Unlike seq there are no gaps
+	// for commands which were skipped when resuming.
+	order int
+
+	// inputs are the records the command was created from, of
+	// which there might be several if we're batching.
+	inputs []string
+
 	// args holds the command + args to execute.
 	args []string
 }
 
+// Result holds the outcome of running a Command.
+type Result struct {
+
+	// cmd is the command which was run.
+	cmd Command
+
+	// stdout holds the output of the command.
+	stdout []byte
+
+	// stderr holds the error-output of the command.
+	stderr []byte
+
+	// err is set if the command failed.
+	err error
+
+	// halted is true if the command was killed because another
+	// failed, and -halt-on-error=now was given.
+	halted bool
+
+	// start is the time the command was started.
+	start time.Time
+
+	// runtime is how long the command took.
+	runtime time.Duration
+
+	// exit is the exit-code of the command.
+	exit int
+
+	// signal is the number of the signal which killed the command.
+	signal int
+
+	// timedOut is true if the command was killed because it ran
+	// for longer than -timeout.
+	timedOut bool
+
+	// attempts is the number of times the command was run.
+	attempts int
+}
+
 // Arguments adds per-command args to the object.
 func (es *execSTDINCommand) Arguments(f *flag.FlagSet) {
 	f.BoolVar(&es.dryRun, "dry-run", false, "Don't run the command.")
 	f.BoolVar(&es.verbose, "verbose", false, "Be verbose.")
 	f.IntVar(&es.parallel, "parallel", 1, "How many jobs to run in parallel.")
 	f.StringVar(&es.split, "split", "", "Split on a different character.")
+	f.StringVar(&es.regex, "regex", "", "Regular expression whose named groups may be used as {name}.")
+	f.BoolVar(&es.keepOrder, "keep-order", false, "Show the output of the commands in the order of their input.")
+	f.BoolVar(&es.tag, "tag", false, "Prefix each line of output with the input which produced it.")
+	f.StringVar(&es.tagTemplate, "tag-template", "", "Prefix each line of output with this template, expanded as the command is.")
+	f.StringVar(&es.haltOnError, "halt-on-error", "", "If a command fails start no more, and kill those running ('now'), or wait for them ('soon').")
+	f.StringVar(&es.joblog, "joblog", "", "Record the commands which are run in the given file.")
+	f.BoolVar(&es.resume, "resume", false, "Skip the commands recorded in the -joblog file.")
+	f.BoolVar(&es.resumeFailed, "resume-failed", false, "Skip the commands recorded in the -joblog file, unless they failed.")
+	f.DurationVar(&es.timeout, "timeout", 0, "Kill each command, and its children, if it runs for longer than this, e.g. '30s'.")
+	f.IntVar(&es.retries, "retries", 0, "Retry each command which fails up to this many times.")
+	f.DurationVar(&es.retryDelay, "retry-delay", time.Second, "How long to wait before retrying, doubled for each further attempt.")
+	f.IntVar(&es.number, "n", 0, "Run each command with up to this many records, as with 'xargs -n'.")
+	f.IntVar(&es.maxChars, "max-chars", 0, "Limit the length of each command to this many bytes, when running it with several records.")
+	f.BoolVar(&es.null, "0", false, "Records are separated by NUL characters, as written by 'find -print0'.")
+	f.StringVar(&es.delimiter, "d", "", "Records are separated by this character, rather than newlines, e.g. ',' or '\\t'.")
 
 }
 
 // worker reads a command to execute from the channel, and executes it.
 //
-// The result is pushed back, but ignored.
-func (es *execSTDINCommand) worker(id int, jobs <-chan Command, results chan<- int) {
+// The result is pushed back, to be shown by the caller.  If the context
+// is cancelled any running command is killed.
+func (es *execSTDINCommand) worker(ctx context.Context, jobs <-chan Command, results chan<- Result) {
 	for j := range jobs {
 
-		// Run the command, and get the output?
-		cmd := exec.Command(j.args[0], j.args[1:]...)
-		out, errr := cmd.CombinedOutput()
+		// Skip the command if we're halting.
+		select {
+		case <-es.stop:
+			continue
+		default:
+		}
 
-		// error?
-		if errr != nil {
-			fmt.Printf("Error running '%s': %s\n", strings.Join(j.args, " "), errr.Error())
-		} else {
+		r := es.run(ctx, j)
 
-			// Show the output
-			fmt.Printf("%s", out)
+		// Halt if we're supposed to, before we take another job.
+		if r.err != nil && !r.halted && es.haltOnError != "" {
+			es.halt()
 		}
 
 		// Send a result to our output channel.
-		results <- 1
+		results <- r
+	}
+}
+
+// run executes the given command, retrying it if it fails and we've
+// been asked to, and returns the result of the last attempt.
+//
+// Each attempt is recorded in the joblog.
+func (es *execSTDINCommand) run(ctx context.Context, j Command) Result {
+
+	for attempt := 1; ; attempt++ {
+
+		r := es.runOnce(ctx, j)
+		r.attempts = attempt
+
+		if es.jlog != nil {
+			err := es.jlog.write(r)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: failed to write joblog: %s\n", err)
+			}
+		}
+
+		if r.err == nil || r.halted || attempt > es.retries {
+			return r
+		}
+
+		//
+		// Wait before trying again, for longer each time, unless
+		// we're halted while we wait.
+		//
+		delay := es.backoff(attempt)
+		if es.verbose {
+			fmt.Fprintf(os.Stderr, "Retrying '%s' in %s, attempt %d of %d: %s\n",
+				strings.Join(j.args, " "), delay.Round(time.Millisecond), attempt+1, es.retries+1, es.describe(r))
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return r
+		}
+	}
+}
+
+// runOnce executes the given command, collecting its output.
+//
+// The command is run in a process-group of its own, so that the whole
+// group, including any processes it started, can be killed if it runs
+// for too long or if we're halting.
+func (es *execSTDINCommand) runOnce(ctx context.Context, j Command) Result {
+
+	parent := ctx
+	if es.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, es.timeout)
+		defer cancel()
+	}
+
+	// Run the command, collecting the output.
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, j.args[0], j.args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	// Don't wait forever for output from any processes
+	// which escaped the process-group.
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	errr := cmd.Run()
+	runtime := time.Since(start)
+	exit, signal := exitStatus(cmd.ProcessState)
+
+	return Result{
+		cmd:      j,
+		stdout:   stdout.Bytes(),
+		stderr:   stderr.Bytes(),
+		err:      errr,
+		halted:   errr != nil && parent.Err() != nil,
+		timedOut: errr != nil && parent.Err() == nil && ctx.Err() == context.DeadlineExceeded,
+		start:    start,
+		runtime:  runtime,
+		exit:     exit,
+		signal:   signal,
+	}
+}
+
+// backoff returns how long to wait before making the next attempt to
+// run a command which has failed.
+//
+// The delay doubles with each attempt, up to a minute, and is varied by
+// up to half either way so that commands which failed together aren't
+// retried together.
+func (es *execSTDINCommand) backoff(attempt int) time.Duration {
+
+	delay := es.retryDelay
+	for i := 1; i < attempt && delay < time.Minute; i++ {
+		delay *= 2
+	}
+	delay = min(delay, time.Minute)
+
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
+
+// describe returns a description of the way in which a command failed.
+func (es *execSTDINCommand) describe(r Result) string {
+	if r.timedOut {
+		return fmt.Sprintf("timed out after %s", es.timeout)
+	}
+	return r.err.Error()
+}
+
+// stopStarting prevents any more commands from being started.
+func (es *execSTDINCommand) stopStarting() {
+	es.stopping.Do(func() {
+		close(es.stop)
+	})
+}
+
+// halt prevents any more commands from being started, and kills those
+// which are running if -halt-on-error=now was given.
+func (es *execSTDINCommand) halt() {
+	es.stopStarting()
+	if es.haltOnError == "now" {
+		es.cancel()
+	}
+}
+
+// recordDelimiter returns the character which separates our records.
+//
+// The delimiter may be given as a single character, or as an escape
+// sequence such as "\t", "\0", or "\x1e".
+func (es *execSTDINCommand) recordDelimiter() (byte, error) {
+
+	if es.null {
+		return 0, nil
+	}
+
+	switch es.delimiter {
+	case "":
+		return '\n', nil
+	case "\\0":
+		return 0, nil
+	}
+
+	d := es.delimiter
+	if strings.HasPrefix(d, "\\") {
+		var err error
+		d, err = strconv.Unquote("\"" + d + "\"")
+		if err != nil {
+			return 0, fmt.Errorf("'%s' is not a valid escape sequence", es.delimiter)
+		}
+	}
+
+	if len(d) != 1 {
+		return 0, fmt.Errorf("'%s' is not a single character", es.delimiter)
+	}
+	return d[0], nil
+}
+
+// commandLength returns the number of bytes the given command occupies
+// when it is executed, which is limited by the system.
+func commandLength(args []string) int {
+	length := 0
+	for _, arg := range args {
+		length += len(arg) + 1
+	}
+	return length
+}
+
+// read sends each record read from the given input to the channel,
+// without its delimiter, and closes the channel at the end of the input.
+func (es *execSTDINCommand) read(in io.Reader, delim byte, records chan<- string) {
+
+	defer close(records)
+
+	reader := bufio.NewReader(in)
+	for {
+		record, err := reader.ReadString(delim)
+		record = strings.TrimSuffix(record, string(delim))
+
+		//
+		// The last record mightn't be followed by a delimiter.
+		//
+		if err == nil || record != "" {
+			records <- record
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "error: failed to read STDIN: %s\n", err)
+			}
+			return
+		}
+	}
+}
+
+// show displays the output of a command, with any error-output going
+// to STDERR, prefixing each line if we're tagging.
+func (es *execSTDINCommand) show(r Result) {
+
+	prefix := ""
+	if es.tagger != nil {
+		prefix = strings.Join(es.tagger.ExpandAll(r.cmd.inputs, es.split), " ") + "\t"
+	} else if es.tag {
+		var inputs []string
+		for _, input := range r.cmd.inputs {
+			inputs = append(inputs, strings.TrimSpace(input))
+		}
+		prefix = strings.Join(inputs, " ") + "\t"
+	}
+
+	os.Stdout.Write(prefixLines(r.stdout, prefix))
+	os.Stderr.Write(prefixLines(r.stderr, prefix))
+
+	// error?
+	if r.err != nil && !r.halted {
+		fmt.Fprintf(os.Stderr, "Error running '%s': %s\n", strings.Join(r.cmd.args, " "), es.describe(r))
+	}
+}
+
+// prefixLines adds the given prefix to each line of the output.
+func prefixLines(out []byte, prefix string) []byte {
+
+	if prefix == "" || len(out) == 0 {
+		return out
+	}
+
+	var buf bytes.Buffer
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		buf.WriteString(prefix)
+		buf.WriteString(line)
+		buf.WriteString("\n")
 	}
+	return buf.Bytes()
 }
 
 // Info returns the name of this subcommand.
@@ -78,6 +468,9 @@ Details:
 This command reads lines from STDIN, and executes the specified command with
 that line as input.
 
+Each command is started as soon as its line has been read, so this works
+with input which never ends, such as that from 'tail -f'.
+
 The line read from STDIN will be available as '{}' and each space-separated
 field will be available as {1}, {2}, etc.
 
@@ -100,6 +493,41 @@ To show all input you'd run:
   foo bar
   bar Steve
 
+The value of '{}' is never split into several arguments, and neither are
+the arguments you supply, so you can run commands such as:
+
+  $ ls | sysbox exec-stdin sh -c 'file {} | grep -q text && wc -l {}'
+
+If you give the command as a single argument it is split into arguments
+with shell-like quoting rules instead:
+
+  $ ls | sysbox exec-stdin 'notify-send "Now playing" {}'
+
+Then a literal '{}' may be written as '\{}', or within single quotes.
+
+Note that earlier releases split each of the arguments on whitespace, so
+'exec-stdin "ls -l" {}' ran 'ls -l', but it now runs a command named 'ls -l'.
+
+Placeholders:
+
+As well as '{}' and '{N}' the command may contain:
+
+  {-N}     The Nth field, counting from the last, so {-1} is the last.
+  {N..M}   Fields N to M, joined by the -split string, or a space.  Either
+           number may be omitted, so {3..} is the third field onwards.
+  {/}      The basename of the line.
+  {//}     The directory-name of the line.
+  {.}      The line without its extension.
+  {/.}     The basename of the line, without its extension.
+  {name}   The text matched by the group named 'name' in the regular
+           expression given with -regex.  Lines which don't match are
+           skipped.
+
+For example:
+
+  $ ls *.jpg | sysbox exec-stdin convert {} {.}.png
+  $ cat /etc/passwd | sysbox exec-stdin -regex='^(?P<user>[^:]+):x:(?P<uid>[0-9]+)' echo {user} has uid {uid}
+
 Flags:
 
 If you prefer you can split fields on specific characters, which is useful
@@ -108,25 +536,146 @@ for operating upon CSV files, or in case you wish to split '/etc/passwd' on
 
   $ cat /etc/passwd | sysbox exec-stdin -split=: groups {1}
 
+Input is read a line at a time, but you can use -0 to read records which
+are separated by NUL characters instead, as written by 'find -print0', so
+that filenames containing newlines are handled correctly, or -d to read
+records separated by any other character:
+
+  $ find . -name '*.tmp' -print0 | sysbox exec-stdin -0 rm {}
+  $ echo -n "one,two,three" | sysbox exec-stdin -d , echo {}
+
+Batching:
+
+Running a command for every line can be slow, so if the command contains
+"{+}" it is instead run with as many lines as will fit, and "{+}" expands
+to one argument for each of them; "{}" and "{N}" refer to the first.  Use
+-n to limit the number of lines for each command, and -max-chars to limit
+the length of each command, which is 131072 bytes by default:
+
+  $ find . -name '*.tmp' -print0 | sysbox exec-stdin -0 rm {+}
+  $ cat ids | sysbox exec-stdin -n 100 -parallel 4 upload --ids {+}
+
+If you use -n, or -max-chars, with a command which contains no placeholders
+the lines are appended to it, as 'xargs' does.  A command which uses other
+placeholders, such as "{}", must also contain "{+}".
+
 If you wish you can run the commands in parallel, using the -parallel flag
 to denote how many simultaneous executions are permitted.
 
+The output of each command is shown once it has finished, with its
+error-output going to STDERR.  When running in parallel that means the
+output appears in the order the commands finish, unless you use
+-keep-order to show it in the order of the input:
+
+  $ cat hosts | sysbox exec-stdin -parallel=8 -keep-order ssh {} uptime
+
+To tell which command produced which output use -tag, to prefix each line
+of output with the input, or -tag-template to prefix it with a template
+which is expanded in the same way as the command:
+
+  $ cat hosts | sysbox exec-stdin -parallel=8 -tag-template='[{1}]' ssh {} uptime
+
+By default every command is run, even if some fail, but with
+-halt-on-error=soon no more will be started after a failure, and with
+-halt-on-error=now those which are running will be killed too.
+
+Use -timeout to kill any command, along with any processes it started,
+which runs for longer than the given duration, such as '30s' or '5m'.  Use
+-retries to run a command which fails, or times out, again; the first
+retry happens after -retry-delay, one second by default, and the delay
+doubles for each further attempt, varying at random by up to half:
+
+  $ cat urls | sysbox exec-stdin -timeout=30s -retries=3 curl -fsO {}
+
+If any commands fail, and -timeout or -retries were given, a summary of
+how many timed out, and how many exited with an error, is shown at the
+end.  With -verbose each retry is reported as it happens.
+
+The exit-code is the number of commands which failed, up to 101, so zero
+means that every command succeeded.  If you interrupt exec-stdin the
+running commands are killed, and the exit-code is 130.
+
+Job Logs:
+
+With -joblog each command is recorded in the given file once it has
+finished, along with the time it started, how long it took, and its
+exit-code, in the same tab-separated format as GNU parallel.  Commands
+which time out are recorded as killed by signal 9, and each attempt to run
+a command which is retried is recorded.
+
+If a run is interrupted you may then run the same command again, with the
+same input, adding -resume to skip the commands which were recorded, or
+-resume-failed to skip only those which succeeded:
+
+  $ sysbox exec-stdin -joblog=upgrade.log ssh {} apt-get upgrade -y < hosts
+  ^C
+  $ sysbox exec-stdin -joblog=upgrade.log -resume-failed ssh {} apt-get upgrade -y < hosts
+
+Commands are identified by their position in the input, so the input must
+not have changed.  When resuming new entries are appended to the joblog.
+
 The only other flag is '-verbose', to show the command that would be
 executed and '-dry-run' to avoid running anything.`
 }
 
-// Execute is invoked if the user specifies `exec-stdin` as the subcommand.
-func (es *execSTDINCommand) Execute(args []string) int {
+// batchTemplate returns the template for the commands we run, and true
+// if each is to be run with a batch of records rather than a single one.
+//
+// We batch if the command refers to "{+}", or if we've been given a
+// number of records or a length.  If the command doesn't say where the
+// records go they're appended to it, as with xargs, but a command which
+// refers to the records in any other way must use "{+}".
+func (es *execSTDINCommand) batchTemplate(cmd string, tmpl *templatedcmd.Template, re *regexp.Regexp) (*templatedcmd.Template, bool, error) {
 
-	//
-	// Join all arguments, in case we have been given "{1}", "{2}", etc.
-	//
-	cmd := ""
+	if es.number < 0 || es.maxChars < 0 {
+		return nil, false, fmt.Errorf("-n and -max-chars must not be negative")
+	}
+
+	if tmpl.UsesAll() {
+		return tmpl, true, nil
+	}
+	if es.number == 0 && es.maxChars == 0 {
+		return tmpl, false, nil
+	}
+
+	if tmpl.UsesInput() {
+		return nil, false, fmt.Errorf("-n and -max-chars require the command to use {+}, if it uses other placeholders")
+	}
+
+	tmpl, err := templatedcmd.Parse(cmd + " {+}")
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid command: %s", err)
+	}
+	tmpl.SetRegexp(re)
+	return tmpl, true, nil
+}
+
+// commandFromArgs returns the command template described by the given
+// arguments.
+//
+// A single argument is the complete command, which Parse will split
+// with shell-like quoting rules.
+//
+// Otherwise the arguments have already been split by the shell, so we
+// quote each of them, to keep them intact, and join them.
+func commandFromArgs(args []string) string {
+
+	if len(args) == 1 {
+		return args[0]
+	}
 
+	cmd := ""
 	for _, arg := range args {
-		cmd += arg
+		cmd += templatedcmd.Quote(arg)
 		cmd += " "
 	}
+	return cmd
+}
+
+// Execute is invoked if the user specifies `exec-stdin` as the subcommand.
+func (es *execSTDINCommand) Execute(args []string) int {
+
+	cmd := commandFromArgs(args)
 
 	//
 	// Ensure we have a command.
@@ -137,78 +686,379 @@ func (es *execSTDINCommand) Execute(args []string) int {
 	}
 
 	//
-	// Prepare to read line-by-line
+	// Parse the command, so that we can report mistakes before
+	// we start reading.
 	//
-	scanner := bufio.NewReader(os.Stdin)
+	tmpl, err := templatedcmd.Parse(cmd)
+	if err != nil {
+		fmt.Printf("error: invalid command: %s\n", err)
+		return 1
+	}
+	if len(tmpl.Expand("", "")) == 0 {
+		fmt.Printf("Usage: sysbox exec-stdin command .. args {}..\n")
+		return 1
+	}
 
 	//
-	// The jobs we're going to add.
+	// If we have a regular expression its named groups may be
+	// used in the command.
 	//
-	// We save these away so that we can allow parallel execution later.
+	var re *regexp.Regexp
+	if es.regex != "" {
+		re, err = regexp.Compile(es.regex)
+		if err != nil {
+			fmt.Printf("error: invalid -regex: %s\n", err)
+			return 1
+		}
+		tmpl.SetRegexp(re)
+	}
+
 	//
-	var toRun []Command
+	// Decide whether we're running each command with a batch of
+	// records, rather than a single one.
+	//
+	tmpl, batching, err := es.batchTemplate(cmd, tmpl, re)
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		return 1
+	}
+
+	maxChars := es.maxChars
+	if maxChars == 0 {
+		maxChars = defaultMaxChars
+	}
+
+	if es.tagTemplate != "" {
+		es.tagger, err = templatedcmd.Parse(es.tagTemplate)
+		if err != nil {
+			fmt.Printf("error: invalid -tag-template: %s\n", err)
+			return 1
+		}
+		es.tagger.SetRegexp(re)
+	}
+
+	switch es.haltOnError {
+	case "", "now", "soon":
+	default:
+		fmt.Printf("error: -halt-on-error must be 'now' or 'soon', not '%s'\n", es.haltOnError)
+		return 1
+	}
+
+	if es.parallel < 1 {
+		es.parallel = 1
+	}
+
+	delim, err := es.recordDelimiter()
+	if err != nil {
+		fmt.Printf("error: invalid -d: %s\n", err)
+		return 1
+	}
 
 	//
-	// Read a line
+	// If we're resuming then find the commands which were already
+	// run, and which of them succeeded.
 	//
-	line, err := scanner.ReadString(byte('\n'))
-	for err == nil && line != "" {
+	resuming := es.resume || es.resumeFailed
+	if resuming && es.joblog == "" {
+		fmt.Printf("error: -resume and -resume-failed require -joblog\n")
+		return 1
+	}
+
+	var done map[int]bool
+	if resuming {
+		done, err = readJobLog(es.joblog)
+		if err != nil {
+			fmt.Printf("error: failed to read joblog: %s\n", err)
+			return 1
+		}
+	}
+
+	//
+	// skip returns true if the command with the given sequence
+	// number has already been run.
+	//
+	skip := func(seq int) bool {
+		ok, found := done[seq]
+		if es.resumeFailed {
+			return found && ok
+		}
+		return found
+	}
+
+	if es.joblog != "" && !es.dryRun {
+		es.jlog, err = openJobLog(es.joblog, resuming)
+		if err != nil {
+			fmt.Printf("error: failed to open joblog: %s\n", err)
+			return 1
+		}
+		defer es.jlog.Close()
+	}
+
+	//
+	// Cancelling the context kills any running commands, and
+	// closing stop prevents any more from being started, see halt.
+	//
+	// If we're interrupted we do both, since commands run in
+	// process-groups of their own and won't see the interrupt.
+	//
+	interrupted, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	ctx, cancel := context.WithCancel(interrupted)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		es.stopStarting()
+	}()
+
+	es.cancel = cancel
+	es.stop = make(chan struct{})
+
+	jobs := make(chan Command)
+	results := make(chan Result)
+
+	//
+	// Each command we start takes a slot, which is released once
+	// its output has been shown.  This limits the memory we use
+	// when keeping the output in order, and one command is slow.
+	//
+	slots := make(chan struct{}, es.parallel*pendingPerWorker)
+
+	//
+	// Launch the appropriate number of parallel workers.
+	//
+	var wg sync.WaitGroup
+	for w := 1; w <= es.parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			es.worker(ctx, jobs, results)
+		}()
+	}
+
+	//
+	// Read records in the background, so that we can stop starting
+	// commands even while we're waiting for more input.
+	//
+	records := make(chan string)
+	go es.read(os.Stdin, delim, records)
+
+	//
+	// Create a command for each record, or batch of records, and
+	// hand it to a worker as soon as one is free, unless we're told
+	// to stop.
+	//
+	go func() {
+		defer close(jobs)
 
 		//
-		// Create the command to execute
+		// The sequence number of each command, and the order in
+		// which we started them.
 		//
-		run := templatedcmd.Expand(cmd, line, es.split)
+		seq := 0
+		order := 0
 
 		//
-		// Show command if being verbose
+		// The records for the next command, and the length of
+		// that command if we're batching.
 		//
-		if es.verbose || es.dryRun {
-			fmt.Printf("%s\n", strings.Join(run, " "))
-		}
+		var batch []string
+		length := 0
 
 		//
-		// If we're not in "pretend"-mode then we'll save the
-		// constructed command away.
+		// emit starts the command for the current batch, and
+		// returns false if we've been told to stop.
 		//
-		if !es.dryRun {
-			toRun = append(toRun, Command{args: run})
+		emit := func() bool {
+
+			inputs := batch
+			batch = nil
+
+			//
+			// Skip the commands we've already run, if
+			// we're resuming.
+			//
+			seq++
+			if skip(seq) {
+				return true
+			}
+
+			//
+			// Create the command to execute
+			//
+			run := tmpl.ExpandAll(inputs, es.split)
+
+			//
+			// Show command if being verbose
+			//
+			if es.verbose || es.dryRun {
+				fmt.Printf("%s\n", strings.Join(run, " "))
+			}
+
+			//
+			// If we're in "pretend"-mode that's all.
+			//
+			if es.dryRun {
+				return true
+			}
+
+			order++
+			j := Command{seq: seq, order: order, inputs: inputs, args: run}
+
+			select {
+			case slots <- struct{}{}:
+			case <-es.stop:
+				return false
+			}
+			select {
+			case jobs <- j:
+				return true
+			case <-es.stop:
+				return false
+			}
+		}
+
+		for {
+			var record string
+			var ok bool
+
+			select {
+			case record, ok = <-records:
+			case <-es.stop:
+				return
+			}
+			if !ok {
+				break
+			}
+
+			//
+			// Records which don't match our regular expression
+			// are skipped.
+			//
+			if re != nil && !re.MatchString(strings.TrimSpace(record)) {
+				continue
+			}
+
+			if !batching {
+				batch = []string{record}
+				if !emit() {
+					return
+				}
+				continue
+			}
+
+			//
+			// Each record adds itself, and a separator, to the
+			// command for every "{+}" in the template.
+			//
+			cost := tmpl.AllCount() * (len(strings.TrimSpace(record)) + 1)
+
+			//
+			// Start the current batch if this record won't fit.
+			//
+			if len(batch) > 0 && length+cost > maxChars {
+				if !emit() {
+					return
+				}
+			}
+
+			if len(batch) == 0 {
+				length = commandLength(tmpl.Expand(record, es.split))
+			} else {
+				length += cost
+			}
+			batch = append(batch, record)
+
+			if es.number > 0 && len(batch) >= es.number {
+				if !emit() {
+					return
+				}
+			}
 		}
 
 		//
-		// Loop again
+		// Start the final batch.
 		//
-		line, err = scanner.ReadString(byte('\n'))
-	}
+		if len(batch) > 0 {
+			emit()
+		}
+	}()
 
 	//
-	// We've built up all the commands we're going to run now.
+	// Once all the workers have finished there are no more results.
 	//
-	// Get the number, and create suitable channels.
-	//
-	num := len(toRun)
-	jobs := make(chan Command, num)
-	results := make(chan int, num)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
 	//
-	// Launch the appropriate number of parallel workers.
+	// Await all the results.
 	//
-	for w := 1; w <= es.parallel; w++ {
-		go es.worker(w, jobs, results)
+	// If we're keeping the order then results are held until all
+	// those before them have been shown.
+	//
+	failed := 0
+	timedOut := 0
+	pending := make(map[int]Result)
+	next := 1
+
+	for r := range results {
+
+		if r.err != nil && !r.halted {
+			failed++
+			if r.timedOut {
+				timedOut++
+			}
+		}
+
+		if !es.keepOrder {
+			es.show(r)
+			<-slots
+			continue
+		}
+
+		pending[r.cmd.order] = r
+		for {
+			p, ok := pending[next]
+			if !ok {
+				break
+			}
+			es.show(p)
+			<-slots
+			delete(pending, next)
+			next++
+		}
 	}
 
 	//
-	// Add all the pending jobs.
+	// If we halted there might be results after a gap, for the
+	// commands we never started.
 	//
-	for _, j := range toRun {
-		jobs <- j
+	var remaining []int
+	for order := range pending {
+		remaining = append(remaining, order)
+	}
+	sort.Ints(remaining)
+	for _, order := range remaining {
+		es.show(pending[order])
 	}
-	close(jobs)
 
 	//
-	// Await all the results.
+	// Summarize the failures, if there were any.
 	//
-	for a := 1; a <= num; a++ {
-		<-results
+	if failed > 0 && (timedOut > 0 || es.retries > 0 || es.verbose) {
+		fmt.Fprintf(os.Stderr, "%d command(s) failed: %d timed out, %d exited with an error\n", failed, timedOut, failed-timedOut)
+	}
+
+	if interrupted.Err() != nil {
+		return 130
 	}
-	return 0
+
+	//
+	// The exit-code is the number of commands which failed, as
+	// GNU parallel does, up to a limit.
+	//
+	return min(failed, 101)
 }
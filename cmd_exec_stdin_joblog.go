@@ -0,0 +1,139 @@
+// helper functions for exec-stdin, which record the commands which
+// were run in a joblog, and allow an interrupted run to be resumed.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// jobLogHeader is the first line of a joblog, which is in the same
+// format as that written by GNU parallel.
+const jobLogHeader = "Seq\tHost\tStarttime\tJobRuntime\tSend\tReceive\tExitval\tSignal\tCommand\n"
+
+// jobLog records the commands which have been run.
+type jobLog struct {
+
+	// file is the joblog we're writing to.
+	file *os.File
+
+	// mutex serializes writes from our workers.
+	mutex sync.Mutex
+}
+
+// openJobLog opens the given joblog for writing.
+//
+// If we're resuming the existing entries are kept, and new ones are
+// appended to them, otherwise the file is truncated.
+func openJobLog(path string, resume bool) (*jobLog, error) {
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// Write the header, unless the file already has one.
+	//
+	info, err := file.Stat()
+	if err == nil && info.Size() == 0 {
+		_, err = file.WriteString(jobLogHeader)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &jobLog{file: file}, nil
+}
+
+// write records the result of running a command.
+//
+// Each attempt to run a command is recorded, if it is retried.
+func (j *jobLog) write(r Result) error {
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	start := float64(r.start.UnixMilli()) / 1000
+	_, err := fmt.Fprintf(j.file, "%d\t:\t%.3f\t%10.3f\t0\t0\t%d\t%d\t%s\n",
+		r.cmd.seq, start, r.runtime.Seconds(), r.exit, r.signal,
+		strings.Join(r.cmd.args, " "))
+	return err
+}
+
+// Close closes the joblog.
+func (j *jobLog) Close() error {
+	return j.file.Close()
+}
+
+// readJobLog reads the given joblog, and returns a map of the sequence
+// numbers of the commands it records, with the value true if the
+// command succeeded.
+//
+// If a command is recorded more than once, because it was retried, the
+// last entry is used.  A joblog which doesn't exist is treated as if
+// it were empty.
+func readJobLog(path string) (map[int]bool, error) {
+
+	done := make(map[int]bool)
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return done, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		fields := strings.SplitN(scanner.Text(), "\t", 9)
+		if len(fields) < 8 || (line == 1 && fields[0] == "Seq") {
+			continue
+		}
+
+		seq, errs := strconv.Atoi(fields[0])
+		exit, erre := strconv.Atoi(fields[6])
+		signal, errg := strconv.Atoi(fields[7])
+		if errs != nil || erre != nil || errg != nil {
+			return nil, fmt.Errorf("%s:%d: malformed joblog entry", path, line)
+		}
+		done[seq] = exit == 0 && signal == 0
+	}
+	return done, scanner.Err()
+}
+
+// exitStatus returns the exit-code of a command, and the number of the
+// signal which killed it, if any, in the same way as GNU parallel.
+//
+// If the command couldn't be started at all the exit-code is 255.
+func exitStatus(state *os.ProcessState) (int, int) {
+
+	if state == nil {
+		return 255, 0
+	}
+
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if ok && ws.Signaled() {
+		return 0, int(ws.Signal())
+	}
+	return state.ExitCode(), 0
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/skx/sysbox/templatedcmd"
+)
+
+// TestBatchTemplate tests deciding whether commands are run with a
+// batch of records, and where those records go.
+func TestBatchTemplate(t *testing.T) {
+
+	type TestCase struct {
+		command  string
+		regex    string
+		number   int
+		maxChars int
+		batching bool
+		expected string
+	}
+
+	tests := []TestCase{
+
+		// Without {+}, -n, or -max-chars we don't batch.
+		{command: "echo {}", expected: "echo a"},
+		{command: "echo", expected: "echo"},
+
+		// {+} always batches.
+		{command: "rm {+}", batching: true, expected: "rm a b c"},
+		{command: "cp {+} {}", batching: true, expected: "cp a b c a"},
+		{command: "echo {} {+}", number: 1, batching: true, expected: "echo a a b c"},
+
+		// -n and -max-chars batch, appending the records if the
+		// command doesn't say where they go.
+		{command: "echo X", number: 1, batching: true, expected: "echo X a b c"},
+		{command: "echo X", number: 2, batching: true, expected: "echo X a b c"},
+		{command: "echo X", maxChars: 100, batching: true, expected: "echo X a b c"},
+		{command: "echo '{}'", number: 2, batching: true, expected: "echo {} a b c"},
+		{command: "awk {print}", number: 2, batching: true, expected: "awk {print} a b c"},
+		{command: "echo {user}", regex: "(?P<id>.*)", number: 2, batching: true, expected: "echo {user} a b c"},
+	}
+
+	for _, test := range tests {
+
+		tmpl, err := templatedcmd.Parse(test.command)
+		if err != nil {
+			t.Fatalf("unexpected error parsing '%s': %s", test.command, err)
+		}
+
+		var re *regexp.Regexp
+		if test.regex != "" {
+			re = regexp.MustCompile(test.regex)
+			tmpl.SetRegexp(re)
+		}
+
+		es := &execSTDINCommand{number: test.number, maxChars: test.maxChars}
+		out, batching, err := es.batchTemplate(test.command, tmpl, re)
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': %s", test.command, err)
+		}
+		if batching != test.batching {
+			t.Fatalf("expected batching to be %t for '%s'", test.batching, test.command)
+		}
+
+		inputs := []string{"a"}
+		if batching {
+			inputs = []string{"a", "b", "c"}
+		}
+		result := strings.Join(out.ExpandAll(inputs, ""), " ")
+		if result != test.expected {
+			t.Fatalf("expected '%s' for '%s', got '%s'", test.expected, test.command, result)
+		}
+	}
+}
+
+// TestBatchTemplateErrors tests the combinations of flags and commands
+// which we reject.
+func TestBatchTemplateErrors(t *testing.T) {
+
+	type TestCase struct {
+		command  string
+		regex    string
+		number   int
+		maxChars int
+		error    string
+	}
+
+	tests := []TestCase{
+		{command: "echo {}", number: 1, error: "require the command to use {+}"},
+		{command: "echo {1}", number: 2, error: "require the command to use {+}"},
+		{command: "echo {/.}", maxChars: 100, error: "require the command to use {+}"},
+		{command: "echo {user}", regex: "(?P<user>.*)", number: 2, error: "require the command to use {+}"},
+		{command: "echo {+}", number: -1, error: "must not be negative"},
+		{command: "echo", maxChars: -1, error: "must not be negative"},
+	}
+
+	for _, test := range tests {
+
+		tmpl, err := templatedcmd.Parse(test.command)
+		if err != nil {
+			t.Fatalf("unexpected error parsing '%s': %s", test.command, err)
+		}
+
+		var re *regexp.Regexp
+		if test.regex != "" {
+			re = regexp.MustCompile(test.regex)
+			tmpl.SetRegexp(re)
+		}
+
+		es := &execSTDINCommand{number: test.number, maxChars: test.maxChars}
+		_, _, err = es.batchTemplate(test.command, tmpl, re)
+		if err == nil {
+			t.Fatalf("expected error for '%s', found none", test.command)
+		}
+		if !strings.Contains(err.Error(), test.error) {
+			t.Fatalf("expected error '%s' for '%s', found '%s'", test.error, test.command, err)
+		}
+	}
+}
+
+// TestCommandFromArgs tests building the command from our arguments, which
+// are only split if there is a single one.
+func TestCommandFromArgs(t *testing.T) {
+
+	type TestCase struct {
+		args     []string
+		expected []string
+	}
+
+	tests := []TestCase{
+		{args: []string{"ls -l {}"}, expected: []string{"ls", "-l", "a b"}},
+		{args: []string{"ls", "-l", "{}"}, expected: []string{"ls", "-l", "a b"}},
+
+		// Several arguments are never split, which is a change
+		// from earlier releases.
+		{args: []string{"ls -l", "{}"}, expected: []string{"ls -l", "a b"}},
+		{args: []string{"sh", "-c", "wc -l {}"}, expected: []string{"sh", "-c", "wc -l a b"}},
+		{args: []string{"echo", "it's", `"{}"`}, expected: []string{"echo", "it's", `"a b"`}},
+		{args: []string{"echo", "", "{}"}, expected: []string{"echo", "", "a b"}},
+	}
+
+	for _, test := range tests {
+
+		tmpl, err := templatedcmd.Parse(commandFromArgs(test.args))
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", test.args, err)
+		}
+
+		out := tmpl.Expand("a b", "")
+		if strings.Join(out, "\x00") != strings.Join(test.expected, "\x00") {
+			t.Fatalf("expected %q for %q, got %q", test.expected, test.args, out)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// parse.go - Contains the parser which splits a template into the
+// words of a command-line, using shell-like quoting rules.
+
+package templatedcmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// placeholderRegexp matches the names of the placeholders we expand,
+// such as "{}", "{+}", "{N}", "{N..M}", "{/}", and "{name}", without
+// their braces.
+var placeholderRegexp = regexp.MustCompile(`^(\+|-?[0-9]+|(-?[0-9]+)?\.\.(-?[0-9]+)?|/|//|\.|/\.|[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// identifierRegexp matches the names of named placeholders, which are
+// expanded from the groups of a regular expression.
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// segment is a piece of a word, which is either literal text or the
+// name of a placeholder.
+type segment struct {
+
+	// text is the literal text, or the name of the placeholder.
+	text string
+
+	// placeholder is true if this segment is to be expanded.
+	placeholder bool
+}
+
+// word is a single word of a template, which becomes one argument
+// of the command.
+type word struct {
+
+	// segments are the pieces of the word.
+	segments []segment
+
+	// quoted is true if any part of the word was quoted.
+	quoted bool
+}
+
+// Template is a parsed command-line template.
+type Template struct {
+
+	// words are the words of the command-line.
+	words []word
+
+	// re is matched against the input, to find the values of
+	// named placeholders.
+	re *regexp.Regexp
+}
+
+// SetRegexp sets a regular expression which is matched against the
+// input when the template is expanded, so that "{name}" expands to the
+// text matched by the group named "name".
+//
+// If the input doesn't match the named placeholders expand to nothing.
+func (t *Template) SetRegexp(re *regexp.Regexp) {
+	t.re = re
+}
+
+// Parse parses the given template into the words of a command-line.
+//
+// Words are separated by whitespace, and may be quoted as they would
+// be in a POSIX shell:
+//
+//   - Text within single quotes is used literally.
+//   - Text within double quotes is used literally, except that a
+//     backslash escapes a following backslash, double quote, or brace.
+//   - Outside quotes a backslash escapes the following character.
+//
+// Placeholders such as "{}" are expanded outside quotes, and within
+// double quotes, so "\{}" or '{}' may be used for a literal "{}".
+//
+// An error is returned if a quote is not terminated, or if the
+// template ends with a backslash.
+func Parse(template string) (*Template, error) {
+
+	t := &Template{}
+
+	//
+	// The word we're building, and whether we've started one.
+	//
+	var cur word
+	started := false
+	var text strings.Builder
+
+	//
+	// Append the literal text we've collected to the current word.
+	//
+	flush := func() {
+		if text.Len() > 0 {
+			cur.segments = append(cur.segments, segment{text: text.String()})
+			text.Reset()
+		}
+	}
+
+	//
+	// Finish the current word, if we've started one.
+	//
+	finish := func() {
+		flush()
+		if started {
+			t.words = append(t.words, cur)
+		}
+		cur = word{}
+		started = false
+	}
+
+	//
+	// Look for a placeholder at the given offset, and if we find one
+	// add it to the current word, returning the offset after it.
+	//
+	placeholder := func(i int) (int, bool) {
+		end := strings.IndexByte(template[i:], '}')
+		if end < 0 || !placeholderRegexp.MatchString(template[i+1:i+end]) {
+			return i, false
+		}
+		flush()
+		cur.segments = append(cur.segments, segment{text: template[i+1 : i+end], placeholder: true})
+		return i + end + 1, true
+	}
+
+	i := 0
+	for i < len(template) {
+
+		c := template[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			finish()
+			i++
+
+		case c == '\\':
+			if i+1 >= len(template) {
+				return nil, fmt.Errorf("template ends with a backslash")
+			}
+			started = true
+
+			// A backslash before a newline joins the lines.
+			if template[i+1] != '\n' {
+				text.WriteByte(template[i+1])
+			}
+			i += 2
+
+		case c == '\'':
+			end := strings.IndexByte(template[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			started = true
+			cur.quoted = true
+			text.WriteString(template[i+1 : i+1+end])
+			i += end + 2
+
+		case c == '"':
+			started = true
+			cur.quoted = true
+			i++
+
+			closed := false
+			for i < len(template) && !closed {
+				c = template[i]
+				switch {
+				case c == '"':
+					closed = true
+					i++
+				case c == '\\' && i+1 < len(template) && strings.IndexByte("\\\"{}\n", template[i+1]) >= 0:
+					if template[i+1] != '\n' {
+						text.WriteByte(template[i+1])
+					}
+					i += 2
+				case c == '{':
+					next, ok := placeholder(i)
+					if !ok {
+						text.WriteByte(c)
+						next = i + 1
+					}
+					i = next
+				default:
+					text.WriteByte(c)
+					i++
+				}
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+
+		case c == '{':
+			started = true
+			next, ok := placeholder(i)
+			if !ok {
+				text.WriteByte(c)
+				next = i + 1
+			}
+			i = next
+
+		default:
+			started = true
+			text.WriteByte(c)
+			i++
+		}
+	}
+	finish()
+
+	return t, nil
+}
+
+// Quote returns the given text quoted such that Parse treats it as a
+// single word, which is useful when building a template from arguments
+// which have already been split.
+//
+// Placeholders within the text are still expanded.
+func Quote(text string) string {
+
+	if text == "" {
+		return "''"
+	}
+
+	var out strings.Builder
+	for _, c := range text {
+		if strings.ContainsRune("\\'\" \t\n", c) {
+			out.WriteByte('\\')
+		}
+		out.WriteRune(c)
+	}
+	return out.String()
+}
+
+// UsesAll returns true if the template refers to "{+}".
+func (t *Template) UsesAll() bool {
+	return t.AllCount() > 0
+}
+
+// AllCount returns the number of times the template refers to "{+}",
+// which is how many times each input appears in its expansion.
+func (t *Template) AllCount() int {
+	count := 0
+	for _, w := range t.words {
+		for _, s := range w.segments {
+			if s.placeholder && s.text == "+" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// UsesInput returns true if the template contains any placeholder which
+// expands to its input, or a part of it.
+//
+// A "{name}" only counts if the regular expression, if we have one,
+// contains a group of that name, since otherwise it is used literally.
+func (t *Template) UsesInput() bool {
+	for _, w := range t.words {
+		for _, s := range w.segments {
+			if s.placeholder && t.known(s.text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// known returns true if the given name is that of a placeholder which
+// we will expand.
+func (t *Template) known(name string) bool {
+	if name == "" || !identifierRegexp.MatchString(name) {
+		return true
+	}
+	return t.re != nil && t.re.SubexpIndex(name) >= 0
+}
+
+// all returns true if the word is an unquoted "{+}", which expands to
+// one argument for each input.
+func (w word) all() bool {
+	return !w.quoted && len(w.segments) == 1 && w.segments[0].placeholder && w.segments[0].text == "+"
+}
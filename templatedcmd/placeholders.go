@@ -0,0 +1,176 @@
+// placeholders.go - Contains the code which works out the value each
+// placeholder expands to.
+
+package templatedcmd
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// expansion holds the values which the placeholders of a template are
+// expanded from.
+type expansion struct {
+
+	// input is the first input, which "{}" expands to.
+	input string
+
+	// all holds all the inputs, which "{+}" expands to.
+	all []string
+
+	// fields holds the fields of the first input.
+	fields []string
+
+	// sep is the string used to join a range of fields.
+	sep string
+
+	// captures holds the named groups matched by the regular
+	// expression, if there is one.
+	captures map[string]string
+}
+
+// newExpansion returns the values for the given inputs, which have
+// already been trimmed.
+func newExpansion(all []string, split string, re *regexp.Regexp) *expansion {
+
+	e := &expansion{all: all, sep: split}
+	if len(all) > 0 {
+		e.input = all[0]
+	}
+	if e.sep == "" {
+		e.sep = " "
+	}
+	e.fields = Fields(e.input, split)
+
+	if re != nil {
+		e.captures = make(map[string]string)
+		match := re.FindStringSubmatch(e.input)
+		for i, name := range re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			e.captures[name] = ""
+			if match != nil {
+				e.captures[name] = match[i]
+			}
+		}
+	}
+	return e
+}
+
+// value returns the value of the named placeholder.
+//
+// A name which isn't that of a placeholder we know, such as a named
+// group which the regular expression doesn't contain, expands to
+// itself, braces and all.
+func (e *expansion) value(name string) string {
+
+	switch name {
+	case "":
+		return e.input
+	case "+":
+		return strings.Join(e.all, " ")
+	case "/":
+		if e.input == "" {
+			return ""
+		}
+		return filepath.Base(e.input)
+	case "//":
+		if e.input == "" {
+			return ""
+		}
+		return filepath.Dir(e.input)
+	case ".":
+		return withoutExtension(e.input)
+	case "/.":
+		if e.input == "" {
+			return ""
+		}
+		return withoutExtension(filepath.Base(e.input))
+	}
+
+	//
+	// "{N}", or "{-N}" counting from the last field.
+	//
+	num, err := strconv.Atoi(name)
+	if err == nil {
+		num = e.index(num)
+		if num >= 1 && num <= len(e.fields) {
+			return e.fields[num-1]
+		}
+		//
+		// Otherwise it's a field that doesn't
+		// exist.  So it's replaced with ''.
+		//
+		return ""
+	}
+
+	//
+	// "{N..M}", where either end may be omitted.
+	//
+	if from, to, ok := strings.Cut(name, ".."); ok {
+		return e.fieldRange(from, to)
+	}
+
+	if val, ok := e.captures[name]; ok {
+		return val
+	}
+	return "{" + name + "}"
+}
+
+// index converts a field number, which counts from the end if it is
+// negative, into one which counts from one.
+func (e *expansion) index(num int) int {
+	if num < 0 {
+		return len(e.fields) + 1 + num
+	}
+	return num
+}
+
+// fieldRange returns the fields from the first number to the second,
+// inclusive, joined by the split-string.
+//
+// The first number defaults to the first field, and the second to the
+// last field.  Fields which don't exist are ignored.
+func (e *expansion) fieldRange(from string, to string) string {
+
+	start, end := 1, len(e.fields)
+
+	if from != "" {
+		num, err := strconv.Atoi(from)
+		if err != nil {
+			return ""
+		}
+		start = e.index(num)
+	}
+	if to != "" {
+		num, err := strconv.Atoi(to)
+		if err != nil {
+			return ""
+		}
+		end = e.index(num)
+	}
+
+	start = max(start, 1)
+	end = min(end, len(e.fields))
+	if start > end {
+		return ""
+	}
+	return strings.Join(e.fields[start-1:end], e.sep)
+}
+
+// withoutExtension removes the extension from the last element of the
+// given path.
+//
+// Names which begin with a period, such as ".bashrc", are not considered
+// to have an extension.
+func withoutExtension(path string) string {
+
+	ext := filepath.Ext(path)
+	if ext == filepath.Base(path) {
+		return path
+	}
+	return strings.TrimSuffix(path, ext)
+}
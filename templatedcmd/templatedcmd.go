@@ -13,27 +13,41 @@
 //	# -> "one"
 //
 // All arguments are available via "{}" and "{N}" will refer to the
-// Nth field of the given input.
+// Nth field of the given input.  Other placeholders are:
+//
+//	{-N}     The Nth field, counting from the last.
+//	{N..M}   Fields N to M, joined by the split-string.  Either
+//	         number may be omitted, as in "{3..}".
+//	{/}      The basename of the input.
+//	{//}     The directory-name of the input.
+//	{.}      The input without its extension.
+//	{/.}     The basename of the input, without its extension.
+//	{name}   The group named "name" in the regular expression given
+//	         to SetRegexp.
+//
+// When a command is run for several inputs at once, via ExpandAll,
+// "{+}" will expand to all of them:
+//
+//	$ rm {+}
+//	# -> "rm" "one" "two" "three"
+//
+// Templates are split into arguments with shell-like quoting rules, and
+// the expansion of a placeholder never splits an argument:
+//
+//	$ notify-send "Now playing: {}" '{}' \{}
+//	# -> "notify-send" "Now playing: a file" "{}" "{}"
 package templatedcmd
 
 import (
-	"regexp"
-	"strconv"
 	"strings"
 )
 
-// Expand performs the expansion of the given input, via the supplied
-// template.  As we allow input to be referred to as an array of fields
-// we also let the user specify a split-string here.
+// Fields splits the given input into fields, in the same way that Expand
+// does when it expands "{N}".
 //
-// By default the input is split on whitespace, but you may supply another
-// string instead.
-func Expand(template string, input string, split string) []string {
-
-	//
-	// Regular expression for looking for ${1}, "${2}", "${3}", etc.
-	//
-	reg := regexp.MustCompile("({[0-9]+})")
+// The input is trimmed of leading/trailing spaces, and then split upon
+// whitespace, unless a different split-string is supplied.
+func Fields(input string, split string) []string {
 
 	//
 	// Trim our input of leading/trailing spaces.
@@ -43,77 +57,125 @@ func Expand(template string, input string, split string) []string {
 	//
 	// Default to splitting the input on white-space.
 	//
-	fields := strings.Fields(input)
 	if split != "" {
-		fields = strings.Split(input, split)
+		return strings.Split(input, split)
 	}
+	return strings.Fields(input)
+}
 
-	//
-	// The return-value is an array of strings
-	//
-	cmd := []string{}
+// Select returns the given fields of the input, numbered from one as
+// with "{N}", joined by the split-string, or by a space if that is empty.
+//
+// Fields which don't exist are ignored.
+func Select(input string, split string, fields []int) string {
+
+	all := Fields(input, split)
+
+	sep := split
+	if sep == "" {
+		sep = " "
+	}
+
+	var out []string
+	for _, num := range fields {
+		if num >= 1 && num <= len(all) {
+			out = append(out, all[num-1])
+		}
+	}
+	return strings.Join(out, sep)
+}
+
+// Expand performs the expansion of the given input, via the supplied
+// template.  As we allow input to be referred to as an array of fields
+// we also let the user specify a split-string here.
+//
+// By default the input is split on whitespace, but you may supply another
+// string instead.
+//
+// The template is parsed via Parse, and an error is returned if it is
+// malformed.
+func Expand(template string, input string, split string) ([]string, error) {
+	return ExpandAll(template, []string{input}, split)
+}
+
+// UsesAll returns true if the given template refers to "{+}", and so
+// should be expanded once for all inputs, via ExpandAll, rather than
+// once for each input.
+//
+// A malformed template is reported by Expand, so here it is treated
+// as if it didn't refer to "{+}".
+func UsesAll(template string) bool {
+	t, err := Parse(template)
+	if err != nil {
+		return false
+	}
+	return t.UsesAll()
+}
+
+// ExpandAll performs the expansion of the given template for several
+// inputs at once.
+//
+// An unquoted "{+}", on its own, expands to one argument for each input,
+// otherwise "{+}" expands to all the inputs separated by spaces.  "{}"
+// and "{N}" refer to the first input.
+func ExpandAll(template string, inputs []string, split string) ([]string, error) {
+	t, err := Parse(template)
+	if err != nil {
+		return nil, err
+	}
+	return t.ExpandAll(inputs, split), nil
+}
+
+// Expand performs the expansion of the template for the given input.
+func (t *Template) Expand(input string, split string) []string {
+	return t.ExpandAll([]string{input}, split)
+}
+
+// ExpandAll performs the expansion of the template for several inputs
+// at once, as described for the ExpandAll function.
+//
+// Each word of the template becomes a single argument, no matter what
+// the placeholders within it expand to.
+func (t *Template) ExpandAll(inputs []string, split string) []string {
 
 	//
-	// We'll operate upon a temporary copy of our template,
-	// split into fields.
+	// Trim all of our inputs.
 	//
-	cmdTmp := strings.Fields(template)
+	all := make([]string, len(inputs))
+	for i, in := range inputs {
+		all[i] = strings.TrimSpace(in)
+	}
+
+	e := newExpansion(all, split, t.re)
 
 	//
-	// For each piece of the template-string look for
-	// "{}", and  "{N}", expand appropriately.
+	// The return-value is an array of strings
 	//
-	for _, piece := range cmdTmp {
+	cmd := []string{}
 
-		//
-		// Do we have a "{N}" ?
-		//
-		matches := reg.FindAllStringSubmatch(piece, -1)
+	for _, w := range t.words {
 
 		//
-		// If so for each match, perform the expansion
+		// A lone "{+}" becomes one argument per input.
 		//
-		for _, v := range matches {
-
-			//
-			// Copy the match and remove the {}
-			//
-			// So we just have "1", "3", etc.
-			//
-			match := v[1]
-			match = strings.ReplaceAll(match, "{", "")
-			match = strings.ReplaceAll(match, "}", "")
-
-			//
-			// Convert the string to a number, and if that
-			// worked we'll replace it with the appropriately
-			// numbered field.
-			//
-			num, err := strconv.Atoi(match)
-			if err == nil {
-
-				//
-				// If the field matches then we can replace it
-				//
-				if num >= 1 && num <= len(fields) {
-					piece = strings.ReplaceAll(piece, v[1], fields[num-1])
-				} else {
-					//
-					// Otherwise it's a field that doesn't
-					// exist.  So it's replaced with ''.
-					//
-					piece = strings.ReplaceAll(piece, v[1], "")
-				}
-			}
+		if w.all() {
+			cmd = append(cmd, all...)
+			continue
 		}
 
-		//
-		// Now replace "{}" with the complete argument
-		//
-		piece = strings.ReplaceAll(piece, "{}", input)
+		var piece strings.Builder
+		for _, s := range w.segments {
+
+			if !s.placeholder {
+				piece.WriteString(s.text)
+				continue
+			}
+
+			piece.WriteString(e.value(s.text))
+		}
 
 		// And append
-		cmd = append(cmd, piece)
+		cmd = append(cmd, piece.String())
 	}
 
 	//
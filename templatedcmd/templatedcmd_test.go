@@ -1,6 +1,8 @@
 package templatedcmd
 
 import (
+	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -25,7 +27,10 @@ func TestBasic(t *testing.T) {
 
 	for _, test := range tests {
 
-		out := Expand(test.template, test.input, test.split)
+		out, err := Expand(test.template, test.input, test.split)
+		if err != nil {
+			t.Fatalf("unexpected error expanding '%s': %s", test.template, err)
+		}
 
 		if len(out) != len(test.expected) {
 			t.Fatalf("Expected to have %d pieces, found %d", len(test.expected), len(out))
@@ -39,3 +44,291 @@ func TestBasic(t *testing.T) {
 		}
 	}
 }
+
+// TestExpandAll tests expanding a template for several inputs.
+func TestExpandAll(t *testing.T) {
+
+	type TestCase struct {
+		template string
+		inputs   []string
+		expected []string
+	}
+
+	tests := []TestCase{
+		{"rm {+}", []string{"a b", " c "}, []string{"rm", "a b", "c"}},
+		{"echo --files={+}", []string{"a", "b"}, []string{"echo", "--files=a b"}},
+		{"echo {} {1}", []string{"a b", "c"}, []string{"echo", "a b", "a"}},
+		{"echo {+} {}", []string{}, []string{"echo", ""}},
+		{"echo \"{+}\"", []string{"a", "b"}, []string{"echo", "a b"}},
+	}
+
+	for _, test := range tests {
+
+		out, err := ExpandAll(test.template, test.inputs, "")
+		if err != nil {
+			t.Fatalf("unexpected error expanding '%s': %s", test.template, err)
+		}
+
+		if len(out) != len(test.expected) {
+			t.Fatalf("Expected to have %d pieces, found %d: %v", len(test.expected), len(out), out)
+		}
+
+		for i, x := range test.expected {
+
+			if out[i] != x {
+				t.Errorf("expected '%s' for piece %d, got '%s'", x, i, out[i])
+			}
+		}
+	}
+
+	if !UsesAll("rm {+}") || UsesAll("rm {}") || UsesAll("rm '{+}'") || UsesAll("rm '{+}") {
+		t.Fatalf("UsesAll returned the wrong result")
+	}
+
+	tmpl, err := Parse(`cp {+} "--also={+}" \{+} {}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tmpl.AllCount() != 2 {
+		t.Fatalf("AllCount returned %d, not 2", tmpl.AllCount())
+	}
+}
+
+// TestQuoting tests that templates are split into arguments with
+// shell-like quoting rules.
+func TestQuoting(t *testing.T) {
+
+	type TestCase struct {
+		template string
+		input    string
+		expected []string
+	}
+
+	tests := []TestCase{
+		{`notify-send "Now playing" {}`, "a b", []string{"notify-send", "Now playing", "a b"}},
+		{`echo "playing: {}"`, "a  b", []string{"echo", "playing: a  b"}},
+		{`echo 'it''s {}' it\'s`, "x", []string{"echo", "its {}", "it's"}},
+		{`echo \{} "\{}" \{1\}`, "x", []string{"echo", "{}", "{}", "{1}"}},
+		{`echo "a\"b\\c\d"`, "", []string{"echo", `a"b\c\d`}},
+		{`echo "" '' x`, "", []string{"echo", "", "", "x"}},
+		{`awk '{print $1}' {1}x{2}`, "a b", []string{"awk", "{print $1}", "axb"}},
+		{`echo {print} {`, "", []string{"echo", "{print}", "{"}},
+		{"echo a\\\nb", "", []string{"echo", "ab"}},
+		{"  ", "", []string{}},
+	}
+
+	for _, test := range tests {
+
+		out, err := Expand(test.template, test.input, "")
+		if err != nil {
+			t.Fatalf("unexpected error expanding '%s': %s", test.template, err)
+		}
+
+		if len(out) != len(test.expected) {
+			t.Fatalf("Expected to have %d pieces for '%s', found %d: %q", len(test.expected), test.template, len(out), out)
+		}
+
+		for i, x := range test.expected {
+
+			if out[i] != x {
+				t.Errorf("expected '%s' for piece %d of '%s', got '%s'", x, i, test.template, out[i])
+			}
+		}
+	}
+
+	//
+	// Malformed templates are errors.
+	//
+	for _, template := range []string{`echo "foo`, `echo 'foo`, `echo foo\`, `echo "foo\"`} {
+		_, err := Expand(template, "", "")
+		if err == nil {
+			t.Errorf("expected an error expanding '%s'", template)
+		}
+	}
+}
+
+// TestQuote tests that quoted text is parsed as a single word.
+func TestQuote(t *testing.T) {
+
+	args := []string{"sh", "-c", `echo "it's" {1} \ `, "", "{}"}
+
+	var quoted []string
+	for _, arg := range args {
+		quoted = append(quoted, Quote(arg))
+	}
+
+	out, err := Expand(strings.Join(quoted, " "), "a b", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{"sh", "-c", `echo "it's" a \ `, "", "a b"}
+	if len(out) != len(expected) {
+		t.Fatalf("Expected to have %d pieces, found %d: %q", len(expected), len(out), out)
+	}
+	for i, x := range expected {
+		if out[i] != x {
+			t.Errorf("expected '%s' for piece %d, got '%s'", x, i, out[i])
+		}
+	}
+}
+
+// TestPlaceholders tests the placeholders other than "{}" and "{N}".
+func TestPlaceholders(t *testing.T) {
+
+	type TestCase struct {
+		template string
+		input    string
+		split    string
+		expected []string
+	}
+
+	tests := []TestCase{
+		{"echo {-1} {-2} {-5}", "a b c", "", []string{"echo", "c", "b", ""}},
+		{"echo {2..3} {3..} {..2} {-2..}", "a b c d", "", []string{"echo", "b c", "c d", "a b", "c d"}},
+		{"echo {2..3} {3..9} {4..2}", "a:b:c", ":", []string{"echo", "b:c", "c", ""}},
+		{"echo {/} {//} {.} {/.}", "/tmp/dir.d/file.tar.gz", "", []string{"echo", "file.tar.gz", "/tmp/dir.d", "/tmp/dir.d/file.tar", "file.tar"}},
+		{"echo {.} {/.}", "dir.d/.bashrc", "", []string{"echo", "dir.d/.bashrc", ".bashrc"}},
+		{"echo {/} {//} {.}", "", "", []string{"echo", "", "", ""}},
+		{"echo {name} {0}", "a b", "", []string{"echo", "{name}", ""}},
+	}
+
+	for _, test := range tests {
+
+		out, err := Expand(test.template, test.input, test.split)
+		if err != nil {
+			t.Fatalf("unexpected error expanding '%s': %s", test.template, err)
+		}
+
+		if len(out) != len(test.expected) {
+			t.Fatalf("Expected to have %d pieces for '%s', found %d: %q", len(test.expected), test.template, len(out), out)
+		}
+
+		for i, x := range test.expected {
+
+			if out[i] != x {
+				t.Errorf("expected '%s' for piece %d of '%s', got '%s'", x, i, test.template, out[i])
+			}
+		}
+	}
+}
+
+// TestRegexp tests expanding the named groups of a regular expression.
+func TestRegexp(t *testing.T) {
+
+	tmpl, err := Parse("useradd -u {uid} {user} {other} {1}")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tmpl.SetRegexp(regexp.MustCompile(`^(?P<user>[^:]+):[^:]*:(?P<uid>[0-9]+)`))
+
+	type TestCase struct {
+		input    string
+		expected []string
+	}
+
+	tests := []TestCase{
+		{"steve:x:1000:1000", []string{"useradd", "-u", "1000", "steve", "{other}", "steve:x:1000:1000"}},
+		{"not a match", []string{"useradd", "-u", "", "", "{other}", "not"}},
+	}
+
+	for _, test := range tests {
+
+		out := tmpl.Expand(test.input, "")
+
+		if len(out) != len(test.expected) {
+			t.Fatalf("Expected to have %d pieces, found %d: %q", len(test.expected), len(out), out)
+		}
+
+		for i, x := range test.expected {
+
+			if out[i] != x {
+				t.Errorf("expected '%s' for piece %d, got '%s'", x, i, out[i])
+			}
+		}
+	}
+
+	//
+	// Named placeholders only refer to the input if the regular
+	// expression has a group of that name.
+	//
+	for _, text := range []string{"echo {}", "echo {2}", "echo {-1}", "echo {1..}", "echo {/.}", "echo {+}", `echo "x{user}"`} {
+		tmpl, err = Parse(text)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		tmpl.SetRegexp(regexp.MustCompile(`(?P<user>.*)`))
+		if !tmpl.UsesInput() {
+			t.Errorf("UsesInput returned false for '%s'", text)
+		}
+	}
+	for _, text := range []string{"echo", "echo \\{}", "echo '{1}'", "awk {print}", "echo {uid}"} {
+		tmpl, err = Parse(text)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		tmpl.SetRegexp(regexp.MustCompile(`(?P<user>.*)`))
+		if tmpl.UsesInput() {
+			t.Errorf("UsesInput returned true for '%s'", text)
+		}
+	}
+}
+
+// TestFields tests splitting input into fields.
+func TestFields(t *testing.T) {
+
+	type TestCase struct {
+		input    string
+		split    string
+		expected []string
+	}
+
+	tests := []TestCase{
+		{"  one two\tthree \n", "", []string{"one", "two", "three"}},
+		{"root:0:0:", ":", []string{"root", "0", "0", ""}},
+		{"", "", []string{}},
+	}
+
+	for _, test := range tests {
+
+		out := Fields(test.input, test.split)
+
+		if len(out) != len(test.expected) {
+			t.Fatalf("Expected to have %d fields, found %d", len(test.expected), len(out))
+		}
+
+		for i, x := range test.expected {
+
+			if out[i] != x {
+				t.Errorf("expected '%s' for field %d, got '%s'", x, i, out[i])
+			}
+		}
+	}
+}
+
+// TestSelect tests selecting fields from input.
+func TestSelect(t *testing.T) {
+
+	type TestCase struct {
+		input    string
+		split    string
+		fields   []int
+		expected string
+	}
+
+	tests := []TestCase{
+		{"  1234 pts/0  00:00:01 bash", "", []int{4}, "bash"},
+		{"1234 pts/0  00:00:01 bash", "", []int{4, 1}, "bash 1234"},
+		{"root:x:0:0", ":", []int{1, 3}, "root:0"},
+		{"root:x:0:0", ":", []int{7, 1}, "root"},
+		{"one two", "", nil, ""},
+	}
+
+	for _, test := range tests {
+
+		out := Select(test.input, test.split, test.fields)
+		if out != test.expected {
+			t.Errorf("expected '%s' for '%s', got '%s'", test.expected, test.input, out)
+		}
+	}
+}